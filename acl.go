@@ -0,0 +1,664 @@
+package bitserver
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "errors"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+const defaultUser = "default"
+
+var (
+    errNoAuth = errors.New("NOAUTH Authentication required.")
+    errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// acl categories, derived from command flags
+var aclCategories = map[string]CommandFlag{
+    "write": CmdWrite,
+    "read": CmdReadOnly,
+    "admin": CmdAdmin,
+    "slots": CmdSlots,
+    "replication": CmdReplication,
+    "fast": CmdFast,
+    "pubsub": CmdPubSub,
+}
+
+type aclUser struct {
+    name        string
+    enabled     bool
+    nopass      bool
+    // sha256 of passwords in hex
+    passwords   map[string]struct{}
+    // allowed commands
+    commands    map[string]bool
+    allKeys     bool
+    keyPatterns []string
+}
+
+func newAclUser(name string) *aclUser {
+    return &aclUser{
+        name: name,
+        passwords: make(map[string]struct{}),
+        commands: make(map[string]bool),
+    }
+}
+
+func (u *aclUser) clone() *aclUser {
+    n := newAclUser(u.name)
+    n.enabled = u.enabled
+    n.nopass = u.nopass
+    for p, _ := range u.passwords {
+        n.passwords[p] = struct{}{}
+    }
+    for cmd, ok := range u.commands {
+        n.commands[cmd] = ok
+    }
+    n.allKeys = u.allKeys
+    n.keyPatterns = append(n.keyPatterns, u.keyPatterns...)
+    return n
+}
+
+func hashPassword(pass string) string {
+    sum := sha256.Sum256([]byte(pass))
+    return hex.EncodeToString(sum[:])
+}
+
+func (u *aclUser) setCommands(flag CommandFlag, allowed bool) {
+    for name, cmd := range globalCommand {
+        if flag == 0 || cmd.flag&flag != 0 {
+            u.commands[name] = allowed
+        }
+        for sub, subFlag := range cmd.subFlags {
+            if flag == 0 || (cmd.flag|subFlag)&flag != 0 {
+                u.commands[name + "|" + sub] = allowed
+            }
+        }
+    }
+}
+
+// setCommand allows or denies cmd, or one of its subcommands when name is cmd|sub
+func (u *aclUser) setCommand(name string, allowed bool) error {
+    cmdName, sub := name, ""
+    if i := strings.IndexByte(name, '|'); i != -1 {
+        cmdName, sub = name[:i], name[i + 1:]
+    }
+    cmd, ok := globalCommand[cmdName]
+    if !ok {
+        return fmt.Errorf("unknown command %s", name)
+    }
+    if sub != "" {
+        if _, ok := cmd.subFlags[sub]; !ok {
+            return fmt.Errorf("unknown subcommand %s", name)
+        }
+        u.commands[name] = allowed
+        return nil
+    }
+    u.commands[cmdName] = allowed
+    for sub, _ := range cmd.subFlags {
+        u.commands[cmdName + "|" + sub] = allowed
+    }
+    return nil
+}
+
+func (u *aclUser) applyRule(rule string) error {
+    switch lower := strings.ToLower(rule); {
+    case lower == "on":
+        u.enabled = true
+    case lower == "off":
+        u.enabled = false
+    case lower == "nopass":
+        u.nopass = true
+        u.passwords = make(map[string]struct{})
+    case lower == "resetpass":
+        u.nopass = false
+        u.passwords = make(map[string]struct{})
+    case lower == "allcommands" || lower == "+@all":
+        u.setCommands(0, true)
+    case lower == "nocommands" || lower == "-@all":
+        u.setCommands(0, false)
+    case lower == "allkeys" || lower == "~*":
+        u.allKeys = true
+        u.keyPatterns = nil
+    case lower == "resetkeys":
+        u.allKeys = false
+        u.keyPatterns = nil
+    case lower == "reset":
+        *u = *newAclUser(u.name)
+    case rule[0] == '>':
+        u.passwords[hashPassword(rule[1:])] = struct{}{}
+        u.nopass = false
+    case rule[0] == '<':
+        delete(u.passwords, hashPassword(rule[1:]))
+    case rule[0] == '#' || rule[0] == '!':
+        hash := strings.ToLower(rule[1:])
+        if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+            return fmt.Errorf("invalid password hash %s", rule[1:])
+        }
+        if rule[0] == '#' {
+            u.passwords[hash] = struct{}{}
+            u.nopass = false
+        } else {
+            delete(u.passwords, hash)
+        }
+    case rule[0] == '~':
+        if !u.allKeys {
+            u.keyPatterns = append(u.keyPatterns, rule[1:])
+        }
+    case strings.HasPrefix(lower, "+@") || strings.HasPrefix(lower, "-@"):
+        flag, ok := aclCategories[lower[2:]]
+        if !ok {
+            return fmt.Errorf("unknown category %s", rule[2:])
+        }
+        u.setCommands(flag, rule[0] == '+')
+    case rule[0] == '+' || rule[0] == '-':
+        return u.setCommand(lower[1:], rule[0] == '+')
+    default:
+        return fmt.Errorf("syntax error in acl rule '%s'", rule)
+    }
+    return nil
+}
+
+func (u *aclUser) checkPassword(pass string) bool {
+    if u.nopass {
+        return true
+    }
+    _, ok := u.passwords[hashPassword(pass)]
+    return ok
+}
+
+func (u *aclUser) matchKey(key []byte) bool {
+    if u.allKeys {
+        return true
+    }
+    for _, pattern := range u.keyPatterns {
+        if globMatch([]byte(pattern), key) {
+            return true
+        }
+    }
+    return false
+}
+
+func (u *aclUser) allCommands() bool {
+    for name, cmd := range globalCommand {
+        if !u.commands[name] {
+            return false
+        }
+        for sub, _ := range cmd.subFlags {
+            if !u.commands[name + "|" + sub] {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func (u *aclUser) commandRules() string {
+    if u.allCommands() {
+        return "+@all"
+    }
+    rules := []string{"-@all"}
+    for name, cmd := range globalCommand {
+        if u.commands[name] {
+            rules = append(rules, "+" + name)
+        }
+        // subcommands that differ from their command, "+" sorts before "-"
+        for sub, _ := range cmd.subFlags {
+            if allowed := u.commands[name + "|" + sub]; allowed != u.commands[name] {
+                if allowed {
+                    rules = append(rules, "+" + name + "|" + sub)
+                } else {
+                    rules = append(rules, "-" + name + "|" + sub)
+                }
+            }
+        }
+    }
+    sort.Strings(rules[1:])
+    return strings.Join(rules, " ")
+}
+
+// rules that rebuild this user, as used by ACL LIST and the acl file
+func (u *aclUser) describe() string {
+    rules := []string{"user", u.name}
+    if u.enabled {
+        rules = append(rules, "on")
+    } else {
+        rules = append(rules, "off")
+    }
+    if u.nopass {
+        rules = append(rules, "nopass")
+    }
+    hashes := make([]string, 0, len(u.passwords))
+    for hash, _ := range u.passwords {
+        hashes = append(hashes, "#" + hash)
+    }
+    sort.Strings(hashes)
+    rules = append(rules, hashes...)
+    if u.allKeys {
+        rules = append(rules, "~*")
+    }
+    for _, pattern := range u.keyPatterns {
+        rules = append(rules, "~" + pattern)
+    }
+    rules = append(rules, u.commandRules())
+    return strings.Join(rules, " ")
+}
+
+// globMatch matches s against a redis-style glob pattern (*, ?, [...], \x)
+func globMatch(pattern, s []byte) bool {
+    for len(pattern) > 0 {
+        switch pattern[0] {
+        case '*':
+            for len(pattern) > 1 && pattern[1] == '*' {
+                pattern = pattern[1:]
+            }
+            if len(pattern) == 1 {
+                return true
+            }
+            for i := 0; i <= len(s); i++ {
+                if globMatch(pattern[1:], s[i:]) {
+                    return true
+                }
+            }
+            return false
+        case '?':
+            if len(s) == 0 {
+                return false
+            }
+            s = s[1:]
+        case '[':
+            if len(s) == 0 {
+                return false
+            }
+            pattern = pattern[1:]
+            not := len(pattern) > 0 && pattern[0] == '^'
+            if not {
+                pattern = pattern[1:]
+            }
+            match := false
+            for len(pattern) > 0 && pattern[0] != ']' {
+                if pattern[0] == '\\' && len(pattern) >= 2 {
+                    pattern = pattern[1:]
+                    match = match || pattern[0] == s[0]
+                } else if len(pattern) >= 3 && pattern[1] == '-' {
+                    lo, hi := pattern[0], pattern[2]
+                    if lo > hi {
+                        lo, hi = hi, lo
+                    }
+                    match = match || (s[0] >= lo && s[0] <= hi)
+                    pattern = pattern[2:]
+                } else {
+                    match = match || pattern[0] == s[0]
+                }
+                pattern = pattern[1:]
+            }
+            if len(pattern) == 0 {
+                // unterminated class, treat end of pattern as ']'
+                return match != not && len(s) == 1
+            }
+            if match == not {
+                return false
+            }
+            s = s[1:]
+        case '\\':
+            if len(pattern) >= 2 {
+                pattern = pattern[1:]
+            }
+            fallthrough
+        default:
+            if len(s) == 0 || pattern[0] != s[0] {
+                return false
+            }
+            s = s[1:]
+        }
+        pattern = pattern[1:]
+    }
+    return len(s) == 0
+}
+
+func (s *Server) initAcl() error {
+    s.acl.Lock()
+    defer s.acl.Unlock()
+
+    s.acl.users = make(map[string]*aclUser)
+    s.acl.users[defaultUser] = s.newDefaultUser()
+
+    if s.config.AclFile == "" {
+        return nil
+    }
+    if _, err := os.Stat(s.config.AclFile); os.IsNotExist(err) {
+        return nil
+    }
+    return s.aclLoad()
+}
+
+func (s *Server) newDefaultUser() *aclUser {
+    u := newAclUser(defaultUser)
+    rules := []string{"on", "~*", "+@all", "nopass"}
+    if s.config.RequirePass != "" {
+        rules[3] = ">" + s.config.RequirePass
+    }
+    for _, rule := range rules {
+        u.applyRule(rule)
+    }
+    return u
+}
+
+// must be called with s.acl locked
+func (s *Server) aclLoad() error {
+    f, err := os.Open(s.config.AclFile)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    users := make(map[string]*aclUser)
+    scanner := bufio.NewScanner(f)
+    for lineno := 1; scanner.Scan(); lineno++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        if len(fields) < 2 || fields[0] != "user" {
+            return fmt.Errorf("%s:%d: line must start with 'user <name>'", s.config.AclFile, lineno)
+        }
+        u := newAclUser(fields[1])
+        for _, rule := range fields[2:] {
+            if err := u.applyRule(rule); err != nil {
+                return fmt.Errorf("%s:%d: %s", s.config.AclFile, lineno, err)
+            }
+        }
+        users[u.name] = u
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+
+    if _, ok := users[defaultUser]; !ok {
+        users[defaultUser] = s.newDefaultUser()
+    }
+    s.acl.users = users
+    return nil
+}
+
+// must be called with s.acl locked
+func (s *Server) aclSave() error {
+    if s.config.AclFile == "" {
+        return nil
+    }
+    names := make([]string, 0, len(s.acl.users))
+    for name, _ := range s.acl.users {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var buf []byte
+    for _, name := range names {
+        buf = append(buf, s.acl.users[name].describe()...)
+        buf = append(buf, '\n')
+    }
+
+    tmp := s.config.AclFile + ".tmp"
+    if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.config.AclFile)
+}
+
+func (s *Server) aclAuth(name string, pass string) error {
+    s.acl.RLock()
+    defer s.acl.RUnlock()
+
+    u := s.acl.users[name]
+    if u == nil || !u.enabled || !u.checkPassword(pass) {
+        return errWrongPass
+    }
+    return nil
+}
+
+// aclDefaultLogin authenticates c as default user if it needs no password, caller holds s.acl
+func (s *Server) aclDefaultLogin(c *conn) error {
+    if c.user.Get() != "" {
+        return nil
+    }
+    if u := s.acl.users[defaultUser]; u != nil && u.enabled && u.nopass {
+        c.user.Set(defaultUser)
+        return nil
+    }
+    return errNoAuth
+}
+
+// aclCheck returns an error if conn c is not allowed to run command f with args
+func (s *Server) aclCheck(c *conn, f *command, args [][]byte) error {
+    if f.flag&CmdNoAuth != 0 {
+        return nil
+    }
+
+    s.acl.RLock()
+    defer s.acl.RUnlock()
+
+    if err := s.aclDefaultLogin(c); err != nil {
+        return err
+    }
+
+    u := s.acl.users[c.user.Get()]
+    if u == nil || !u.enabled {
+        c.user.Set("")
+        return errNoAuth
+    }
+    if name := f.aclName(args); !u.commands[name] {
+        return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", name)
+    }
+    for _, key := range f.keys(args) {
+        if !u.matchKey(key) {
+            return fmt.Errorf("NOPERM this user has no permissions to access one of the keys used as arguments")
+        }
+    }
+    return nil
+}
+
+// AUTH [username] password
+func AuthCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if len(args) > 2 {
+        return toRespErrorf("len(args) = %d, expect <= 2", len(args))
+    }
+
+    name, pass := defaultUser, string(args[0])
+    if len(args) == 2 {
+        name, pass = string(args[0]), string(args[1])
+    } else if c.s.config.RequirePass == "" {
+        s := c.s
+        s.acl.RLock()
+        u := s.acl.users[defaultUser]
+        nopass := u != nil && u.nopass
+        s.acl.RUnlock()
+        if nopass {
+            return toRespErrorf("AUTH <password> called without any password configured for the default user")
+        }
+    }
+
+    if err := c.s.aclAuth(name, pass); err != nil {
+        return toRespError(err)
+    }
+    c.user.Set(name)
+    return redis.NewString("OK"), nil
+}
+
+// ACL SETUSER|GETUSER|DELUSER|LIST|USERS|WHOAMI|CAT|SAVE|LOAD [args...]
+func AclCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    sub := strings.ToLower(string(args[0]))
+    args = args[1:]
+
+    switch sub {
+    case "setuser":
+        if len(args) < 1 {
+            return toRespErrorf("len(args) = %d, expect >= 1", len(args))
+        }
+        name := string(args[0])
+        s.acl.Lock()
+        defer s.acl.Unlock()
+
+        var u *aclUser
+        if old := s.acl.users[name]; old != nil {
+            u = old.clone()
+        } else {
+            u = newAclUser(name)
+        }
+        for _, rule := range args[1:] {
+            if len(rule) == 0 {
+                return toRespErrorf("empty acl rule")
+            }
+            if err := u.applyRule(string(rule)); err != nil {
+                return toRespErrorf("error in ACL SETUSER modifier '%s': %s", rule, err)
+            }
+        }
+        s.acl.users[name] = u
+        if err := s.aclSave(); err != nil {
+            return toRespError(err)
+        }
+        return redis.NewString("OK"), nil
+    case "getuser":
+        if len(args) != 1 {
+            return toRespErrorf("len(args) = %d, expect = 1", len(args))
+        }
+        s.acl.RLock()
+        defer s.acl.RUnlock()
+
+        u := s.acl.users[string(args[0])]
+        if u == nil {
+            return redis.NewBulkBytes(nil), nil
+        }
+        flags := redis.NewArray()
+        if u.enabled {
+            flags.AppendBulkBytes([]byte("on"))
+        } else {
+            flags.AppendBulkBytes([]byte("off"))
+        }
+        if u.allKeys {
+            flags.AppendBulkBytes([]byte("allkeys"))
+        }
+        if u.allCommands() {
+            flags.AppendBulkBytes([]byte("allcommands"))
+        }
+        if u.nopass {
+            flags.AppendBulkBytes([]byte("nopass"))
+        }
+        passwords := redis.NewArray()
+        for hash, _ := range u.passwords {
+            passwords.AppendBulkBytes([]byte(hash))
+        }
+        keys := redis.NewArray()
+        for _, pattern := range u.keyPatterns {
+            keys.AppendBulkBytes([]byte(pattern))
+        }
+
+        resp := redis.NewArray()
+        resp.AppendBulkBytes([]byte("flags"))
+        resp.Append(flags)
+        resp.AppendBulkBytes([]byte("passwords"))
+        resp.Append(passwords)
+        resp.AppendBulkBytes([]byte("commands"))
+        resp.AppendBulkBytes([]byte(u.commandRules()))
+        resp.AppendBulkBytes([]byte("keys"))
+        resp.Append(keys)
+        return resp, nil
+    case "deluser":
+        if len(args) < 1 {
+            return toRespErrorf("len(args) = %d, expect >= 1", len(args))
+        }
+        s.acl.Lock()
+        defer s.acl.Unlock()
+
+        var n int64
+        for _, name := range args {
+            if string(name) == defaultUser {
+                return toRespErrorf("the 'default' user cannot be removed")
+            }
+            if _, ok := s.acl.users[string(name)]; ok {
+                delete(s.acl.users, string(name))
+                n++
+            }
+        }
+        if err := s.aclSave(); err != nil {
+            return toRespError(err)
+        }
+        return redis.NewInt(n), nil
+    case "list", "users":
+        s.acl.RLock()
+        defer s.acl.RUnlock()
+
+        names := make([]string, 0, len(s.acl.users))
+        for name, _ := range s.acl.users {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        resp := redis.NewArray()
+        for _, name := range names {
+            if sub == "list" {
+                resp.AppendBulkBytes([]byte(s.acl.users[name].describe()))
+            } else {
+                resp.AppendBulkBytes([]byte(name))
+            }
+        }
+        return resp, nil
+    case "whoami":
+        return redis.NewBulkBytesWithString(c.user.Get()), nil
+    case "cat":
+        resp := redis.NewArray()
+        if len(args) == 0 {
+            for cat, _ := range aclCategories {
+                resp.AppendBulkBytes([]byte(cat))
+            }
+            return resp, nil
+        }
+        flag, ok := aclCategories[strings.ToLower(string(args[0]))]
+        if !ok {
+            return toRespErrorf("unknown category %s", args[0])
+        }
+        for name, cmd := range globalCommand {
+            if cmd.flag&flag != 0 {
+                resp.AppendBulkBytes([]byte(name))
+            }
+            for sub, subFlag := range cmd.subFlags {
+                if cmd.flag&flag == 0 && subFlag&flag != 0 {
+                    resp.AppendBulkBytes([]byte(name + "|" + sub))
+                }
+            }
+        }
+        return resp, nil
+    case "save", "load":
+        if s.config.AclFile == "" {
+            return toRespErrorf("this instance is not configured to use an ACL file")
+        }
+        s.acl.Lock()
+        defer s.acl.Unlock()
+
+        var err error
+        if sub == "save" {
+            err = s.aclSave()
+        } else {
+            err = s.aclLoad()
+        }
+        if err != nil {
+            return toRespError(err)
+        }
+        return redis.NewString("OK"), nil
+    default:
+        return toRespErrorf("unknown ACL subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "auth", f: AuthCmd, flag: CmdNoAuth|CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: -2,
+        group: "connection", summary: "Authenticate to the server"})
+    register(&command{name: "acl", f: AclCmd, flag: CmdAdmin|CmdLoading|CmdStale|CmdNoScript, arity: -2,
+        group: "server", summary: "Manage acl users"})
+}
@@ -0,0 +1,131 @@
+package bitserver
+
+import (
+    "path/filepath"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testAclSuite struct {
+    s *testSvrNode
+    aclFile string
+}
+
+var _ = Suite(&testAclSuite{})
+
+func (s *testAclSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17800
+    config.Dbpath = c.MkDir()
+    config.RequirePass = "foobared"
+    config.AclFile = filepath.Join(c.MkDir(), "users.acl")
+    s.aclFile = config.AclFile
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testAclSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testAclSuite) TestRequirePass(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkError(c, "NOAUTH.*", "get", "a")
+    nc.checkError(c, "WRONGPASS.*", "auth", "bad")
+    nc.checkOK(c, "auth", "foobared")
+    nc.checkOK(c, "set", "a", "1")
+    nc.checkString(c, "1", "get", "a")
+    nc.checkString(c, "default", "acl", "whoami")
+}
+
+func (s *testAclSuite) TestAclUser(c *C) {
+    admin := testGetConn(c, s.s.port)
+    defer admin.Close()
+    admin.checkOK(c, "auth", "foobared")
+    admin.checkOK(c, "acl", "setuser", "reader", "on", ">secret", "~app:*", "+@read")
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "auth", "reader", "secret")
+    nc.checkString(c, "reader", "acl", "whoami")
+    nc.checkError(c, "NOPERM.*", "set", "app:1", "1")
+    nc.checkError(c, "NOPERM.*", "get", "other")
+    nc.checkError(c, "NOPERM.*", "slaveof", "no", "one")
+    resp := nc.doCmd(c, "get", "app:1")
+    c.Assert(resp, FitsTypeOf, (*redis.BulkBytes)(nil))
+
+    // permissions change on the fly
+    admin.checkOK(c, "acl", "setuser", "reader", "+set")
+    nc.checkOK(c, "set", "app:1", "1")
+
+    admin.checkOK(c, "acl", "setuser", "reader", "off")
+    nc.checkError(c, "NOAUTH.*", "get", "app:1")
+
+    admin.checkInt(c, 1, "acl", "deluser", "reader")
+    admin.checkError(c, ".*cannot be removed", "acl", "deluser", "default")
+}
+
+func (s *testAclSuite) TestClientSubcommands(c *C) {
+    admin := testGetConn(c, s.s.port)
+    defer admin.Close()
+    admin.checkOK(c, "auth", "foobared")
+    admin.checkOK(c, "acl", "setuser", "app", "on", "nopass", "~*", "+@all", "-@admin", "+client|list")
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "auth", "app", "any")
+    nc.checkOK(c, "client", "setname", "app")
+    nc.checkString(c, "app", "client", "getname")
+    nc.checkError(c, "NOPERM.*client\\|kill.*", "client", "kill", "id", "1")
+    nc.checkError(c, "NOPERM.*", "client", "pause", "10")
+    resp := nc.doCmd(c, "client", "list")
+    c.Assert(resp, Not(FitsTypeOf), (*redis.Error)(nil))
+
+    // a subcommand can be denied on its own
+    admin.checkOK(c, "acl", "setuser", "app", "-client|list")
+    nc.checkError(c, "NOPERM.*", "client", "list")
+    admin.checkInt(c, 1, "acl", "deluser", "app")
+}
+
+func (s *testAclSuite) TestAclFile(c *C) {
+    admin := testGetConn(c, s.s.port)
+    defer admin.Close()
+    admin.checkOK(c, "auth", "foobared")
+    admin.checkOK(c, "acl", "setuser", "persist", "on", "nopass", "~*", "+get")
+
+    config := DefaultConfig()
+    config.Listen = 17801
+    config.Dbpath = c.MkDir()
+    config.AclFile = s.aclFile
+    node := testCreateServerWithConfig(c, config)
+    defer node.Close()
+
+    nc := testGetConn(c, node.port)
+    defer nc.Close()
+    nc.checkOK(c, "auth", "persist", "any")
+    nc.checkError(c, "NOPERM.*", "set", "a", "1")
+}
+
+func (s *testAclSuite) TestGlobMatch(c *C) {
+    tests := []struct {
+        pattern, s string
+        match bool
+    }{
+        {"*", "", true},
+        {"app:*", "app:1", true},
+        {"app:*", "ap", false},
+        {"a?c", "abc", true},
+        {"a?c", "ac", false},
+        {"[a-c]x", "bx", true},
+        {"[^a-c]x", "bx", false},
+        {"a\\*", "a*", true},
+        {"a\\*", "ab", false},
+        {"*{tag}*", "x{tag}y", true},
+    }
+    for _, t := range tests {
+        c.Assert(globMatch([]byte(t.pattern), []byte(t.s)), Equals, t.match, Commentf("%s %s", t.pattern, t.s))
+    }
+}
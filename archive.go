@@ -0,0 +1,315 @@
+package bitserver
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/reborndb/go/atomic2"
+)
+
+// index of an archive directory, one line per archived data-file
+const archiveIndex = "ARCHIVE"
+
+type archiveState struct {
+    // data-files before it are archived, guarded by s.backup
+    fileId      int64
+    files       atomic2.Int64
+    lastFileId  atomic2.Int64
+    errors      atomic2.Int64
+}
+
+// archivedFile is a data-file rotated out of active at time rotated
+type archivedFile struct {
+    fileId  int64
+    name    string
+    size    int64
+    rotated int64
+}
+
+// initArchive starts copying data-files into ArchiveDir once they rotate out of active.
+// Files rotated before are not archived, take a base backup after enabling it.
+func (s *Server) initArchive() error {
+    dir := s.config.ArchiveDir
+    if dir == "" {
+        return nil
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    s.archive.fileId = s.bc.ActiveFileId()
+    if s.bc.GetDataFilePath(s.archive.fileId) == "" {
+        return errNoDataFiles
+    }
+    s.archive.lastFileId.Set(-1)
+
+    s.goFunc(func() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.signal:
+                return
+            case <-ticker.C:
+                // don't let merges delete files before they are archived
+                s.backup.Lock()
+                s.archiveDataFilesLocked()
+                s.backup.Unlock()
+            }
+        }
+    })
+    return nil
+}
+
+// archiveDataFilesLocked archives data-files rotated out of active since the last
+// call, merges call it too before deleting any. It holds s.backup.
+func (s *Server) archiveDataFilesLocked() error {
+    dir := s.config.ArchiveDir
+    if dir == "" {
+        return nil
+    }
+    err := s.archiveDataFiles(dir)
+    if err != nil {
+        s.archive.errors.Incr()
+        s.logger.Printf("archive data-files failed, err = %s", err)
+    }
+    return err
+}
+
+func (s *Server) archiveDataFiles(dir string) error {
+    bc := s.bc
+    activeFileId := bc.ActiveFileId()
+    if activeFileId == s.archive.fileId {
+        return nil
+    }
+
+    for fileId := s.archive.fileId; fileId < activeFileId; {
+        path := bc.GetDataFilePath(fileId)
+        if _, err := os.Stat(path); err == nil {
+            if err := archiveDataFile(dir, fileId, path); err != nil {
+                return err
+            }
+            s.archive.files.Incr()
+            s.archive.lastFileId.Set(fileId)
+        }
+        next := bc.NextDataFileId(fileId)
+        if next <= fileId {
+            break
+        }
+        fileId = next
+    }
+    s.archive.fileId = activeFileId
+    return nil
+}
+
+func archiveDataFile(dir string, fileId int64, path string) error {
+    name := filepath.Base(path)
+    if err := copyFile(path, filepath.Join(dir, name), -1); err != nil {
+        return err
+    }
+    fi, err := os.Stat(filepath.Join(dir, name))
+    if err != nil {
+        return err
+    }
+
+    f, err := os.OpenFile(filepath.Join(dir, archiveIndex), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    if _, err := fmt.Fprintf(f, "file %d %s %d %d\n", fileId, name, fi.Size(), time.Now().Unix()); err != nil {
+        return err
+    }
+    return f.Sync()
+}
+
+func readArchiveIndex(dir string) ([]*archivedFile, error) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, archiveIndex))
+    if err != nil {
+        return nil, err
+    }
+    // a data-file archived twice keeps its last copy
+    byId := make(map[int64]*archivedFile)
+    for i, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        if len(fields) != 5 || fields[0] != "file" {
+            return nil, fmt.Errorf("invalid archive index line %d: %s", i + 1, line)
+        }
+        f := &archivedFile{name: fields[2]}
+        var errs [3]error
+        f.fileId, errs[0] = strconv.ParseInt(fields[1], 10, 64)
+        f.size, errs[1] = strconv.ParseInt(fields[3], 10, 64)
+        f.rotated, errs[2] = strconv.ParseInt(fields[4], 10, 64)
+        for _, err := range errs {
+            if err != nil {
+                return nil, fmt.Errorf("invalid archive index line %d: %s", i + 1, line)
+            }
+        }
+        byId[f.fileId] = f
+    }
+
+    files := make([]*archivedFile, 0, len(byId))
+    for _, f := range byId {
+        files = append(files, f)
+    }
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].fileId < files[j].fileId
+    })
+    return files, nil
+}
+
+// RestoreTarget is where a point-in-time restore stops: at unix time Time,
+// or before the record at FileId:Offset if Time is 0
+type RestoreTarget struct {
+    Time    int64
+    FileId  int64
+    Offset  int64
+}
+
+// ParseRestoreTarget parses "fileId:offset", a unix timestamp or an RFC3339 time
+func ParseRestoreTarget(s string) (*RestoreTarget, error) {
+    if i := strings.IndexByte(s, ':'); i > 0 && !strings.Contains(s, "T") {
+        fileId, err1 := strconv.ParseInt(s[:i], 10, 64)
+        offset, err2 := strconv.ParseInt(s[i + 1:], 10, 64)
+        if err1 != nil || err2 != nil || offset < 0 {
+            return nil, fmt.Errorf("invalid restore target %s", s)
+        }
+        return &RestoreTarget{FileId: fileId, Offset: offset}, nil
+    }
+    if ts, err := strconv.ParseInt(s, 10, 64); err == nil && ts > 0 {
+        return &RestoreTarget{Time: ts}, nil
+    }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        return nil, fmt.Errorf("invalid restore target %s", s)
+    }
+    return &RestoreTarget{Time: t.Unix()}, nil
+}
+
+// RestorePointInTime restores the base backup into the empty dbpath, then
+// replays data-files of archiveDir written after the backup up to target
+func RestorePointInTime(base string, archiveDir string, dbpath string, target *RestoreTarget) error {
+    activeFileId, err := readBackupActive(base)
+    if err != nil {
+        return err
+    }
+    if target.Time == 0 && target.FileId < activeFileId {
+        return fmt.Errorf("target %d:%d is before the base backup", target.FileId, target.Offset)
+    }
+    files, err := readArchiveIndex(archiveDir)
+    if err != nil {
+        return err
+    }
+    if err := RestoreBackup(base, dbpath); err != nil {
+        return err
+    }
+
+    // data-file cut at the target, and where
+    cutFileId, cutOffset := int64(-1), int64(-1)
+    for _, f := range files {
+        if f.fileId < activeFileId {
+            continue
+        }
+        if target.Time == 0 && f.fileId > target.FileId {
+            break
+        }
+        // the archived copy of the active file of the backup is complete
+        if err := copyFile(filepath.Join(archiveDir, f.name), filepath.Join(dbpath, f.name), -1); err != nil {
+            return err
+        }
+        if target.Time == 0 && f.fileId == target.FileId {
+            cutFileId, cutOffset = f.fileId, target.Offset
+            break
+        }
+        if target.Time != 0 && f.rotated > target.Time {
+            // the file spans the target, records past it are dropped below
+            cutFileId = f.fileId
+            break
+        }
+        log.Printf("replayed archived data-file[%d]", f.fileId)
+    }
+
+    if cutFileId < 0 {
+        log.Printf("archive ends before the restore target")
+        return nil
+    }
+    return cutDataFile(dbpath, cutFileId, cutOffset, target)
+}
+
+// cutDataFile truncates data-file fileId of dbpath at offset, or at the first record
+// written after target.Time if offset < 0. Commit groups are restored whole, a cut
+// inside one moves back to where it starts.
+func cutDataFile(dbpath string, fileId int64, offset int64, target *RestoreTarget) error {
+    bc, err := openBitcaskStorage(dbpath)
+    if err != nil {
+        return err
+    }
+    path := bc.GetDataFilePath(fileId)
+
+    var pos, groupStart int64
+    // timestamp of the last record with trailer, tombstones following it share it
+    ts := int64(-1)
+    inGroup := false
+    for {
+        if offset >= 0 && pos >= offset {
+            break
+        }
+        rec, err := bc.RefRecord(fileId, pos)
+        if err != nil {
+            break
+        }
+        if rec.Key() != nil {
+            ts = int64(rec.Timestamp())
+        }
+        if offset < 0 {
+            if ts < 0 {
+                bc.Close()
+                return fmt.Errorf("record at %d:%d has no timestamp, restore to a fileId:offset target instead", fileId, pos)
+            }
+            if ts > target.Time {
+                break
+            }
+        }
+        if !inGroup {
+            groupStart = pos
+        }
+        if rec.Key() != nil {
+            inGroup = rec.More()
+        }
+        pos += rec.Size()
+    }
+    bc.Close()
+
+    if offset >= 0 && pos != offset {
+        return fmt.Errorf("offset %d of data-file[%d] is not a record boundary", offset, fileId)
+    }
+    if inGroup {
+        log.Printf("target is inside a commit group of data-file[%d], cut at offset %d before it", fileId, groupStart)
+        pos = groupStart
+    }
+    log.Printf("replayed data-file[%d] up to offset %d", fileId, pos)
+    return os.Truncate(path, pos)
+}
+
+// readBackupActive returns the active data-file of a backup, from its manifest
+func readBackupActive(dir string) (int64, error) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, backupManifest))
+    if err != nil {
+        return 0, err
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 3 && fields[0] == "active" {
+            return strconv.ParseInt(fields[1], 10, 64)
+        }
+    }
+    return 0, fmt.Errorf("no active data-file in manifest of %s", dir)
+}
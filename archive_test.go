@@ -0,0 +1,89 @@
+package bitserver
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testArchiveSuite struct {
+}
+
+var _ = Suite(&testArchiveSuite{})
+
+func (s *testArchiveSuite) TestParseRestoreTarget(c *C) {
+    t, err := ParseRestoreTarget("3:1024")
+    c.Assert(err, IsNil)
+    c.Assert(*t, Equals, RestoreTarget{FileId: 3, Offset: 1024})
+
+    t, err = ParseRestoreTarget("1700000000")
+    c.Assert(err, IsNil)
+    c.Assert(*t, Equals, RestoreTarget{Time: 1700000000})
+
+    t, err = ParseRestoreTarget("2023-11-14T22:13:20Z")
+    c.Assert(err, IsNil)
+    c.Assert(*t, Equals, RestoreTarget{Time: 1700000000})
+
+    _, err = ParseRestoreTarget("3:-1")
+    c.Assert(err, NotNil)
+    _, err = ParseRestoreTarget("yesterday")
+    c.Assert(err, NotNil)
+}
+
+func (s *testArchiveSuite) TestArchiveIndex(c *C) {
+    dir := c.MkDir()
+    index := "file 2 2.data 100 1700000001\nfile 1 1.data 50 1700000000\nfile 2 2.data 120 1700000002\n"
+    c.Assert(ioutil.WriteFile(filepath.Join(dir, archiveIndex), []byte(index), 0644), IsNil)
+
+    files, err := readArchiveIndex(dir)
+    c.Assert(err, IsNil)
+    c.Assert(files, HasLen, 2)
+    c.Assert(*files[0], Equals, archivedFile{fileId: 1, name: "1.data", size: 50, rotated: 1700000000})
+    c.Assert(*files[1], Equals, archivedFile{fileId: 2, name: "2.data", size: 120, rotated: 1700000002})
+
+    c.Assert(ioutil.WriteFile(filepath.Join(dir, archiveIndex), []byte("file 1\n"), 0644), IsNil)
+    _, err = readArchiveIndex(dir)
+    c.Assert(err, ErrorMatches, "invalid archive index line 1.*")
+}
+
+func (s *testArchiveSuite) TestTargetBeforeBase(c *C) {
+    base := c.MkDir()
+    c.Assert(ioutil.WriteFile(filepath.Join(base, backupManifest), []byte("time 1\nactive 5 100\n"), 0644), IsNil)
+    err := RestorePointInTime(base, c.MkDir(), c.MkDir(), &RestoreTarget{FileId: 4})
+    c.Assert(err, ErrorMatches, ".*before the base backup")
+}
+
+func (s *testArchiveSuite) TestCutByTime(c *C) {
+    dir := c.MkDir()
+    b, err := openBitcaskStorage(dir)
+    c.Assert(err, IsNil)
+    c.Assert(b.Set([]byte("a"), []byte("1")), IsNil)
+    c.Assert(b.WriteBatch([]writeOp{{key: []byte("b"), value: []byte("2")}, {key: []byte("c"), value: []byte("3")}}), IsNil)
+    fileId := b.ActiveFileId()
+    path := b.GetDataFilePath(fileId)
+    b.Close()
+    fi, err := os.Stat(path)
+    c.Assert(err, IsNil)
+    size := fi.Size()
+
+    now := time.Now().Unix()
+    c.Assert(cutDataFile(dir, fileId, -1, &RestoreTarget{Time: now + 3600}), IsNil)
+    fi, err = os.Stat(path)
+    c.Assert(err, IsNil)
+    c.Assert(fi.Size(), Equals, size)
+    c.Assert(cutDataFile(dir, fileId, -1, &RestoreTarget{Time: now - 3600}), IsNil)
+    fi, err = os.Stat(path)
+    c.Assert(err, IsNil)
+    c.Assert(fi.Size(), Equals, int64(0))
+
+    // values without trailer tell no time
+    b, err = openBitcaskStorage(dir)
+    c.Assert(err, IsNil)
+    c.Assert(b.BitCask.Set([]byte("old"), []byte("v")), IsNil)
+    fileId = b.ActiveFileId()
+    b.Close()
+    err = cutDataFile(dir, fileId, -1, &RestoreTarget{Time: now})
+    c.Assert(err, ErrorMatches, "record at .* has no timestamp.*")
+}
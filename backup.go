@@ -0,0 +1,318 @@
+package bitserver
+
+import (
+    "bufio"
+    "crypto/md5"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/reborndb/go/atomic2"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// name of the manifest in a backup directory, written last
+const backupManifest = "MANIFEST"
+
+type backupState struct {
+    // one backup at a time, merges hold it as well so no file is deleted mid-backup
+    sync.Mutex
+    running     atomic2.Int64
+    lastTime    atomic2.Int64
+    lastStatus  atomic2.String
+    lastDir     atomic2.String
+}
+
+var errBackupInProgress = errors.New("Background save already in progress")
+
+// backupFile is a file of a backup, as in its manifest
+type backupFile struct {
+    name    string
+    size    int64
+    md5     string
+}
+
+// backupTo writes a consistent snapshot of the data directory into dir, which must be empty
+func (s *Server) backupTo(dir string) error {
+    if !s.backup.running.CompareAndSwap(0, 1) {
+        return errBackupInProgress
+    }
+    return s.runBackup(dir)
+}
+
+// runBackup backs up into dir, the caller set backup.running
+func (s *Server) runBackup(dir string) error {
+    defer s.backup.running.Set(0)
+    s.backup.Lock()
+    defer s.backup.Unlock()
+
+    err := s.doBackup(dir)
+    if err != nil {
+        s.logger.Printf("backup to %s failed, err = %s", dir, err)
+        s.backup.lastStatus.Set("err")
+        return err
+    }
+    s.backup.lastStatus.Set("ok")
+    s.backup.lastTime.Set(time.Now().Unix())
+    s.backup.lastDir.Set(dir)
+    return nil
+}
+
+func (s *Server) doBackup(dir string) error {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    if names, err := readDirNames(dir); err != nil {
+        return err
+    } else if len(names) != 0 {
+        return fmt.Errorf("backup directory %s is not empty", dir)
+    }
+
+    // The active data-file is not rotated, bitcask can't be asked to: no write is
+    // applied while we pick files, so it is copied up to its current size instead,
+    // the same snapshot a rotation would give.
+    bc := s.bc
+    s.commitMu.Lock()
+    s.dataLock.Lock()
+    activeFileId := bc.ActiveFileId()
+    activePath := bc.GetDataFilePath(activeFileId)
+    if activePath == "" {
+        s.dataLock.Unlock()
+        s.commitMu.Unlock()
+        return errNoDataFiles
+    }
+    var activeSize int64
+    if fi, err := os.Stat(activePath); err == nil {
+        activeSize = fi.Size()
+    }
+    dbpath := filepath.Dir(activePath)
+    names, err := readDirNames(dbpath)
+    s.dataLock.Unlock()
+    s.commitMu.Unlock()
+    if err != nil {
+        return err
+    }
+    // merges wait for s.backup, so no data-file is deleted while we copy
+    dataFiles := make(map[string]int64)
+    for _, fileId := range dataFileIds(bc) {
+        dataFiles[filepath.Base(bc.GetDataFilePath(fileId))] = fileId
+    }
+
+    var files []*backupFile
+    for _, name := range names {
+        src := filepath.Join(dbpath, name)
+        dst := filepath.Join(dir, name)
+        fi, err := os.Stat(src)
+        if err != nil {
+            return err
+        }
+        if !fi.Mode().IsRegular() {
+            continue
+        }
+
+        if src == activePath {
+            err = copyFile(src, dst, activeSize)
+        } else {
+            err = linkOrCopyFile(src, dst)
+        }
+        if err != nil {
+            return err
+        }
+        f, err := md5File(dst)
+        if err != nil {
+            return err
+        }
+        f.name = name
+        files = append(files, f)
+    }
+
+    // manifest goes last, a backup without it is incomplete
+    tmp := filepath.Join(dir, backupManifest + ".tmp")
+    mf, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(mf)
+    fmt.Fprintf(w, "time %d\n", time.Now().Unix())
+    fmt.Fprintf(w, "active %d %d\n", activeFileId, activeSize)
+    // md5s of the copies, as GetFileMetas would compute them
+    for _, f := range files {
+        if fileId, ok := dataFiles[f.name]; ok {
+            fmt.Fprintf(w, "datafile %d %s\n", fileId, f.md5)
+        }
+    }
+    for _, f := range files {
+        fmt.Fprintf(w, "file %s %d %s\n", f.name, f.size, f.md5)
+    }
+    if err := w.Flush(); err != nil {
+        mf.Close()
+        return err
+    }
+    if err := mf.Sync(); err != nil {
+        mf.Close()
+        return err
+    }
+    mf.Close()
+    return os.Rename(tmp, filepath.Join(dir, backupManifest))
+}
+
+// RestoreBackup verifies the backup in dir and copies it into the empty dbpath
+func RestoreBackup(dir string, dbpath string) error {
+    files, err := readBackupManifest(dir)
+    if err != nil {
+        return err
+    }
+    for _, f := range files {
+        got, err := md5File(filepath.Join(dir, f.name))
+        if err != nil {
+            return err
+        }
+        if got.size != f.size || got.md5 != f.md5 {
+            return fmt.Errorf("backup file %s is corrupted", f.name)
+        }
+    }
+
+    if err := os.MkdirAll(dbpath, 0755); err != nil {
+        return err
+    }
+    if names, err := readDirNames(dbpath); err != nil {
+        return err
+    } else if len(names) != 0 {
+        return fmt.Errorf("dbpath %s is not empty", dbpath)
+    }
+    for _, f := range files {
+        if err := copyFile(filepath.Join(dir, f.name), filepath.Join(dbpath, f.name), -1); err != nil {
+            return err
+        }
+    }
+    log.Printf("restored %d files from %s into %s", len(files), dir, dbpath)
+    return nil
+}
+
+func readBackupManifest(dir string) ([]*backupFile, error) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, backupManifest))
+    if err != nil {
+        return nil, err
+    }
+    var files []*backupFile
+    for i, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 || fields[0] != "file" {
+            continue
+        }
+        if len(fields) != 4 {
+            return nil, fmt.Errorf("invalid manifest line %d: %s", i + 1, line)
+        }
+        size, err := strconv.ParseInt(fields[2], 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid manifest line %d: %s", i + 1, line)
+        }
+        files = append(files, &backupFile{name: fields[1], size: size, md5: fields[3]})
+    }
+    return files, nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+    f, err := os.Open(dir)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return f.Readdirnames(-1)
+}
+
+func linkOrCopyFile(src, dst string) error {
+    if err := os.Link(src, dst); err == nil {
+        return nil
+    }
+    return copyFile(src, dst, -1)
+}
+
+// copyFile copies the first size bytes of src, or all of it if size < 0
+func copyFile(src, dst string, size int64) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.Create(dst)
+    if err != nil {
+        return err
+    }
+    defer out.Close()
+
+    var r io.Reader = in
+    if size >= 0 {
+        r = io.LimitReader(in, size)
+    }
+    if _, err := io.Copy(out, r); err != nil {
+        return err
+    }
+    return out.Sync()
+}
+
+func md5File(path string) (*backupFile, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    h := md5.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return nil, err
+    }
+    return &backupFile{size: n, md5: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// bgsaveDir is where BGSAVE puts a backup, a new directory under BackupDir
+func (s *Server) bgsaveDir() string {
+    dir := s.config.BackupDir
+    if dir == "" {
+        dir = filepath.Clean(s.config.Dbpath) + "-backup"
+    }
+    return filepath.Join(dir, fmt.Sprintf("backup-%d", time.Now().UnixNano()))
+}
+
+// BACKUP path
+func BackupCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if err := c.s.backupTo(string(args[0])); err != nil {
+        return toRespError(err)
+    }
+    return redis.NewString("OK"), nil
+}
+
+// BGSAVE
+func BgsaveCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    if !s.backup.running.CompareAndSwap(0, 1) {
+        return toRespError(errBackupInProgress)
+    }
+    dir := s.bgsaveDir()
+    s.goFunc(func() {
+        s.runBackup(dir)
+    })
+    return redis.NewString("Background saving started"), nil
+}
+
+// LASTSAVE
+func LastsaveCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    return redis.NewInt(c.s.backup.lastTime.Get()), nil
+}
+
+func init() {
+    register(&command{name: "backup", f: BackupCmd, flag: CmdAdmin|CmdNoScript|CmdNoMulti, arity: 2,
+        group: "server", summary: "Take a consistent snapshot of the data directory"})
+    register(&command{name: "bgsave", f: BgsaveCmd, flag: CmdAdmin|CmdNoScript|CmdNoMulti, arity: 1,
+        group: "server", summary: "Take a backup in the background"})
+    register(&command{name: "lastsave", f: LastsaveCmd, flag: CmdReadOnly|CmdFast|CmdLoading|CmdStale, arity: 1,
+        group: "server", summary: "Get the unix time of the last successful backup"})
+}
@@ -0,0 +1,80 @@
+package bitserver
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testBackupSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testBackupSuite{})
+
+func (s *testBackupSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17910
+    config.Dbpath = c.MkDir()
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testBackupSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testBackupSuite) TestBackupRestore(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "set", "backup:a", "1")
+    nc.checkOK(c, "set", "backup:b", "2")
+
+    dir := filepath.Join(c.MkDir(), "backup")
+    nc.checkOK(c, "backup", dir)
+    _, err := os.Stat(filepath.Join(dir, backupManifest))
+    c.Assert(err, IsNil)
+    resp := nc.doCmd(c, "lastsave")
+    c.Assert(resp.(*redis.Int).Value > 0, Equals, true)
+    nc.checkError(c, ".*is not empty", "backup", dir)
+
+    dbpath := filepath.Join(c.MkDir(), "restored")
+    c.Assert(RestoreBackup(dir, dbpath), IsNil)
+    c.Assert(RestoreBackup(dir, dbpath), ErrorMatches, ".*is not empty")
+
+    files, err := readBackupManifest(dir)
+    c.Assert(err, IsNil)
+    c.Assert(len(files) > 0, Equals, true)
+    // files may be hard links to live data-files, replace rather than overwrite
+    path := filepath.Join(dir, files[0].name)
+    c.Assert(os.Remove(path), IsNil)
+    err = ioutil.WriteFile(path, []byte("garbage"), 0644)
+    c.Assert(err, IsNil)
+    c.Assert(RestoreBackup(dir, filepath.Join(c.MkDir(), "corrupted")), ErrorMatches, ".*is corrupted")
+}
+
+func (s *testBackupSuite) TestBgsaveInProgress(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    // a running backup, as BGSAVE or BACKUP would claim it
+    c.Assert(s.s.svr.backup.running.CompareAndSwap(0, 1), Equals, true)
+    nc.checkError(c, "Background save already in progress", "bgsave")
+    nc.checkError(c, "Background save already in progress", "backup", filepath.Join(c.MkDir(), "backup"))
+    s.s.svr.backup.running.Set(0)
+}
+
+func (s *testBackupSuite) TestBackupInMulti(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    // BACKUP takes commitMu, which EXEC holds
+    nc.checkOK(c, "multi")
+    nc.checkError(c, "Command backup not allowed inside a transaction", "backup", c.MkDir())
+    nc.checkError(c, "EXECABORT.*", "exec")
+    nc.checkOK(c, "set", "backup:multi", "1")
+}
@@ -0,0 +1,256 @@
+package bitserver
+
+import (
+    "errors"
+    "time"
+)
+
+// max number of batches coalesced into a group commit
+const maxCommitGroup = 128
+
+var errServerClosed = errors.New("server is closed")
+
+type writeOp struct {
+    key     []byte
+    value   []byte
+    expireAt uint32
+    del     bool
+    // delete without replicating, for migrated keys
+    local   bool
+    // remove all keys
+    clear   bool
+}
+
+// writeBatch is a group of puts and deletes, applied all or nothing
+type writeBatch struct {
+    ops     []writeOp
+    // keyspace events of the ops, see notify
+    events  []keyEvent
+}
+
+func (b *writeBatch) Put(key, value []byte) {
+    b.ops = append(b.ops, writeOp{key: key, value: value})
+}
+
+func (b *writeBatch) PutWithExpr(key, value []byte, expireAt uint32) {
+    b.ops = append(b.ops, writeOp{key: key, value: value, expireAt: expireAt})
+}
+
+func (b *writeBatch) Delete(key []byte) {
+    b.ops = append(b.ops, writeOp{key: key, del: true})
+}
+
+func (b *writeBatch) DeleteLocal(key []byte) {
+    b.ops = append(b.ops, writeOp{key: key, del: true, local: true})
+}
+
+func (b *writeBatch) Clear() {
+    b.ops = append(b.ops, writeOp{clear: true})
+}
+
+func (b *writeBatch) Len() int {
+    return len(b.ops)
+}
+
+// lookup finds the latest write to key in b, for reads inside EXEC
+func (b *writeBatch) lookup(key []byte) (op *writeOp, found bool) {
+    for i := len(b.ops) - 1; i >= 0; i-- {
+        op := &b.ops[i]
+        if op.clear || string(op.key) == string(key) {
+            return op, true
+        }
+    }
+    return nil, false
+}
+
+// atomicBatchWriter writes puts and deletes as one commit group, which is applied
+// and survives a crash all or nothing. A batch with clears or local deletes is
+// committed alone and, like batches of storages without it, gets its ops applied
+// one by one, still atomic for readers.
+type atomicBatchWriter interface {
+    WriteBatch(ops []writeOp) error
+}
+
+type commitReq struct {
+    b       *writeBatch
+    done    chan error
+}
+
+// commit applies b, waiting for its group commit.
+// Inside EXEC writes are collected and committed by EXEC as a single batch.
+func (s *Server) commit(c *conn, b *writeBatch) error {
+    if b.Len() == 0 {
+        return nil
+    }
+    if c != nil && c.txBatch != nil {
+        c.txBatch.ops = append(c.txBatch.ops, b.ops...)
+        c.txBatch.events = append(c.txBatch.events, b.events...)
+        return nil
+    }
+
+    req := &commitReq{b: b, done: make(chan error, 1)}
+    select {
+    case s.commits <- req:
+    case <-s.signal:
+        return errServerClosed
+    }
+    return <-req.done
+}
+
+// get reads key, seeing writes of the transaction being EXECed by c
+func (s *Server) get(c *conn, key []byte) ([]byte, error) {
+    value, _, err := s.getWithExpr(c, key)
+    return value, err
+}
+
+func (s *Server) getWithExpr(c *conn, key []byte) ([]byte, uint32, error) {
+    if c != nil && c.txBatch != nil {
+        if op, found := c.txBatch.lookup(key); found {
+            if op.clear || op.del || expired(op.expireAt, time.Now()) {
+                return nil, 0, ErrKeyNotFound
+            }
+            return op.value, op.expireAt, nil
+        }
+    }
+    value, expireAt, err := s.bc.GetWithExpr(key)
+    if err == nil && expired(expireAt, time.Now()) {
+        // the expirer deletes it, reads can't commit
+        s.trackExpire(key, expireAt)
+        s.wakeExpirer()
+        return nil, 0, ErrKeyNotFound
+    }
+    return value, expireAt, err
+}
+
+// committer coalesces batches of concurrent conns into group commits
+func (s *Server) committer() {
+    for {
+        var group []*commitReq
+        select {
+        case <-s.signal:
+            return
+        case req := <-s.commits:
+            group = append(group, req)
+        }
+    LOOP:
+        for len(group) < maxCommitGroup {
+            select {
+            case req := <-s.commits:
+                group = append(group, req)
+            default:
+                break LOOP
+            }
+        }
+
+        // batches with clears or local deletes have no framed form, each is
+        // applied on its own so the others still commit as one group
+        for len(group) > 0 {
+            n := 1
+            if !group[0].b.hasClearOrLocal() {
+                for n < len(group) && !group[n].b.hasClearOrLocal() {
+                    n++
+                }
+            }
+            batches := make([]*writeBatch, n)
+            for i, req := range group[:n] {
+                batches[i] = req.b
+            }
+            err := s.applyBatches(batches...)
+            for _, req := range group[:n] {
+                req.done <- err
+            }
+            group = group[n:]
+        }
+    }
+}
+
+// applyBatches writes batches as one group, readers and the replication stream
+// see all of them or none. EXEC holds commitMu already and calls applyBatchesLocked.
+func (s *Server) applyBatches(batches ...*writeBatch) error {
+    s.commitMu.Lock()
+    defer s.commitMu.Unlock()
+    return s.applyBatchesLocked(batches...)
+}
+
+func (s *Server) applyBatchesLocked(batches ...*writeBatch) error {
+    start := time.Now()
+    s.dataLock.Lock()
+    err := s.writeBatches(batches)
+    s.dataLock.Unlock()
+
+    var n int64
+    for _, b := range batches {
+        for _, op := range b.ops {
+            n += int64(len(op.key) + len(op.value))
+            switch {
+            case op.clear:
+                s.touchAllKeys()
+                s.untrackAllExpires()
+            case op.del:
+                s.touchKeys(op.key)
+                s.trackExpire(op.key, 0)
+            default:
+                s.touchKeys(op.key)
+                s.trackExpire(op.key, op.expireAt)
+            }
+        }
+    }
+    s.counters.commitGroups.Incr()
+    s.counters.commitBatches.Add(int64(len(batches)))
+    if err == nil {
+        s.notifyBatches(batches)
+        err = s.afterWrite(n)
+    }
+    s.latencyAdd(latencyCommit, time.Since(start))
+    return err
+}
+
+func (s *Server) writeBatches(batches []*writeBatch) error {
+    bc := s.bc
+    framed := true
+    for _, b := range batches {
+        framed = framed && !b.hasClearOrLocal()
+    }
+    if w, ok := interface{}(bc).(atomicBatchWriter); ok && framed {
+        var ops []writeOp
+        for _, b := range batches {
+            ops = append(ops, b.ops...)
+        }
+        return w.WriteBatch(ops)
+    }
+
+    for _, b := range batches {
+        for _, op := range b.ops {
+            var err error
+            switch {
+            case op.clear:
+                err = bc.ClearAll()
+            case op.del && op.local:
+                err = bc.DelLocal(op.key)
+            case op.del:
+                err = bc.Del(op.key)
+                if err == ErrKeyNotFound {
+                    err = nil
+                }
+            case op.expireAt != 0:
+                err = bc.SetWithExpr(op.key, op.value, op.expireAt)
+            default:
+                err = bc.Set(op.key, op.value)
+            }
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// clear and local deletes have no framed form, their batch is applied op by op
+func (b *writeBatch) hasClearOrLocal() bool {
+    for _, op := range b.ops {
+        if op.clear || op.local {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,73 @@
+package bitserver
+
+import (
+    "fmt"
+    "sync"
+    . "gopkg.in/check.v1"
+)
+
+type testBatchSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testBatchSuite{})
+
+func (s *testBatchSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17890
+    config.Dbpath = c.MkDir()
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testBatchSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testBatchSuite) TestLookup(c *C) {
+    b := &writeBatch{}
+    b.Put([]byte("a"), []byte("1"))
+    b.Put([]byte("b"), []byte("1"))
+    b.Delete([]byte("a"))
+
+    op, found := b.lookup([]byte("a"))
+    c.Assert(found, Equals, true)
+    c.Assert(op.del, Equals, true)
+    op, found = b.lookup([]byte("b"))
+    c.Assert(found, Equals, true)
+    c.Assert(string(op.value), Equals, "1")
+    _, found = b.lookup([]byte("c"))
+    c.Assert(found, Equals, false)
+
+    b.Clear()
+    op, found = b.lookup([]byte("b"))
+    c.Assert(found, Equals, true)
+    c.Assert(op.clear, Equals, true)
+}
+
+func (s *testBatchSuite) TestConcurrentWrites(c *C) {
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            nc := testGetConn(c, s.s.port)
+            defer nc.Close()
+            for j := 0; j < 50; j++ {
+                key := fmt.Sprintf("batch:%d:%d", i, j)
+                nc.checkOK(c, "set", key, j)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    for i := 0; i < 8; i++ {
+        nc.checkString(c, "49", "get", fmt.Sprintf("batch:%d:49", i))
+    }
+    nc.checkInt(c, 2, "del", "batch:0:0", "batch:0:1", "batch:none")
+    nc.checkOK(c, "slotsrestore", "r1", 0, "1", "r2", 0, "2")
+    nc.checkString(c, "2", "get", "r2")
+}
@@ -2,20 +2,16 @@ package main
 
 import (
     "time"
-    "bytes"
     "sync/atomic"
     "sync"
     "math/rand"
-    "net"
     "log"
     "fmt"
     "flag"
     "strings"
-    "hash/crc32"
-    "bufio"
     "strconv"
 
-    redis "github.com/reborndb/go/redis/resp"
+    "github.com/rocket323/bitserver/client"
 )
 
 /*
@@ -38,6 +34,7 @@ var (
     writePortion int
     randomSpace int
     triggerPortion int
+    pipeline int
 
     // normal var
     value []byte
@@ -49,10 +46,6 @@ var (
     readWriteEnd time.Time
 )
 
-const (
-    MaxSlotNum = 1024
-)
-
 func init() {
     flag.StringVar(&t, "t",
         "readwrite,readwritewhilemerge,readwritewhilemigrate,readwritemigreatewhilemerge," +
@@ -65,33 +58,11 @@ func init() {
     flag.IntVar(&writePortion, "write_portion", 50, "write portion")
     flag.IntVar(&randomSpace, "r", 1e9, "key space")
     flag.IntVar(&triggerPortion, "tp", 50, "trigger portion for merge/migrate")
+    flag.IntVar(&pipeline, "P", 1, "pipeline <P> requests per client")
 
     log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-func hashTag(key []byte) []byte {
-    part := key
-    if i := bytes.IndexByte(part, '{'); i != -1 {
-        part = part[i+1:]
-    } else {
-        return key
-    }
-    if i := bytes.IndexByte(part, '}'); i != -1 {
-        return part[:i]
-    } else {
-        return key
-    }
-}
-
-func hashTagToSlot(tag []byte) uint32 {
-    return crc32.ChecksumIEEE(tag) % MaxSlotNum
-}
-
-func hashKeyToSlot(key []byte) ([]byte, uint32) {
-    tag := hashTag(key)
-    return tag, hashTagToSlot(tag)
-}
-
 func randomKey() string {
     return fmt.Sprintf("%012d", rand.Int() % randomSpace)
 }
@@ -110,88 +81,21 @@ func splitIpPort(url string) (string, int) {
 }
 
 func benchSlaveOf(masterUrl string, slaveUrl string) {
-    masterConn := benchGetConn(slaveUrl)
+    slaveConn := benchGetConn(slaveUrl)
+    defer slaveConn.Close()
     masterIp, masterPort := splitIpPort(masterUrl)
 
-    err := masterConn.doMustOK("slaveof", masterIp, masterPort)
-    if err != nil {
+    if err := slaveConn.SlaveOf(masterIp, masterPort); err != nil {
         log.Fatalf("set %s slaveof %s failed, err = %s", slaveUrl, masterUrl, err)
     }
 }
 
-type benchConn struct {
-    nc net.Conn
-}
-
-func (c *benchConn) Close() {
-    c.nc.Close()
-}
-
-func benchGetConn(url string) *benchConn {
-    nc, err := net.Dial("tcp", url)
+func benchGetConn(url string) *client.Conn {
+    c, err := client.Dial(url, nil)
     if err != nil {
         log.Fatalf("dial server[%s] failed, err = %s", url, err)
     }
-    return &benchConn{
-        nc: nc,
-    }
-}
-
-func (c *benchConn) doCmd(cmd string, args ...interface{}) (redis.Resp, error) {
-    r := bufio.NewReaderSize(c.nc, 32)
-    w := bufio.NewWriterSize(c.nc, 32)
-
-    req := redis.NewRequest(cmd, args...)
-    err := redis.Encode(w, req)
-    if err != nil {
-        return nil, err
-    }
-
-    err = w.Flush()
-    if err != nil {
-        return nil, err
-    }
-
-    resp, err := redis.Decode(r)
-    if err != nil {
-        return nil, err
-    }
-    return resp, nil
-}
-
-func (c *benchConn) doMustOK(cmd string, args ...interface{}) error {
-    rsp, err := c.doCmd(cmd, args...);
-    if err != nil {
-        return err
-    }
-    x, ok := rsp.(*redis.String);
-    if !ok {
-        log.Fatalf("not string resp, type[%T]", rsp)
-    }
-    if x.Value != "OK" {
-        log.Fatalf("not ok, but - %s", x.Value)
-    }
-    return nil
-}
-
-func decodeIntArray(resp redis.Resp) []int64 {
-    v, ok := resp.(*redis.Array)
-    if !ok {
-        log.Fatalf("migrate resp not IntArray, but %T", resp)
-    }
-
-    arr := make([]int64, 0)
-    for _, vv := range v.Value {
-        b, ok := vv.(*redis.Int)
-        if !ok {
-            log.Fatalf("migrate resp element not Int, but %T", vv)
-        }
-        arr = append(arr, int64(b.Value))
-    }
-    if len(arr) == 0 {
-        log.Fatalf("migrate resp has zero length")
-    }
-    return arr
+    return c
 }
 
 var (
@@ -202,25 +106,39 @@ var (
         conn := benchGetConn(url)
         writeOps := 0
         readOps := 0
+        // requests sent but not received, up to pipeline
+        pending := 0
         for i := 0; i < n; i++ {
             key := randomKey()
             x := rand.Int() % 100
             var err error
             if x < writePortion { // write
                 writeOps++
-                _, slot := hashKeyToSlot([]byte(key))
+                _, slot := client.HashKeyToSlot([]byte(key))
                 slots[int(slot)] = true
-                _, err = conn.doCmd("set", key, value)
+                err = conn.Send("set", key, value)
                 if err != nil {
                     log.Fatalf("set key[%s] failed, err = %s", key, err)
                 }
             } else { // read
                 readOps++
-                _, err = conn.doCmd("get", key)
+                err = conn.Send("get", key)
                 if err != nil {
                     log.Fatalf("get key[%s] failed, err = %s", key, err)
                 }
             }
+            pending++
+
+            if pending == pipeline || i == n - 1 {
+                if err := conn.Flush(); err != nil {
+                    log.Fatalf("send requests failed, err = %s", err)
+                }
+                for ; pending > 0; pending-- {
+                    if _, err := conn.Receive(); err != nil {
+                        log.Fatalf("receive reply failed, err = %s", err)
+                    }
+                }
+            }
 
             newTotal := atomic.AddInt32(&totalOps, 1)
             if newTotal == int32(int64(num) * int64(triggerPortion) / 100) {
@@ -241,7 +159,7 @@ var (
         begin := time.Now()
         fmt.Printf("merge start...\n")
         conn := benchGetConn(url)
-        _, err := conn.doCmd("merge")
+        _, err := conn.Do("merge")
         if err != nil {
             log.Fatalf("merge failed, err = %s", err)
         }
@@ -264,15 +182,8 @@ var (
 
         cnt := 0
         for slot, _ := range slots {
-            for {
-                rsp, err := conn.doCmd("slotsmgrtslot", dstIp, dstPort, 1000, slot)
-                if err != nil {
-                    log.Fatalf("mgrt failed, err = %s", err)
-                }
-                arr := decodeIntArray(rsp)
-                if arr[0] == 0 {
-                    break
-                }
+            if _, err := conn.MigrateSlotAll(dstIp, dstPort, time.Second, uint32(slot), false); err != nil {
+                log.Fatalf("mgrt failed, err = %s", err)
             }
             cnt++
             log.Printf("migrated slots[%d/%d]", cnt, len(slots))
@@ -291,7 +202,7 @@ func reportReadWrite() {
     d := readWriteEnd.Sub(readWriteBegin)
     writeMB := float64(num * valueSize) / 1e6
     var report string
-    report += fmt.Sprintf("========\nread/write finish in %.2f seconds\n", d.Seconds())
+    report += fmt.Sprintf("========\nread/write finish in %.2f seconds, pipeline %d\n", d.Seconds(), pipeline)
     report += fmt.Sprintf("%.2f qps\n", float64(num) / d.Seconds())
     report += fmt.Sprintf("%.2f MB/s\n", writeMB / d.Seconds())
     report += fmt.Sprintf("%.2f micros/op\n", d.Seconds() * 1e6 / float64(num))
@@ -431,6 +342,9 @@ func main() {
     testcases := strings.Split(t, ",")
     urls = strings.Split(servers, ",")
     value = make([]byte, valueSize)
+    if pipeline < 1 {
+        pipeline = 1
+    }
 
     for _, tc := range testcases {
         switch tc {
@@ -0,0 +1,387 @@
+package bitserver
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/reborndb/go/atomic2"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// records read per dataLock hold while streaming
+const cdcReadBatch = 128
+
+// how long a caught up stream waits for writes before checking again
+const cdcPollInterval = time.Second
+
+var (
+    errMergeCDC = errors.New("CDC cursors are behind, merge later")
+    errCDCStreaming = errors.New("CDC stream already running on this connection")
+)
+
+// cdcCursor is where a CDC stream is in the data-files. Named cursors outlive
+// their conn, so a consumer resuming after a disconnect still holds back merges.
+type cdcCursor struct {
+    name    string
+    fileId  atomic2.Int64
+    offset  atomic2.Int64
+    // set once merges no longer wait for it
+    dropped atomic2.Int64
+    // guarded by s.cdc
+    conn    *conn
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+type cdcState struct {
+    sync.Mutex
+    cursors map[*cdcCursor]struct{}
+    names   map[string]*cdcCursor
+    n       atomic2.Int64
+    // closed and replaced on every write, waking caught up streams
+    wake    chan struct{}
+    dropped atomic2.Int64
+}
+
+func (cur *cdcCursor) String() string {
+    if cur.name != "" {
+        return cur.name
+    }
+    return fmt.Sprintf("%p", cur)
+}
+
+// cdcWake wakes streams waiting for writes, it's called after every write
+func (s *Server) cdcWake() {
+    if s.cdc.n.Get() == 0 {
+        return
+    }
+    s.cdc.Lock()
+    defer s.cdc.Unlock()
+    if s.cdc.wake != nil {
+        close(s.cdc.wake)
+        s.cdc.wake = nil
+    }
+}
+
+func (s *Server) cdcWaitChan() chan struct{} {
+    s.cdc.Lock()
+    defer s.cdc.Unlock()
+    if s.cdc.wake == nil {
+        s.cdc.wake = make(chan struct{})
+    }
+    return s.cdc.wake
+}
+
+// dataFileLag returns bytes of data-files from fileId:offset to the end of the active one
+func (s *Server) dataFileLag(fileId int64, offset int64) int64 {
+    bc := s.bc
+    activeFileId := bc.ActiveFileId()
+    var lag int64
+    for id := fileId; id <= activeFileId; id = bc.NextDataFileId(id) {
+        if fi, err := os.Stat(bc.GetDataFilePath(id)); err == nil {
+            lag += fi.Size()
+        }
+        if id == fileId {
+            lag -= offset
+        }
+        if id == activeFileId || bc.NextDataFileId(id) <= id {
+            break
+        }
+    }
+    if lag < 0 {
+        lag = 0
+    }
+    return lag
+}
+
+// cdcHoldsMerge reports whether a cursor still needs data-files a merge would rewrite.
+// Cursors lagging more than CDCMaxHoldBytes are dropped instead.
+func (s *Server) cdcHoldsMerge() bool {
+    if s.cdc.n.Get() == 0 {
+        return false
+    }
+    activeFileId := s.bc.ActiveFileId()
+    s.cdc.Lock()
+    defer s.cdc.Unlock()
+    hold := false
+    for cur, _ := range s.cdc.cursors {
+        fileId := cur.fileId.Get()
+        if fileId >= activeFileId {
+            continue
+        }
+        max := s.config.CDCMaxHoldBytes
+        if max > 0 && s.dataFileLag(fileId, cur.offset.Get()) > max {
+            s.logger.Printf("drop CDC cursor %s at %d:%d, too far behind", cur, fileId, cur.offset.Get())
+            s.cdc.dropped.Incr()
+            cur.dropped.Set(1)
+            s.removeCursorLocked(cur)
+            continue
+        }
+        hold = true
+    }
+    return hold
+}
+
+// removeCursorLocked forgets cur, stopping its stream
+func (s *Server) removeCursorLocked(cur *cdcCursor) {
+    if cur.stop != nil {
+        close(cur.stop)
+        cur.stop = nil
+    }
+    delete(s.cdc.cursors, cur)
+    if cur.name != "" && s.cdc.names[cur.name] == cur {
+        delete(s.cdc.names, cur.name)
+    }
+    s.cdc.n.Set(int64(len(s.cdc.cursors)))
+}
+
+// stopCDC stops the stream of c and waits for it. Named cursors stay, at their last position.
+func (s *Server) stopCDC(c *conn) {
+    cur := c.cdc
+    if cur == nil {
+        return
+    }
+    s.cdc.Lock()
+    if cur.stop != nil {
+        close(cur.stop)
+        cur.stop = nil
+    }
+    if cur.conn == c {
+        cur.conn = nil
+        if cur.name == "" {
+            s.removeCursorLocked(cur)
+        }
+    }
+    s.cdc.Unlock()
+    <-cur.done
+    c.cdc = nil
+}
+
+// startCDC registers a cursor at fileId:offset for c and starts its stream
+func (s *Server) startCDC(c *conn, name string, fileId int64, offset int64) error {
+    if c.cdc != nil {
+        select {
+        case <-c.cdc.done:
+            // the last stream of c ended, on an error
+            s.stopCDC(c)
+        default:
+            return errCDCStreaming
+        }
+    }
+    if s.bc.GetDataFilePath(s.bc.ActiveFileId()) == "" {
+        return errNoDataFiles
+    }
+    if _, err := os.Stat(s.bc.GetDataFilePath(fileId)); err != nil || offset < 0 {
+        return fmt.Errorf("position %d:%d is not available", fileId, offset)
+    }
+
+    s.cdc.Lock()
+    if s.cdc.cursors == nil {
+        s.cdc.cursors = make(map[*cdcCursor]struct{})
+        s.cdc.names = make(map[string]*cdcCursor)
+    }
+    cur := s.cdc.names[name]
+    if cur != nil && cur.conn != nil {
+        s.cdc.Unlock()
+        return fmt.Errorf("CDC cursor %s is in use", name)
+    }
+    if cur == nil {
+        cur = &cdcCursor{name: name}
+        s.cdc.cursors[cur] = struct{}{}
+        if name != "" {
+            s.cdc.names[name] = cur
+        }
+        s.cdc.n.Set(int64(len(s.cdc.cursors)))
+    }
+    cur.fileId.Set(fileId)
+    cur.offset.Set(offset)
+    cur.conn = c
+    cur.stop = make(chan struct{})
+    cur.done = make(chan struct{})
+    stop := cur.stop
+    s.cdc.Unlock()
+
+    c.cdc = cur
+    // the reply is queued before any event
+    sub := s.subscriber(c)
+    c.reply(redis.NewString("OK"))
+    s.goFunc(func() {
+        defer close(cur.done)
+        err := s.streamCDC(c, cur, sub, stop)
+        if err == nil && cur.dropped.Get() != 0 {
+            err = fmt.Errorf("CDC cursor %s dropped, too far behind", cur)
+        }
+        if err != nil {
+            s.logger.Printf("CDC stream of %s ended, err = %s", c, err)
+            // the subscriber writer drains its queue until the conn is removed
+            resp := redis.NewError(err)
+            c.queueOutput(resp)
+            select {
+            case sub.ch <- resp:
+            case <-s.signal:
+                c.unqueueOutput(resp)
+            }
+        }
+    })
+    return nil
+}
+
+// cdcEvent is ["cdc", fileId, offset, type, db, key, value, expireAt], type being set or
+// del. fileId:offset is the end of the commit group of rec, shared by the events of the
+// group, and a consumer resumes after them with CDC SUBSCRIBE fileId offset.
+func cdcEvent(fileId int64, offset int64, rec Record) redis.Resp {
+    db, key := decodeDbKey(rec.Key())
+    if rec.Deleted() {
+        return newPush("cdc", redis.NewInt(fileId), redis.NewInt(offset), redis.NewBulkBytesWithString("del"),
+            redis.NewInt(int64(db)), redis.NewBulkBytes(key), redis.NewBulkBytes(nil), redis.NewInt(0))
+    }
+    return newPush("cdc", redis.NewInt(fileId), redis.NewInt(offset), redis.NewBulkBytesWithString("set"),
+        redis.NewInt(int64(db)), redis.NewBulkBytes(key), redis.NewBulkBytes(rec.Value()), redis.NewInt(int64(rec.ExpireAt())))
+}
+
+// readCDC reads records from fileId:offset, returning events of the groups ending in
+// them. It only stops early at a group end, g carries a group on to the next data-file.
+func (s *Server) readCDC(g *recordGroup, fileId int64, offset int64) ([]redis.Resp, int64, bool, error) {
+    s.dataLock.RLock()
+    defer s.dataLock.RUnlock()
+    var events []redis.Resp
+    for len(events) < cdcReadBatch || g.inGroup {
+        rec, err := s.bc.RefRecord(fileId, offset)
+        if err == io.EOF {
+            return events, offset, true, nil
+        } else if err != nil {
+            return nil, offset, false, err
+        }
+        offset += rec.Size()
+        for _, r := range g.add(rec) {
+            events = append(events, cdcEvent(fileId, offset, r))
+        }
+    }
+    return events, offset, false, nil
+}
+
+func (s *Server) streamCDC(c *conn, cur *cdcCursor, sub *subscriber, stop chan struct{}) error {
+    fileId, offset := cur.fileId.Get(), cur.offset.Get()
+    g := &recordGroup{}
+    for {
+        wake := s.cdcWaitChan()
+        if _, err := os.Stat(s.bc.GetDataFilePath(fileId)); err != nil {
+            return fmt.Errorf("position %d:%d is no longer available", fileId, offset)
+        }
+        events, next, eof, err := s.readCDC(g, fileId, offset)
+        if err != nil {
+            return err
+        }
+        for _, ev := range events {
+            c.queueOutput(ev)
+            select {
+            case sub.ch <- ev:
+            case <-stop:
+                c.unqueueOutput(ev)
+                return nil
+            case <-s.signal:
+                c.unqueueOutput(ev)
+                return nil
+            }
+        }
+        offset = next
+        if eof && fileId < s.bc.ActiveFileId() {
+            fileId, offset = s.bc.NextDataFileId(fileId), 0
+        }
+        if !g.inGroup {
+            // a resumed cursor starts at a group end
+            cur.fileId.Set(fileId)
+            cur.offset.Set(offset)
+        }
+        if !eof {
+            continue
+        }
+
+        t := time.NewTimer(cdcPollInterval)
+        select {
+        case <-wake:
+        case <-t.C:
+        case <-stop:
+            t.Stop()
+            return nil
+        case <-s.signal:
+            t.Stop()
+            return nil
+        }
+        t.Stop()
+    }
+}
+
+func (s *Server) listCursors() []string {
+    s.cdc.Lock()
+    defer s.cdc.Unlock()
+    var lines []string
+    for cur, _ := range s.cdc.cursors {
+        fileId, offset := cur.fileId.Get(), cur.offset.Get()
+        addr := ""
+        if cur.conn != nil {
+            addr = cur.conn.nc.RemoteAddr().String()
+        }
+        lines = append(lines, fmt.Sprintf("name=%s fileid=%d offset=%d addr=%s lag=%d",
+            cur.name, fileId, offset, addr, s.dataFileLag(fileId, offset)))
+    }
+    sort.Strings(lines)
+    return lines
+}
+
+// CDC SUBSCRIBE fileId offset [NAME name] | LIST | FORGET name
+func CdcCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "subscribe":
+        if len(args) != 3 && len(args) != 5 {
+            return toRespErrorf("wrong number of arguments for 'cdc subscribe' command")
+        }
+        fileId, err1 := strconv.ParseInt(string(args[1]), 10, 64)
+        offset, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+        if err1 != nil || err2 != nil {
+            return toRespErrorf("invalid position %s:%s", args[1], args[2])
+        }
+        name := ""
+        if len(args) == 5 {
+            if strings.ToLower(string(args[3])) != "name" || len(args[4]) == 0 {
+                return toRespErrorf("syntax error")
+            }
+            name = string(args[4])
+        }
+        if err := s.startCDC(c, name, fileId, offset); err != nil {
+            return toRespError(err)
+        }
+        return nil, nil
+    case "list":
+        return newVerbatim([]byte(strings.Join(s.listCursors(), "\n"))), nil
+    case "forget":
+        if len(args) != 2 {
+            return toRespErrorf("wrong number of arguments for 'cdc forget' command")
+        }
+        s.cdc.Lock()
+        defer s.cdc.Unlock()
+        cur := s.cdc.names[string(args[1])]
+        if cur == nil {
+            return redis.NewInt(0), nil
+        }
+        if cur.conn != nil {
+            return toRespErrorf("CDC cursor %s is in use", args[1])
+        }
+        s.removeCursorLocked(cur)
+        return redis.NewInt(1), nil
+    default:
+        return toRespErrorf("unknown CDC subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "cdc", f: CdcCmd, flag: CmdAdmin|CmdReplication|CmdNoScript|CmdNoMulti, arity: -2,
+        group: "server", summary: "Stream committed writes from a data-file position"})
+}
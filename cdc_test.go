@@ -0,0 +1,146 @@
+package bitserver
+
+import (
+    "strings"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testCDCSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testCDCSuite{})
+
+func (s *testCDCSuite) SetUpSuite(c *C) {
+    s.s = testCreateServer(c, 18010, c.MkDir())
+}
+
+func (s *testCDCSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+type testCDCEvent struct {
+    fileId  int64
+    offset  int64
+    typ     string
+    key     string
+    value   string
+}
+
+func (s *testCDCSuite) receiveEvent(c *C, nc *testConn) testCDCEvent {
+    resp, err := nc.Receive()
+    c.Assert(err, IsNil)
+    ev, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(ev.Value, HasLen, 8)
+    c.Assert(ev.Value[0], DeepEquals, redis.NewBulkBytesWithString("cdc"))
+    c.Assert(ev.Value[4], DeepEquals, redis.NewInt(0))
+    return testCDCEvent{
+        fileId: ev.Value[1].(*redis.Int).Value,
+        offset: ev.Value[2].(*redis.Int).Value,
+        typ: string(ev.Value[3].(*redis.BulkBytes).Value),
+        key: string(ev.Value[5].(*redis.BulkBytes).Value),
+        value: string(ev.Value[6].(*redis.BulkBytes).Value),
+    }
+}
+
+// receiveUntil returns the events up to the one of key
+func (s *testCDCSuite) receiveUntil(c *C, nc *testConn, key string) []testCDCEvent {
+    var events []testCDCEvent
+    for {
+        ev := s.receiveEvent(c, nc)
+        events = append(events, ev)
+        if ev.key == key {
+            return events
+        }
+    }
+}
+
+func (s *testCDCSuite) TestStream(c *C) {
+    svr := s.s.svr
+    s.s.checkOK(c, "set", "cdc1", "v1")
+    fileId := svr.bc.ActiveFileId()
+
+    nc := testGetConn(c, s.s.port)
+    c.Assert(nc.Send("cdc", "subscribe", fileId, 0, "name", "indexer"), IsNil)
+    c.Assert(nc.Flush(), IsNil)
+    resp, err := nc.Receive()
+    c.Assert(err, IsNil)
+    c.Assert(resp, DeepEquals, redis.NewString("OK"))
+
+    // everything written so far in the active data-file, then new writes as they commit
+    events := s.receiveUntil(c, nc, "cdc1")
+    ev := events[len(events) - 1]
+    c.Assert(ev.typ, Equals, "set")
+    c.Assert(ev.value, Equals, "v1")
+    c.Assert(ev.fileId, Equals, fileId)
+
+    s.s.checkInt(c, 1, "del", "cdc1")
+    del := s.receiveEvent(c, nc)
+    c.Assert(del, Equals, testCDCEvent{fileId: ev.fileId, offset: del.offset, typ: "del", key: "cdc1"})
+    c.Assert(del.offset > ev.offset, Equals, true)
+
+    // the events of a commit group come together, ending at the same position
+    tx := testGetConn(c, s.s.port)
+    defer tx.Close()
+    tx.checkOK(c, "multi")
+    tx.checkString(c, "QUEUED", "set", "{cdc}2", "v2")
+    tx.checkString(c, "QUEUED", "set", "{cdc}3", "v3")
+    tx.doCmd(c, "exec")
+    e2, e3 := s.receiveEvent(c, nc), s.receiveEvent(c, nc)
+    c.Assert(e2.key + "=" + e2.value, Equals, "{cdc}2=v2")
+    c.Assert(e3.key + "=" + e3.value, Equals, "{cdc}3=v3")
+    c.Assert(e2.offset, Equals, e3.offset)
+    c.Assert(e2.offset > del.offset, Equals, true)
+
+    // a named cursor outlives its conn
+    nc.Close()
+    nc = testGetConn(c, s.s.port)
+    defer nc.Close()
+    list := func() string {
+        resp := nc.doCmd(c, "cdc", "list")
+        c.Assert(resp, FitsTypeOf, (*redis.BulkBytes)(nil))
+        return string(resp.(*redis.BulkBytes).Value)
+    }
+    for i := 0; i < 100 && !strings.Contains(list(), "addr= "); i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(list(), Matches, "name=indexer .*addr= .*")
+    nc.checkInt(c, 1, "cdc", "forget", "indexer")
+    nc.checkInt(c, 0, "cdc", "forget", "indexer")
+}
+
+func (s *testCDCSuite) TestInvalidPosition(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkError(c, "position .* is not available", "cdc", "subscribe", 1 << 40, 0)
+    nc.checkError(c, "syntax error", "cdc", "subscribe", 0, 0, "nick", "x")
+}
+
+func (s *testCDCSuite) TestHoldMerge(c *C) {
+    svr := s.s.svr
+    cur := &cdcCursor{name: "old"}
+    cur.fileId.Set(svr.bc.ActiveFileId() - 1)
+    svr.cdc.Lock()
+    if svr.cdc.cursors == nil {
+        svr.cdc.cursors = make(map[*cdcCursor]struct{})
+        svr.cdc.names = make(map[string]*cdcCursor)
+    }
+    svr.cdc.cursors[cur] = struct{}{}
+    svr.cdc.n.Set(int64(len(svr.cdc.cursors)))
+    svr.cdc.Unlock()
+
+    c.Assert(svr.cdcHoldsMerge(), Equals, true)
+    s.s.checkError(c, "CDC cursors are behind.*", "merge")
+
+    // too far behind, the cursor is dropped
+    svr.config.CDCMaxHoldBytes = 1
+    s.s.checkOK(c, "set", "cdc4", "v4")
+    c.Assert(svr.cdcHoldsMerge(), Equals, false)
+    c.Assert(cur.dropped.Get(), Equals, int64(1))
+    svr.config.CDCMaxHoldBytes = 1 << 30
+}
@@ -0,0 +1,335 @@
+package bitserver
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+const (
+    clientTypeNormal = "normal"
+    clientTypeSlave = "slave"
+    clientTypeMaster = "master"
+)
+
+func (s *Server) clientType(c *conn) string {
+    if c.isMaster {
+        return clientTypeMaster
+    }
+    if s.isSlave(c) {
+        return clientTypeSlave
+    }
+    return clientTypeNormal
+}
+
+// info line of conn c, as in CLIENT LIST
+func (s *Server) clientInfo(c *conn) string {
+    now := time.Now()
+    flags := ""
+    switch s.clientType(c) {
+    case clientTypeSlave:
+        flags += "S"
+    case clientTypeMaster:
+        flags += "M"
+    }
+    if s.isMonitor(c) {
+        flags += "O"
+    }
+    if c.migrating.Get() != 0 {
+        flags += "m"
+    }
+    if c.noEvict.Get() != 0 {
+        flags += "e"
+    }
+    if c.subscriptions() > 0 {
+        flags += "P"
+    }
+    if flags == "" {
+        flags = "N"
+    }
+    lastTime := time.Unix(0, c.lastTime.Get())
+
+    return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d cmd=%s qbuf=%d obuf=%d user=%s resp=%d",
+        c.id, c.nc.RemoteAddr(), c.nc.LocalAddr(), c.name.Get(),
+        int64(now.Sub(c.createTime).Seconds()), int64(now.Sub(lastTime).Seconds()),
+        flags, c.db.Get(), c.subs.Get(), c.psubs.Get(), c.lastCmd.Get(), c.r.Buffered(), c.outputBufferSize(), c.user.Get(), c.proto.Get())
+}
+
+func (s *Server) listConns() []*conn {
+    s.connMu.Lock()
+    defer s.connMu.Unlock()
+    conns := make([]*conn, 0, len(s.conns))
+    for c, _ := range s.conns {
+        conns = append(conns, c)
+    }
+    return conns
+}
+
+// clientFilter selects conns for CLIENT LIST and CLIENT KILL
+type clientFilter struct {
+    ids     map[int64]bool
+    addr    string
+    typ     string
+    skip    *conn
+}
+
+func (f *clientFilter) match(s *Server, c *conn) bool {
+    if c == f.skip {
+        return false
+    }
+    if f.ids != nil && !f.ids[c.id] {
+        return false
+    }
+    if f.addr != "" && c.nc.RemoteAddr().String() != f.addr {
+        return false
+    }
+    if f.typ != "" && s.clientType(c) != f.typ {
+        return false
+    }
+    return true
+}
+
+func parseClientType(typ []byte) (string, error) {
+    switch t := strings.ToLower(string(typ)); t {
+    case clientTypeNormal, clientTypeSlave, clientTypeMaster:
+        return t, nil
+    case "replica":
+        return clientTypeSlave, nil
+    default:
+        return "", fmt.Errorf("unknown client type '%s'", typ)
+    }
+}
+
+func (s *Server) pauseClients(d time.Duration, all bool) {
+    s.pause.Lock()
+    defer s.pause.Unlock()
+    if s.pause.ch == nil {
+        s.pause.ch = make(chan struct{})
+    }
+    until := time.Now().Add(d)
+    if until.After(s.pause.until) {
+        s.pause.until = until
+    }
+    s.pause.all = s.pause.all || all
+}
+
+func (s *Server) unpauseClients() {
+    s.pause.Lock()
+    defer s.pause.Unlock()
+    s.pause.until = time.Time{}
+    s.pause.all = false
+    if s.pause.ch != nil {
+        close(s.pause.ch)
+        s.pause.ch = nil
+    }
+}
+
+// waitPause blocks command f while clients are paused.
+// CLIENT itself is never paused, so paused clients can be unpaused.
+func (s *Server) waitPause(f *command) {
+    if f.name == "client" {
+        return
+    }
+    for {
+        s.pause.Lock()
+        until, all, ch := s.pause.until, s.pause.all, s.pause.ch
+        s.pause.Unlock()
+
+        d := until.Sub(time.Now())
+        if d <= 0 || (!all && f.flag&CmdWrite == 0) {
+            return
+        }
+        select {
+        case <-ch:
+        case <-time.After(d):
+        case <-s.signal:
+            return
+        }
+    }
+}
+
+// CLIENT LIST|INFO|KILL|SETNAME|GETNAME|ID|PAUSE|UNPAUSE|NO-EVICT|TRACKING [args...]
+func ClientCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    sub := strings.ToLower(string(args[0]))
+    args = args[1:]
+
+    switch sub {
+    case "id":
+        return redis.NewInt(c.id), nil
+    case "info":
+        return newVerbatim([]byte(s.clientInfo(c) + "\n")), nil
+    case "getname":
+        if name := c.name.Get(); name != "" {
+            return redis.NewBulkBytesWithString(name), nil
+        }
+        return redis.NewBulkBytes(nil), nil
+    case "setname":
+        if len(args) != 1 {
+            return toRespErrorf("len(args) = %d, expect = 1", len(args))
+        }
+        if bytes.IndexAny(args[0], " \n") != -1 {
+            return toRespErrorf("Client names cannot contain spaces, newlines or special characters.")
+        }
+        c.name.Set(string(args[0]))
+        return redis.NewString("OK"), nil
+    case "list":
+        f := &clientFilter{}
+        for i := 0; i < len(args); i++ {
+            switch strings.ToLower(string(args[i])) {
+            case "type":
+                if i + 1 >= len(args) {
+                    return toRespErrorf("syntax error")
+                }
+                typ, err := parseClientType(args[i + 1])
+                if err != nil {
+                    return toRespError(err)
+                }
+                f.typ = typ
+                i++
+            case "id":
+                f.ids = make(map[int64]bool)
+                for i++; i < len(args); i++ {
+                    id, err := strconv.ParseInt(string(args[i]), 10, 64)
+                    if err != nil {
+                        return toRespError(err)
+                    }
+                    f.ids[id] = true
+                }
+            default:
+                return toRespErrorf("syntax error")
+            }
+        }
+
+        var buf bytes.Buffer
+        for _, cc := range s.listConns() {
+            if f.match(s, cc) {
+                buf.WriteString(s.clientInfo(cc))
+                buf.WriteByte('\n')
+            }
+        }
+        return newVerbatim(buf.Bytes()), nil
+    case "kill":
+        if len(args) == 1 {
+            // CLIENT KILL addr
+            f := &clientFilter{addr: string(args[0])}
+            for _, cc := range s.listConns() {
+                if f.match(s, cc) {
+                    cc.Close()
+                    return redis.NewString("OK"), nil
+                }
+            }
+            return toRespErrorf("No such client")
+        }
+        if len(args) == 0 || len(args) % 2 != 0 {
+            return toRespErrorf("syntax error")
+        }
+
+        // CLIENT KILL [ID id] [ADDR addr] [TYPE type] [SKIPME yes|no]
+        f := &clientFilter{skip: c}
+        for i := 0; i < len(args); i += 2 {
+            val := args[i + 1]
+            switch strings.ToLower(string(args[i])) {
+            case "id":
+                id, err := strconv.ParseInt(string(val), 10, 64)
+                if err != nil {
+                    return toRespError(err)
+                }
+                f.ids = map[int64]bool{id: true}
+            case "addr":
+                f.addr = string(val)
+            case "type":
+                typ, err := parseClientType(val)
+                if err != nil {
+                    return toRespError(err)
+                }
+                f.typ = typ
+            case "skipme":
+                switch strings.ToLower(string(val)) {
+                case "yes":
+                    f.skip = c
+                case "no":
+                    f.skip = nil
+                default:
+                    return toRespErrorf("syntax error")
+                }
+            default:
+                return toRespErrorf("syntax error")
+            }
+        }
+
+        var n int64
+        for _, cc := range s.listConns() {
+            if f.match(s, cc) {
+                cc.Close()
+                n++
+            }
+        }
+        return redis.NewInt(n), nil
+    case "pause":
+        if len(args) != 1 && len(args) != 2 {
+            return toRespErrorf("len(args) = %d, expect = 1 or 2", len(args))
+        }
+        ms, err := strconv.ParseInt(string(args[0]), 10, 64)
+        if err != nil || ms < 0 {
+            return toRespErrorf("timeout is not an integer or out of range")
+        }
+        all := true
+        if len(args) == 2 {
+            switch strings.ToLower(string(args[1])) {
+            case "write":
+                all = false
+            case "all":
+            default:
+                return toRespErrorf("syntax error")
+            }
+        }
+        s.pauseClients(time.Duration(ms) * time.Millisecond, all)
+        return redis.NewString("OK"), nil
+    case "unpause":
+        s.unpauseClients()
+        return redis.NewString("OK"), nil
+    case "tracking":
+        if len(args) != 1 {
+            return toRespErrorf("len(args) = %d, expect = 1", len(args))
+        }
+        switch strings.ToLower(string(args[0])) {
+        case "on":
+            // invalidations are pushes, REDIRECT to another conn is not supported
+            if c.proto.Get() < resp3 {
+                return toRespErrorf("CLIENT TRACKING needs RESP3, switch with HELLO 3")
+            }
+            s.setTracking(c, true)
+        case "off":
+            s.setTracking(c, false)
+        default:
+            return toRespErrorf("syntax error")
+        }
+        return redis.NewString("OK"), nil
+    case "no-evict":
+        if len(args) != 1 {
+            return toRespErrorf("len(args) = %d, expect = 1", len(args))
+        }
+        switch strings.ToLower(string(args[0])) {
+        case "on":
+            c.noEvict.Set(1)
+        case "off":
+            c.noEvict.Set(0)
+        default:
+            return toRespErrorf("syntax error")
+        }
+        return redis.NewString("OK"), nil
+    default:
+        return toRespErrorf("unknown CLIENT subcommand %s", sub)
+    }
+}
+
+func init() {
+    // a client may inspect and name itself, acting on others needs admin
+    register(&command{name: "client", f: ClientCmd, flag: CmdLoading|CmdStale|CmdNoScript, arity: -2,
+        subFlags: map[string]CommandFlag{"kill": CmdAdmin, "pause": CmdAdmin, "unpause": CmdAdmin, "list": CmdAdmin},
+        group: "connection", summary: "Manage client connections"})
+}
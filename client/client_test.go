@@ -0,0 +1,152 @@
+package client_test
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+    "github.com/rocket323/bitserver"
+    "github.com/rocket323/bitserver/client"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type testClientSuite struct {
+    svrs    []*bitserver.Server
+    addrs   []string
+}
+
+var _ = Suite(&testClientSuite{})
+
+func (s *testClientSuite) SetUpSuite(c *C) {
+    for _, port := range []int{17940, 17941} {
+        config := bitserver.DefaultConfig()
+        config.Listen = port
+        config.Dbpath = c.MkDir()
+        svr, err := bitserver.NewServerWithOptions(context.Background(), config, nil)
+        c.Assert(err, IsNil)
+        go svr.Serve()
+        s.svrs = append(s.svrs, svr)
+        s.addrs = append(s.addrs, fmt.Sprintf("127.0.0.1:%d", port))
+    }
+}
+
+func (s *testClientSuite) TearDownSuite(c *C) {
+    for _, svr := range s.svrs {
+        svr.Close()
+    }
+}
+
+func (s *testClientSuite) TestReplies(c *C) {
+    _, err := client.Int(redis.NewError(fmt.Errorf("ERR boom")), nil)
+    c.Assert(err, Equals, client.Error("ERR boom"))
+    _, err = client.Bytes(&redis.BulkBytes{}, nil)
+    c.Assert(err, Equals, client.ErrNil)
+    ints, err := client.Ints(&redis.Array{Value: []redis.Resp{redis.NewInt(1), redis.NewInt(2)}}, nil)
+    c.Assert(err, IsNil)
+    c.Assert(ints, DeepEquals, []int64{1, 2})
+    c.Assert(client.OK(redis.NewString("QUEUED"), nil), NotNil)
+}
+
+func (s *testClientSuite) TestHashKeyToSlot(c *C) {
+    tag, slot := client.HashKeyToSlot([]byte("a{b}c"))
+    c.Assert(string(tag), Equals, "b")
+    _, slot2 := client.HashKeyToSlot([]byte("b"))
+    c.Assert(slot, Equals, slot2)
+    c.Assert(slot < client.MaxSlotNum, Equals, true)
+}
+
+func (s *testClientSuite) TestPipeline(c *C) {
+    cc, err := client.Dial(s.addrs[0], &client.Options{Timeout: time.Second})
+    c.Assert(err, IsNil)
+    defer cc.Close()
+
+    resps, err := cc.Pipeline(redis.NewRequest("set", "p", "1"), redis.NewRequest("get", "p"), redis.NewRequest("del", "p"))
+    c.Assert(err, IsNil)
+    c.Assert(resps, HasLen, 3)
+    c.Assert(client.OK(resps[0], nil), IsNil)
+    v, err := client.String(resps[1], nil)
+    c.Assert(err, IsNil)
+    c.Assert(v, Equals, "1")
+    n, err := client.Int(resps[2], nil)
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, int64(1))
+
+    c.Assert(cc.Send("set", "q", "2"), IsNil)
+    v, err = client.String(cc.Do("get", "q"))
+    c.Assert(err, IsNil)
+    c.Assert(v, Equals, "2")
+}
+
+func (s *testClientSuite) TestPool(c *C) {
+    p := client.NewPool(s.addrs[0], &client.Options{MaxIdle: 1})
+    defer p.Close()
+
+    c1, err := p.Get()
+    c.Assert(err, IsNil)
+    c2, err := p.Get()
+    c.Assert(err, IsNil)
+    p.Put(c1)
+    p.Put(c2)
+    c.Assert(p.Idle(), Equals, 1)
+    c.Assert(c1.Err(), Equals, client.ErrClosed)
+
+    c.Assert(client.OK(p.Do("set", "a", "1")), IsNil)
+    p.Close()
+    _, err = p.Get()
+    c.Assert(err, Equals, client.ErrClosed)
+}
+
+func (s *testClientSuite) TestMigrateSlot(c *C) {
+    src, err := client.Dial(s.addrs[0], nil)
+    c.Assert(err, IsNil)
+    defer src.Close()
+    dst, err := client.Dial(s.addrs[1], nil)
+    c.Assert(err, IsNil)
+    defer dst.Close()
+
+    for i := 0; i < 3; i++ {
+        c.Assert(client.OK(src.Do("set", fmt.Sprintf("{m}%d", i), i)), IsNil)
+    }
+    _, slot := client.HashKeyToSlot([]byte("m"))
+    infos, err := src.SlotsInfo(int(slot), 1)
+    c.Assert(err, IsNil)
+    c.Assert(infos, DeepEquals, []client.SlotInfo{{Slot: slot, Keys: 1}})
+
+    n, err := src.MigrateSlotAll("127.0.0.1", 17941, time.Second, slot, false)
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, int64(3))
+    infos, err = src.SlotsInfo(int(slot), 1)
+    c.Assert(err, IsNil)
+    c.Assert(infos, HasLen, 0)
+    v, err := client.String(dst.Do("get", "{m}2"))
+    c.Assert(err, IsNil)
+    c.Assert(v, Equals, "2")
+}
+
+func (s *testClientSuite) TestReplication(c *C) {
+    master, err := client.Dial(s.addrs[0], nil)
+    c.Assert(err, IsNil)
+    defer master.Close()
+    slave, err := client.Dial(s.addrs[1], nil)
+    c.Assert(err, IsNil)
+    defer slave.Close()
+
+    role, err := master.Role()
+    c.Assert(err, IsNil)
+    c.Assert(role.IsMaster(), Equals, true)
+
+    c.Assert(slave.SlaveOf("127.0.0.1", 17940), IsNil)
+    role, err = slave.Role()
+    c.Assert(err, IsNil)
+    c.Assert(role.Role, Equals, "slave")
+    c.Assert(role.MasterHost, Equals, "127.0.0.1")
+    c.Assert(role.MasterPort, Equals, 17940)
+
+    c.Assert(slave.SlaveOfNoOne(), IsNil)
+    role, err = slave.Role()
+    c.Assert(err, IsNil)
+    c.Assert(role.IsMaster(), Equals, true)
+}
@@ -0,0 +1,236 @@
+// Package client is a Go client of bitserver, with pooling, pipelining,
+// typed replies and helpers for slots migration and replication.
+package client
+
+import (
+    "bufio"
+    "errors"
+    "net"
+    "time"
+
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+var (
+    ErrClosed = errors.New("client is closed")
+    errPending = errors.New("receive pending replies before a pipeline")
+)
+
+// Options of Dial and NewPool
+type Options struct {
+    // dials tcp if nil, e.g. set it to dial with tls
+    Dial        func(addr string, timeout time.Duration) (net.Conn, error)
+    // timeout of dialing, no timeout if zero
+    DialTimeout time.Duration
+    // timeout of each request, no timeout if zero
+    Timeout     time.Duration
+    // sent with AUTH once connected if Password is not empty, User may be empty
+    User        string
+    Password    string
+
+    // idle connections kept by a pool, DefaultMaxIdle if zero
+    MaxIdle     int
+    // idle connections are closed after IdleTimeout, DefaultIdleTimeout if zero
+    IdleTimeout time.Duration
+}
+
+const (
+    DefaultMaxIdle = 16
+    DefaultIdleTimeout = 10 * time.Second
+)
+
+// Conn is a connection to bitserver, it must not be used concurrently.
+// Once a network error happened, every call returns it, see Err.
+type Conn struct {
+    nc      net.Conn
+    r       *bufio.Reader
+    w       *bufio.Writer
+    timeout time.Duration
+    // requests sent but not received
+    pending int
+    err     error
+    // last time the connection was used, for pools
+    last    time.Time
+}
+
+// Dial connects to addr, authenticating if opts says so. opts may be nil.
+func Dial(addr string, opts *Options) (*Conn, error) {
+    if opts == nil {
+        opts = &Options{}
+    }
+    dial := opts.Dial
+    if dial == nil {
+        dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+            return net.DialTimeout("tcp", addr, timeout)
+        }
+    }
+    nc, err := dial(addr, opts.DialTimeout)
+    if err != nil {
+        return nil, err
+    }
+
+    c := NewConn(nc, opts.Timeout)
+    if opts.Password != "" {
+        var err error
+        if opts.User != "" {
+            err = OK(c.Do("AUTH", opts.User, opts.Password))
+        } else {
+            err = OK(c.Do("AUTH", opts.Password))
+        }
+        if err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+// NewConn wraps an established connection
+func NewConn(nc net.Conn, timeout time.Duration) *Conn {
+    return &Conn{
+        nc: nc,
+        r: bufio.NewReader(nc),
+        w: bufio.NewWriter(nc),
+        timeout: timeout,
+        last: time.Now(),
+    }
+}
+
+// SetTimeout changes the timeout of following requests, zero means no timeout
+func (c *Conn) SetTimeout(timeout time.Duration) {
+    c.timeout = timeout
+}
+
+// Err returns the error which broke the connection, if any
+func (c *Conn) Err() error {
+    return c.err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+    return c.nc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+    return c.nc.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+    if c.err == nil {
+        c.err = ErrClosed
+    }
+    return c.nc.Close()
+}
+
+func (c *Conn) fail(err error) error {
+    if c.err == nil {
+        c.err = err
+    }
+    return err
+}
+
+// Send buffers a request without waiting for its reply, see Flush and Receive
+func (c *Conn) Send(cmd string, args ...interface{}) error {
+    return c.SendRequest(redis.NewRequest(cmd, args...))
+}
+
+// SendRequest is Send of a request built by the caller
+func (c *Conn) SendRequest(req *redis.Array) error {
+    if c.err != nil {
+        return c.err
+    }
+    if c.timeout > 0 {
+        if err := c.nc.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+            return c.fail(err)
+        }
+    }
+    if err := redis.Encode(c.w, req); err != nil {
+        return c.fail(err)
+    }
+    c.pending++
+    return nil
+}
+
+// Flush writes buffered requests
+func (c *Conn) Flush() error {
+    if c.err != nil {
+        return c.err
+    }
+    if c.timeout > 0 {
+        if err := c.nc.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+            return c.fail(err)
+        }
+    }
+    if err := c.w.Flush(); err != nil {
+        return c.fail(err)
+    }
+    return nil
+}
+
+// Receive reads the reply of the oldest pending request.
+// Error replies are returned as *redis.Error with a nil error, see the typed reply helpers.
+func (c *Conn) Receive() (redis.Resp, error) {
+    if c.err != nil {
+        return nil, c.err
+    }
+    if c.timeout > 0 {
+        if err := c.nc.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+            return nil, c.fail(err)
+        }
+    }
+    resp, err := redis.Decode(c.r)
+    if err != nil {
+        return nil, c.fail(err)
+    }
+    if c.pending > 0 {
+        c.pending--
+    }
+    c.last = time.Now()
+    return resp, nil
+}
+
+// Do sends a request and returns its reply, after receiving replies of pending requests
+func (c *Conn) Do(cmd string, args ...interface{}) (redis.Resp, error) {
+    return c.DoRequest(redis.NewRequest(cmd, args...))
+}
+
+// DoRequest is Do of a request built by the caller
+func (c *Conn) DoRequest(req *redis.Array) (redis.Resp, error) {
+    if err := c.SendRequest(req); err != nil {
+        return nil, err
+    }
+    if err := c.Flush(); err != nil {
+        return nil, err
+    }
+    var resp redis.Resp
+    for c.pending > 0 {
+        var err error
+        if resp, err = c.Receive(); err != nil {
+            return nil, err
+        }
+    }
+    return resp, nil
+}
+
+// Pipeline sends all requests at once, then returns their replies in order
+func (c *Conn) Pipeline(reqs ...*redis.Array) ([]redis.Resp, error) {
+    if c.pending != 0 {
+        return nil, errPending
+    }
+    for _, req := range reqs {
+        if err := c.SendRequest(req); err != nil {
+            return nil, err
+        }
+    }
+    if err := c.Flush(); err != nil {
+        return nil, err
+    }
+    resps := make([]redis.Resp, 0, len(reqs))
+    for range reqs {
+        resp, err := c.Receive()
+        if err != nil {
+            return nil, err
+        }
+        resps = append(resps, resp)
+    }
+    return resps, nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+    "container/list"
+    "sync"
+    "time"
+
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// Pool keeps idle connections to one address, it is safe for concurrent use
+type Pool struct {
+    addr    string
+    opts    Options
+
+    mu      sync.Mutex
+    // most recently used first
+    idle    *list.List
+    closed  bool
+}
+
+// NewPool returns a pool of connections to addr, dialed with opts which may be nil
+func NewPool(addr string, opts *Options) *Pool {
+    p := &Pool{addr: addr, idle: list.New()}
+    if opts != nil {
+        p.opts = *opts
+    }
+    if p.opts.MaxIdle == 0 {
+        p.opts.MaxIdle = DefaultMaxIdle
+    }
+    if p.opts.IdleTimeout == 0 {
+        p.opts.IdleTimeout = DefaultIdleTimeout
+    }
+    return p
+}
+
+func (p *Pool) Addr() string {
+    return p.addr
+}
+
+// Get returns an idle connection, or dials a new one
+func (p *Pool) Get() (*Conn, error) {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        return nil, ErrClosed
+    }
+    p.closeStale()
+    if e := p.idle.Front(); e != nil {
+        c := p.idle.Remove(e).(*Conn)
+        p.mu.Unlock()
+        c.SetTimeout(p.opts.Timeout)
+        return c, nil
+    }
+    p.mu.Unlock()
+    return Dial(p.addr, &p.opts)
+}
+
+// Put gives c back, broken connections or ones with pending replies are closed
+func (p *Pool) Put(c *Conn) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.closed || c.err != nil || c.pending != 0 {
+        c.Close()
+        return
+    }
+    c.last = time.Now()
+    p.idle.PushFront(c)
+    for p.idle.Len() > p.opts.MaxIdle {
+        p.idle.Remove(p.idle.Back()).(*Conn).Close()
+    }
+    p.closeStale()
+}
+
+// closeStale closes connections idle for more than IdleTimeout, the oldest are at back
+func (p *Pool) closeStale() {
+    for e := p.idle.Back(); e != nil; e = p.idle.Back() {
+        c := e.Value.(*Conn)
+        if time.Since(c.last) < p.opts.IdleTimeout {
+            return
+        }
+        p.idle.Remove(e)
+        c.Close()
+    }
+}
+
+// Idle returns the number of idle connections
+func (p *Pool) Idle() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.idle.Len()
+}
+
+// Do runs one request on a pooled connection
+func (p *Pool) Do(cmd string, args ...interface{}) (redis.Resp, error) {
+    c, err := p.Get()
+    if err != nil {
+        return nil, err
+    }
+    defer p.Put(c)
+    return c.Do(cmd, args...)
+}
+
+// Close closes idle connections, connections put back later are closed as well
+func (p *Pool) Close() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.closed = true
+    for e := p.idle.Front(); e != nil; e = e.Next() {
+        e.Value.(*Conn).Close()
+    }
+    p.idle.Init()
+}
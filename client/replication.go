@@ -0,0 +1,85 @@
+package client
+
+import (
+    "fmt"
+)
+
+// Role is the reply of ROLE
+type Role struct {
+    // "master" or "slave"
+    Role        string
+    // hosts of slaves of a master
+    Slaves      []string
+
+    // master of a slave, and the position of BSYNC in its data-files
+    MasterHost  string
+    MasterPort  int
+    SyncFileId  int64
+    SyncOffset  int64
+}
+
+func (r *Role) IsMaster() bool {
+    return r.Role == "master"
+}
+
+// SlaveOf makes the server a slave of host:port
+func (c *Conn) SlaveOf(host string, port int) error {
+    return OK(c.Do("SLAVEOF", host, port))
+}
+
+// SlaveOfNoOne turns a slave into a master
+func (c *Conn) SlaveOfNoOne() error {
+    return OK(c.Do("SLAVEOF", "NO", "ONE"))
+}
+
+func (c *Conn) Role() (*Role, error) {
+    values, err := Array(c.Do("ROLE"))
+    if err != nil {
+        return nil, err
+    }
+    if len(values) == 0 {
+        return nil, fmt.Errorf("empty role reply")
+    }
+    role, err := String(values[0], nil)
+    if err != nil {
+        return nil, err
+    }
+
+    r := &Role{Role: role}
+    switch role {
+    case "master":
+        if len(values) < 2 {
+            return nil, fmt.Errorf("invalid master role reply")
+        }
+        slaves, err := Array(values[1], nil)
+        if err != nil {
+            return nil, err
+        }
+        for _, slave := range slaves {
+            fields, err := Strings(slave, nil)
+            if err != nil {
+                return nil, err
+            }
+            if len(fields) != 0 {
+                r.Slaves = append(r.Slaves, fields[0])
+            }
+        }
+    case "slave":
+        if len(values) != 5 {
+            return nil, fmt.Errorf("invalid slave role reply")
+        }
+        if r.MasterHost, err = String(values[1], nil); err != nil {
+            return nil, err
+        }
+        var ints [3]int64
+        for i := range ints {
+            if ints[i], err = Int(values[i + 2], nil); err != nil {
+                return nil, err
+            }
+        }
+        r.MasterPort, r.SyncFileId, r.SyncOffset = int(ints[0]), ints[1], ints[2]
+    default:
+        return nil, fmt.Errorf("unknown role %s", role)
+    }
+    return r, nil
+}
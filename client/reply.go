@@ -0,0 +1,118 @@
+package client
+
+import (
+    "errors"
+    "fmt"
+
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// ErrNil is returned by typed reply helpers for nil bulk replies
+var ErrNil = errors.New("nil reply")
+
+// Error is an error reply of the server
+type Error string
+
+func (e Error) Error() string {
+    return string(e)
+}
+
+// The typed reply helpers take the results of Do, e.g. client.Int(c.Do("DEL", key)),
+// and turn error replies into Error.
+
+func replyError(resp redis.Resp, err error) error {
+    if err != nil {
+        return err
+    }
+    if x, ok := resp.(*redis.Error); ok {
+        return Error(x.Value)
+    }
+    return nil
+}
+
+// OK checks for a +OK reply
+func OK(resp redis.Resp, err error) error {
+    s, err := String(resp, err)
+    if err != nil {
+        return err
+    }
+    if s != "OK" {
+        return fmt.Errorf("not ok, got %s", s)
+    }
+    return nil
+}
+
+// String converts simple string and bulk replies
+func String(resp redis.Resp, err error) (string, error) {
+    b, err := Bytes(resp, err)
+    return string(b), err
+}
+
+// Bytes converts simple string and bulk replies
+func Bytes(resp redis.Resp, err error) ([]byte, error) {
+    if err := replyError(resp, err); err != nil {
+        return nil, err
+    }
+    switch x := resp.(type) {
+    case *redis.String:
+        return []byte(x.Value), nil
+    case *redis.BulkBytes:
+        if x.Value == nil {
+            return nil, ErrNil
+        }
+        return x.Value, nil
+    default:
+        return nil, fmt.Errorf("unexpected reply type %T", resp)
+    }
+}
+
+func Int(resp redis.Resp, err error) (int64, error) {
+    if err := replyError(resp, err); err != nil {
+        return 0, err
+    }
+    if x, ok := resp.(*redis.Int); ok {
+        return x.Value, nil
+    }
+    return 0, fmt.Errorf("unexpected reply type %T", resp)
+}
+
+// Array converts array replies
+func Array(resp redis.Resp, err error) ([]redis.Resp, error) {
+    if err := replyError(resp, err); err != nil {
+        return nil, err
+    }
+    if x, ok := resp.(*redis.Array); ok {
+        return x.Value, nil
+    }
+    return nil, fmt.Errorf("unexpected reply type %T", resp)
+}
+
+// Ints converts arrays of integers
+func Ints(resp redis.Resp, err error) ([]int64, error) {
+    values, err := Array(resp, err)
+    if err != nil {
+        return nil, err
+    }
+    ints := make([]int64, len(values))
+    for i, v := range values {
+        if ints[i], err = Int(v, nil); err != nil {
+            return nil, err
+        }
+    }
+    return ints, nil
+}
+
+// Strings converts arrays of strings, nil elements become empty strings
+func Strings(resp redis.Resp, err error) ([]string, error) {
+    values, err := Array(resp, err)
+    if err != nil {
+        return nil, err
+    }
+    strs := make([]string, len(values))
+    for i, v := range values {
+        if strs[i], err = String(v, nil); err != nil && err != ErrNil {
+            return nil, err
+        }
+    }
+    return strs, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+    "bytes"
+    "fmt"
+    "hash/crc32"
+    "time"
+)
+
+// MaxSlotNum is the number of codis slots
+const MaxSlotNum = 1024
+
+// HashTag returns the part of key between the first { and the following }, or key itself
+func HashTag(key []byte) []byte {
+    part := key
+    if i := bytes.IndexByte(part, '{'); i != -1 {
+        part = part[i+1:]
+    } else {
+        return key
+    }
+    if i := bytes.IndexByte(part, '}'); i != -1 {
+        return part[:i]
+    } else {
+        return key
+    }
+}
+
+func HashTagToSlot(tag []byte) uint32 {
+    return crc32.ChecksumIEEE(tag) % MaxSlotNum
+}
+
+// HashKeyToSlot returns the hash tag of key and its slot
+func HashKeyToSlot(key []byte) ([]byte, uint32) {
+    tag := HashTag(key)
+    return tag, HashTagToSlot(tag)
+}
+
+// SlotInfo is an entry of SLOTSINFO, bitserver only tells whether a slot has keys
+type SlotInfo struct {
+    Slot    uint32
+    Keys    int64
+}
+
+// SlotsInfo returns non-empty slots among count slots from start
+func (c *Conn) SlotsInfo(start, count int) ([]SlotInfo, error) {
+    values, err := Array(c.Do("SLOTSINFO", start, count))
+    if err != nil {
+        return nil, err
+    }
+    var infos []SlotInfo
+    for _, v := range values {
+        ints, err := Ints(v, nil)
+        if err != nil {
+            return nil, err
+        }
+        if len(ints) != 2 {
+            return nil, fmt.Errorf("invalid slotsinfo entry %v", ints)
+        }
+        if ints[1] != 0 {
+            infos = append(infos, SlotInfo{Slot: uint32(ints[0]), Keys: ints[1]})
+        }
+    }
+    return infos, nil
+}
+
+func msec(d time.Duration) int64 {
+    return int64(d / time.Millisecond)
+}
+
+func migrated(resp []int64, err error) (int64, error) {
+    if err != nil {
+        return 0, err
+    }
+    if len(resp) != 2 {
+        return 0, fmt.Errorf("invalid migrate reply %v", resp)
+    }
+    return resp[0], nil
+}
+
+// MigrateSlot moves one key of slot to host:port, returning the number of keys moved, 0 once slot is empty
+func (c *Conn) MigrateSlot(host string, port int, timeout time.Duration, slot uint32) (int64, error) {
+    return migrated(Ints(c.Do("SLOTSMGRTSLOT", host, port, msec(timeout), slot)))
+}
+
+// MigrateTagSlot is MigrateSlot moving all keys sharing the hash tag of the key moved
+func (c *Conn) MigrateTagSlot(host string, port int, timeout time.Duration, slot uint32) (int64, error) {
+    return migrated(Ints(c.Do("SLOTSMGRTTAGSLOT", host, port, msec(timeout), slot)))
+}
+
+// MigrateOne moves key to host:port
+func (c *Conn) MigrateOne(host string, port int, timeout time.Duration, key []byte) (int64, error) {
+    return Int(c.Do("SLOTSMGRTONE", host, port, msec(timeout), key))
+}
+
+// MigrateSlotAll calls MigrateTagSlot, or MigrateSlot if tagged is false, until slot is empty,
+// returning the number of keys moved
+func (c *Conn) MigrateSlotAll(host string, port int, timeout time.Duration, slot uint32, tagged bool) (int64, error) {
+    var total int64
+    for {
+        var n int64
+        var err error
+        if tagged {
+            n, err = c.MigrateTagSlot(host, port, timeout, slot)
+        } else {
+            n, err = c.MigrateSlot(host, port, timeout, slot)
+        }
+        if err != nil {
+            return total, err
+        }
+        if n == 0 {
+            return total, nil
+        }
+        total += n
+    }
+}
@@ -0,0 +1,168 @@
+package bitserver
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testClientSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testClientSuite{})
+
+func (s *testClientSuite) SetUpSuite(c *C) {
+    s.s = testCreateServer(c, 17830, c.MkDir())
+}
+
+func (s *testClientSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testClientSuite) TestName(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    resp := nc.doCmd(c, "client", "getname")
+    c.Assert(resp, DeepEquals, redis.NewBulkBytes(nil))
+    nc.checkError(c, ".*cannot contain spaces.*", "client", "setname", "a b")
+    nc.checkOK(c, "client", "setname", "worker")
+    nc.checkString(c, "worker", "client", "getname")
+
+    resp = nc.doCmd(c, "client", "id")
+    id, ok := resp.(*redis.Int)
+    c.Assert(ok, Equals, true)
+
+    resp = nc.doCmd(c, "client", "list", "id", id.Value)
+    list, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(string(list.Value), Matches, fmt.Sprintf("id=%d .* name=worker .* flags=N cmd=client .*\n", id.Value))
+}
+
+func (s *testClientSuite) TestKill(c *C) {
+    victim := testGetConn(c, s.s.port)
+    defer victim.Close()
+    victim.checkOK(c, "client", "setname", "victim")
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    addr := victim.LocalAddr().String()
+    nc.checkInt(c, 0, "client", "kill", "type", "slave")
+    nc.checkInt(c, 1, "client", "kill", "addr", addr)
+    nc.checkError(c, "No such client", "client", "kill", addr)
+
+    resp := nc.doCmd(c, "client", "list")
+    list, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(strings.Contains(string(list.Value), "name=victim"), Equals, false)
+}
+
+func (s *testClientSuite) TestPause(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "client", "pause", 500, "write")
+    begin := time.Now()
+    s.s.checkString(c, "", "get", "paused")
+    c.Assert(time.Since(begin) < 250 * time.Millisecond, Equals, true)
+    s.s.checkOK(c, "set", "paused", "1")
+    c.Assert(time.Since(begin) >= 400 * time.Millisecond, Equals, true)
+
+    nc.checkOK(c, "client", "pause", 10000, "all")
+    go func() {
+        time.Sleep(200 * time.Millisecond)
+        s.s.checkOK(c, "client", "unpause")
+    }()
+    begin = time.Now()
+    s.s.checkString(c, "1", "get", "paused")
+    c.Assert(time.Since(begin) < 5 * time.Second, Equals, true)
+}
+
+type testClientLimitSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testClientLimitSuite{})
+
+func (s *testClientLimitSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17831
+    config.Dbpath = c.MkDir()
+    config.MaxClients = 2
+    config.Timeout = 1
+    config.NormalOutputBufferLimit = OutputBufferLimit{Hard: 1024}
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testClientLimitSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testClientLimitSuite) checkStat(c *C, name string, expect int64) {
+    resp := s.s.doCmd(c, "info", "stats")
+    info, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(strings.Contains(string(info.Value), fmt.Sprintf("%s:%d\r\n", name, expect)), Equals, true)
+}
+
+func (s *testClientLimitSuite) TestMaxClients(c *C) {
+    nc1 := testGetConn(c, s.s.port)
+    defer nc1.Close()
+    nc1.checkOK(c, "set", "a", "1")
+    nc2 := testGetConn(c, s.s.port)
+    defer nc2.Close()
+    nc2.checkOK(c, "set", "a", "1")
+
+    nc3 := testGetConn(c, s.s.port)
+    defer nc3.Close()
+    resp, err := nc3.Receive()
+    c.Assert(err, IsNil)
+    c.Assert(resp, DeepEquals, redis.NewError(fmt.Errorf("ERR max number of clients reached")))
+}
+
+func (s *testClientLimitSuite) TestIdleTimeout(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+
+    time.Sleep(1500 * time.Millisecond)
+    _, err := nc.Receive()
+    c.Assert(err, NotNil)
+    s.checkStat(c, "client_idle_timeouts", 1)
+}
+
+func (s *testClientLimitSuite) TestOutputBufferLimit(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "big", strings.Repeat("x", 8192))
+
+    c.Assert(nc.Send("get", "big"), IsNil)
+    c.Assert(nc.Flush(), IsNil)
+    _, err := nc.Receive()
+    c.Assert(err, NotNil)
+    s.checkStat(c, "client_output_buffer_limit_disconnections", 1)
+}
+
+func (s *testClientLimitSuite) TestSubscriberOutputLimit(c *C) {
+    // let conns of other tests go, maxclients is 2
+    time.Sleep(200 * time.Millisecond)
+    sub := testGetConn(c, s.s.port)
+    defer sub.Close()
+    c.Assert(sub.Send("subscribe", "limited"), IsNil)
+    c.Assert(sub.Flush(), IsNil)
+    _, err := sub.Receive()
+    c.Assert(err, IsNil)
+
+    // queued messages count as output, the subscriber is dropped before its queue fills
+    resp := s.s.doCmd(c, "publish", "limited", strings.Repeat("x", 2048))
+    c.Assert(resp, DeepEquals, redis.NewInt(0))
+    _, err = sub.Receive()
+    c.Assert(err, NotNil)
+}
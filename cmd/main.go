@@ -2,9 +2,12 @@ package main
 
 import (
     "flag"
+    "fmt"
     "log"
     "os"
     "os/signal"
+    "strconv"
+    "strings"
     "syscall"
     "github.com/rocket323/bitserver"
 )
@@ -12,11 +15,75 @@ import (
 var (
     listenPort int
     dbpath string
+    storage string
+    binds string
+    unixSocket string
+    unixSocketPerm string
+    maxClients int
+    timeout int
+    slowlogLogSlowerThan int64
+    slowlogMaxLen int
+    latencyMonitorThreshold int64
+    metricsAddr string
+    requirePass string
+    masterAuth string
+    masterUser string
+    aclFile string
+    tlsCertFile string
+    tlsKeyFile string
+    tlsCAFile string
+    tlsAuthClients bool
+    tlsReplication bool
+    codisMode bool
+    databases int
+    notifyKeyspaceEvents string
+    appendFsync string
+    backupDir string
+    restoreFrom string
+    archiveDir string
+    autoMerge bool
+    mergeMinSize int64
+    mergeDeadRatio float64
+    mergeWindows string
+    mergeRateLimit int64
+    cdcMaxHoldBytes int64
 )
 
 func init() {
     flag.IntVar(&listenPort, "l", 6379, "listen port")
     flag.StringVar(&dbpath, "db", "testdb", "db path")
+    flag.StringVar(&storage, "storage", "bitcask", "storage engine, bitcask or memory")
+    flag.StringVar(&binds, "bind", "", "comma separated host:port to listen on, 0.0.0.0:<l> if empty")
+    flag.StringVar(&unixSocket, "unixsocket", "", "unix socket path to listen on")
+    flag.StringVar(&unixSocketPerm, "unixsocketperm", "700", "unix socket permissions, in octal")
+    flag.IntVar(&maxClients, "maxclients", 10000, "max number of connected clients, 0 means no limit")
+    flag.IntVar(&timeout, "timeout", 2000, "close connections idle for more than timeout seconds, 0 means never")
+    flag.Int64Var(&slowlogLogSlowerThan, "slowlog-log-slower-than", 10000, "log commands slower than this many microseconds, negative disables slowlog")
+    flag.IntVar(&slowlogMaxLen, "slowlog-max-len", 128, "max number of slowlog entries, 0 or less keeps none")
+    flag.Int64Var(&latencyMonitorThreshold, "latency-monitor-threshold", 100, "record latency events of at least this many milliseconds, 0 disables")
+    flag.StringVar(&metricsAddr, "metrics-addr", "", "http address serving /metrics, /healthz and /readyz")
+    flag.StringVar(&requirePass, "requirepass", "", "password of the default user")
+    flag.StringVar(&masterAuth, "masterauth", "", "password to auth against master and migration targets")
+    flag.StringVar(&masterUser, "masteruser", "", "user of masterauth, empty for the default user")
+    flag.StringVar(&aclFile, "aclfile", "", "acl users file")
+    flag.StringVar(&tlsCertFile, "tls-cert-file", "", "tls certificate")
+    flag.StringVar(&tlsKeyFile, "tls-key-file", "", "tls private key")
+    flag.StringVar(&tlsCAFile, "tls-ca-cert-file", "", "tls ca to verify peers")
+    flag.BoolVar(&tlsAuthClients, "tls-auth-clients", false, "require tls client certificates")
+    flag.BoolVar(&tlsReplication, "tls-replication", false, "use tls for replication and migration")
+    flag.StringVar(&appendFsync, "appendfsync", "everysec", "when to fsync data-files: always, everysec or no")
+    flag.StringVar(&backupDir, "backup-dir", "", "directory of BGSAVE backups, <db>-backup if empty")
+    flag.StringVar(&restoreFrom, "restore-from", "", "restore the backup in this directory into an empty db path before starting")
+    flag.StringVar(&archiveDir, "archive-dir", "", "copy data-files here once they rotate out of active")
+    flag.BoolVar(&autoMerge, "auto-merge", false, "merge automatically by dead bytes ratio and size")
+    flag.Int64Var(&mergeMinSize, "merge-min-size", 512 << 20, "bytes of data-files before auto merge")
+    flag.Float64Var(&mergeDeadRatio, "merge-dead-ratio", 0, "ratio of dead bytes triggering auto merge, 0 merges by growth of merge-min-size")
+    flag.StringVar(&mergeWindows, "merge-windows", "", "HH:MM-HH:MM[,...] windows for auto merge, any time if empty")
+    flag.Int64Var(&mergeRateLimit, "merge-rate-limit", 0, "merge io in bytes per second, 0 means no limit")
+    flag.Int64Var(&cdcMaxHoldBytes, "cdc-max-hold-bytes", 1 << 30, "bytes of data-files CDC cursors may hold back from merges, 0 means no limit")
+    flag.BoolVar(&codisMode, "codis", false, "running behind codis, reject cross-slot transactions and SELECT of db other than 0")
+    flag.IntVar(&databases, "databases", 16, "number of databases")
+    flag.StringVar(&notifyKeyspaceEvents, "notify-keyspace-events", "", "classes of keyspace events to publish, e.g. KEA, M for migrated and R for restored keys")
 }
 
 func main() {
@@ -27,6 +94,53 @@ func main() {
     config := bitserver.DefaultConfig()
     config.Listen = listenPort
     config.Dbpath = dbpath
+    config.Storage = storage
+    if binds != "" {
+        config.Binds = strings.Split(binds, ",")
+    }
+    if unixSocket != "" {
+        if len(config.Binds) == 0 {
+            config.Binds = []string{fmt.Sprintf("0.0.0.0:%d", listenPort)}
+        }
+        config.Binds = append(config.Binds, "unix:" + unixSocket)
+    }
+    perm, err := strconv.ParseUint(unixSocketPerm, 8, 32)
+    if err != nil {
+        log.Fatalf("invalid unixsocketperm %s", unixSocketPerm)
+    }
+    config.UnixSocketPerm = os.FileMode(perm)
+    config.MaxClients = maxClients
+    config.Timeout = timeout
+    config.SlowlogLogSlowerThan = slowlogLogSlowerThan
+    config.SlowlogMaxLen = slowlogMaxLen
+    config.LatencyMonitorThreshold = latencyMonitorThreshold
+    config.MetricsAddr = metricsAddr
+    config.RequirePass = requirePass
+    config.MasterAuth = masterAuth
+    config.MasterUser = masterUser
+    config.AclFile = aclFile
+    config.TLSCertFile = tlsCertFile
+    config.TLSKeyFile = tlsKeyFile
+    config.TLSCAFile = tlsCAFile
+    config.TLSAuthClients = tlsAuthClients
+    config.TLSReplication = tlsReplication
+    config.CodisMode = codisMode
+    config.Databases = databases
+    config.NotifyKeyspaceEvents = notifyKeyspaceEvents
+    config.AppendFsync = appendFsync
+    config.BackupDir = backupDir
+    config.ArchiveDir = archiveDir
+    config.AutoMerge = autoMerge
+    config.MergeMinSize = mergeMinSize
+    config.MergeDeadBytesRatio = mergeDeadRatio
+    config.MergeWindows = mergeWindows
+    config.MergeRateLimit = mergeRateLimit
+    config.CDCMaxHoldBytes = cdcMaxHoldBytes
+    if restoreFrom != "" {
+        if err := bitserver.RestoreBackup(restoreFrom, dbpath); err != nil {
+            log.Fatalf("restore from %s failed, err=%s", restoreFrom, err)
+        }
+    }
     server, err := bitserver.NewServer(config)
     if err != nil {
         log.Fatal(err)
@@ -1,10 +1,11 @@
 package bitserver
 
 import (
+    "sort"
     "strconv"
     "strings"
+    "time"
     "log"
-    "github.com/rocket323/bitcask"
     redis "github.com/reborndb/go/redis/resp"
 )
 
@@ -12,16 +13,28 @@ type command struct {
     name    string
     f       CommandFunc
     flag    CommandFlag
+    // number of args including the command name, -N means at least N
+    arity   int
+    // positions of keys in args, the command name is at 0,
+    // a negative lastKey counts from the end, firstKey is 0 if there are no keys
+    firstKey int
+    lastKey  int
+    keyStep  int
+    // extra flags of some subcommands, acl rules can name them as cmd|sub
+    subFlags map[string]CommandFlag
+    // for COMMAND DOCS
+    group   string
+    summary string
 }
 
 var globalCommand = make(map[string]*command)
 
-func register(name string, f CommandFunc, flag CommandFlag) {
-    funcName := strings.ToLower(name)
-    if _, ok := globalCommand[funcName]; ok {
-        log.Fatalf("%s has been registered", name)
+func register(cmd *command) {
+    cmd.name = strings.ToLower(cmd.name)
+    if _, ok := globalCommand[cmd.name]; ok {
+        log.Fatalf("%s has been registered", cmd.name)
     }
-    globalCommand[funcName] = &command{name, f, flag}
+    globalCommand[cmd.name] = cmd
 }
 
 type CommandFunc func(c *conn, args [][]byte) (redis.Resp, error)
@@ -30,23 +43,134 @@ type CommandFlag uint32
 const (
     CmdWrite CommandFlag = 1 << iota
     CmdReadOnly
+    CmdAdmin
+    CmdSlots
+    CmdReplication
+    // allowed before authentication, not subject to acl
+    CmdNoAuth
+    CmdNoScript
+    CmdFast
+    // allowed while loading data
+    CmdLoading
+    // allowed on a slave that lost its master
+    CmdStale
+    // can't be queued in MULTI
+    CmdNoMulti
+    CmdPubSub
 )
 
+// flag names in COMMAND output
+var commandFlagNames = []struct {
+    flag CommandFlag
+    name string
+}{
+    {CmdWrite, "write"},
+    {CmdReadOnly, "readonly"},
+    {CmdAdmin, "admin"},
+    {CmdNoAuth, "no-auth"},
+    {CmdNoScript, "noscript"},
+    {CmdFast, "fast"},
+    {CmdLoading, "loading"},
+    {CmdStale, "stale"},
+    {CmdNoMulti, "no-multi"},
+    {CmdPubSub, "pubsub"},
+}
+
+// Register adds a command taking any number of args and no keys
 func Register(name string, f CommandFunc, flag CommandFlag) {
-    register(name, f, flag)
+    register(&command{name: name, f: f, flag: flag, arity: -1})
 }
 
-// GET key
-func GetCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) < 1 {
-        return toRespErrorf("len(args) = %d, expect >= 1", len(args))
+func (cmd *command) checkArity(args [][]byte) bool {
+    argc := len(args) + 1
+    if cmd.arity >= 0 {
+        return argc == cmd.arity
+    }
+    return argc >= -cmd.arity
+}
+
+// aclName is the name acl rules use for this call, cmd|sub for subcommands with their own flags
+func (cmd *command) aclName(args [][]byte) string {
+    if len(cmd.subFlags) != 0 && len(args) != 0 {
+        sub := strings.ToLower(string(args[0]))
+        if _, ok := cmd.subFlags[sub]; ok {
+            return cmd.name + "|" + sub
+        }
+    }
+    return cmd.name
+}
+
+// keys returns the keys in args, which don't include the command name
+func (cmd *command) keys(args [][]byte) [][]byte {
+    if cmd.firstKey == 0 {
+        return nil
+    }
+    argc := len(args) + 1
+    last := cmd.lastKey
+    if last < 0 {
+        last += argc
+    }
+    var keys [][]byte
+    for i := cmd.firstKey; i <= last && i < argc; i += cmd.keyStep {
+        keys = append(keys, args[i - 1])
+    }
+    return keys
+}
+
+func (cmd *command) info() *redis.Array {
+    flags := &respSet{}
+    for _, fn := range commandFlagNames {
+        if cmd.flag&fn.flag != 0 {
+            flags.Value = append(flags.Value, redis.NewString(fn.name))
+        }
+    }
+    cats := make([]string, 0)
+    for cat, flag := range aclCategories {
+        if cmd.flag&flag != 0 {
+            cats = append(cats, "@" + cat)
+        }
     }
+    sort.Strings(cats)
+    categories := redis.NewArray()
+    for _, cat := range cats {
+        categories.Append(redis.NewString(cat))
+    }
+
+    resp := redis.NewArray()
+    resp.AppendBulkBytes([]byte(cmd.name))
+    resp.AppendInt(int64(cmd.arity))
+    resp.Append(flags)
+    resp.AppendInt(int64(cmd.firstKey))
+    resp.AppendInt(int64(cmd.lastKey))
+    resp.AppendInt(int64(cmd.keyStep))
+    resp.Append(categories)
+    return resp
+}
+
+func (cmd *command) docs() *respMap {
+    resp := newRespMap()
+    resp.Add("summary", redis.NewBulkBytesWithString(cmd.summary))
+    resp.Add("group", redis.NewBulkBytesWithString(cmd.group))
+    return resp
+}
 
+func sortedCommands(htable map[string]*command) []*command {
+    cmds := make([]*command, 0, len(htable))
+    for _, cmd := range htable {
+        cmds = append(cmds, cmd)
+    }
+    sort.Slice(cmds, func(i, j int) bool {
+        return cmds[i].name < cmds[j].name
+    })
+    return cmds
+}
+
+// GET key
+func GetCmd(c *conn, args [][]byte) (redis.Resp, error) {
     key := args[0]
-    bc := c.s.bc
 
-    value, err := bc.Get(key)
-    if err != nil && err != bitcask.ErrKeyNotFound {
+    value, err := c.s.get(c, c.dbKey(key))
+    if err != nil && err != ErrKeyNotFound {
         return toRespError(err)
     } else {
         return redis.NewBulkBytes(value), nil
@@ -55,15 +179,14 @@ func GetCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SET key value [EX seconds]
 func SetCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) < 2 {
-        return toRespErrorf("len(args) = %d, expect >= 2", len(args))
-    }
-
     key := args[0]
     value := args[1]
-    bc := c.s.bc
 
-    err := bc.Set(key, value)
+    key = c.dbKey(key)
+    b := &writeBatch{}
+    b.Put(key, value)
+    b.notify(notifyString, "set", key)
+    err := c.s.commit(c, b)
     if err != nil {
         return toRespError(err)
     } else {
@@ -73,40 +196,159 @@ func SetCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // DEL KEY [KEY ...]
 func DelCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) < 1 {
-        return toRespErrorf("len(args) = %d, expect >= 2", len(args))
-    }
     keys := args
     var cnt int64 = 0
-    bc := c.s.bc
 
+    b := &writeBatch{}
     for _, key := range keys {
-        err := bc.Del(key)
-        if err != nil {
-            return redis.NewInt(0), err
+        key = c.dbKey(key)
+        _, err := c.s.get(c, key)
+        if err != nil && err != ErrKeyNotFound {
+            return toRespError(err)
         }
-        cnt++
+        if err == nil {
+            cnt++
+            b.notify(notifyGeneric, "del", key)
+        }
+        b.Delete(key)
+    }
+    if err := c.s.commit(c, b); err != nil {
+        return redis.NewInt(0), err
     }
     return redis.NewInt(cnt), nil
 }
 
 // PING
 func PingCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 0 {
-        return toRespErrorf("len(args) = %d, expect = 0", len(args))
+    if len(args) > 1 {
+        return toRespErrorf("wrong number of arguments for 'ping' command")
+    }
+    // RESP2 subscribers can't tell a status reply from a message
+    if c.subscriptions() > 0 && c.proto.Get() < resp3 {
+        resp := redis.NewArray()
+        resp.AppendBulkBytes([]byte("pong"))
+        if len(args) == 1 {
+            resp.AppendBulkBytes(args[0])
+        } else {
+            resp.AppendBulkBytes([]byte{})
+        }
+        return resp, nil
+    }
+    if len(args) == 1 {
+        return redis.NewBulkBytes(args[0]), nil
     }
     return redis.NewString("PONG"), nil
 }
 
+// ECHO message
+func EchoCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    return redis.NewBulkBytes(args[0]), nil
+}
+
+// QUIT
+func QuitCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.closeAfterReply = true
+    return redis.NewString("OK"), nil
+}
+
+// TIME
+func TimeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    now := time.Now()
+    resp := redis.NewArray()
+    resp.AppendBulkBytes([]byte(strconv.FormatInt(now.Unix(), 10)))
+    resp.AppendBulkBytes([]byte(strconv.FormatInt(int64(now.Nanosecond() / 1000), 10)))
+    return resp, nil
+}
+
+// DEBUG SLEEP seconds
+func DebugCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    switch strings.ToLower(string(args[0])) {
+    case "sleep":
+        if len(args) != 2 {
+            return toRespErrorf("wrong number of arguments for 'debug sleep' command")
+        }
+        secs, err := strconv.ParseFloat(string(args[1]), 64)
+        if err != nil || secs < 0 {
+            return toRespErrorf("value is not a valid float")
+        }
+        t := time.NewTimer(time.Duration(secs * float64(time.Second)))
+        defer t.Stop()
+        select {
+        case <-t.C:
+        case <-c.s.signal:
+        }
+        return redis.NewString("OK"), nil
+    default:
+        return toRespErrorf("unknown subcommand '%s' for 'debug' command", args[0])
+    }
+}
+
+// COMMAND [INFO name... | COUNT | GETKEYS cmd args... | DOCS [name...]]
 func CommandCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    return redis.NewArray(), nil
+    htable := c.s.htable
+    if len(args) == 0 {
+        resp := redis.NewArray()
+        for _, cmd := range sortedCommands(htable) {
+            resp.Append(cmd.info())
+        }
+        return resp, nil
+    }
+
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "info":
+        resp := redis.NewArray()
+        for _, name := range args[1:] {
+            if cmd := htable[strings.ToLower(string(name))]; cmd != nil {
+                resp.Append(cmd.info())
+            } else {
+                resp.Append(redis.NewBulkBytes(nil))
+            }
+        }
+        return resp, nil
+    case "count":
+        return redis.NewInt(int64(len(htable))), nil
+    case "getkeys":
+        if len(args) < 2 {
+            return toRespErrorf("len(args) = %d, expect >= 2", len(args))
+        }
+        cmd := htable[strings.ToLower(string(args[1]))]
+        if cmd == nil {
+            return toRespErrorf("Invalid command specified")
+        }
+        if !cmd.checkArity(args[2:]) {
+            return toRespErrorf("Invalid number of arguments specified for command")
+        }
+        keys := cmd.keys(args[2:])
+        if len(keys) == 0 {
+            return toRespErrorf("The command has no key arguments")
+        }
+        resp := redis.NewArray()
+        for _, key := range keys {
+            resp.AppendBulkBytes(key)
+        }
+        return resp, nil
+    case "docs":
+        cmds := sortedCommands(htable)
+        if len(args) > 1 {
+            cmds = cmds[:0]
+            for _, name := range args[1:] {
+                if cmd := htable[strings.ToLower(string(name))]; cmd != nil {
+                    cmds = append(cmds, cmd)
+                }
+            }
+        }
+        resp := newRespMap()
+        for _, cmd := range cmds {
+            resp.Add(cmd.name, cmd.docs())
+        }
+        return resp, nil
+    default:
+        return toRespErrorf("unknown COMMAND subcommand %s", sub)
+    }
 }
 
 // ROLE
 func RoleCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 0 {
-        return toRespErrorf("len(args) = %d, expect = 0", len(args))
-    }
     arr := redis.NewArray()
     s := c.s
     masterAddr := s.repl.masterAddr.Get()
@@ -149,34 +391,49 @@ func RoleCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // INFO [section]
 func InfoCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    return nil, nil
-}
-
-// MERGE
-func MergeCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    c.s.merge()
-    return redis.NewString("OK"), nil
+    if len(args) > 1 {
+        return toRespErrorf("len(args) = %d, expect <= 1", len(args))
+    }
+    section := "default"
+    if len(args) == 1 {
+        section = strings.ToLower(string(args[0]))
+    }
+    return newVerbatim(c.s.info(section)), nil
 }
 
 // FLUSHALL
 func FlushAllCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    bc := c.s.bc
-    err := bc.ClearAll()
-    if err != nil {
-        toRespError(err)
+    b := &writeBatch{}
+    b.Clear()
+    if err := c.s.commit(c, b); err != nil {
+        return toRespError(err)
     }
     return redis.NewString("OK"), nil
 }
 
 func init() {
-    Register("command", CommandCmd, CmdReadOnly)
-    Register("set", SetCmd, CmdWrite)
-    Register("get", GetCmd, CmdReadOnly)
-    Register("del", DelCmd, CmdWrite)
-    Register("ping", PingCmd, CmdReadOnly)
-    Register("role", RoleCmd, CmdReadOnly)
-    Register("info", InfoCmd, CmdReadOnly)
-    Register("merge", MergeCmd, CmdReadOnly)
-    register("flushall", FlushAllCmd, CmdWrite)
+    register(&command{name: "command", f: CommandCmd, flag: CmdReadOnly|CmdLoading|CmdStale, arity: -1,
+        group: "server", summary: "Get details about commands"})
+    register(&command{name: "set", f: SetCmd, flag: CmdWrite, arity: -3, firstKey: 1, lastKey: 1, keyStep: 1,
+        group: "string", summary: "Set the string value of a key"})
+    register(&command{name: "get", f: GetCmd, flag: CmdReadOnly|CmdFast, arity: 2, firstKey: 1, lastKey: 1, keyStep: 1,
+        group: "string", summary: "Get the value of a key"})
+    register(&command{name: "del", f: DelCmd, flag: CmdWrite, arity: -2, firstKey: 1, lastKey: -1, keyStep: 1,
+        group: "generic", summary: "Delete keys"})
+    register(&command{name: "ping", f: PingCmd, flag: CmdReadOnly|CmdFast|CmdLoading|CmdStale, arity: -1,
+        group: "connection", summary: "Ping the server"})
+    register(&command{name: "echo", f: EchoCmd, flag: CmdReadOnly|CmdFast|CmdLoading|CmdStale, arity: 2,
+        group: "connection", summary: "Echo the given string"})
+    register(&command{name: "quit", f: QuitCmd, flag: CmdNoAuth|CmdFast|CmdLoading|CmdStale, arity: 1,
+        group: "connection", summary: "Close the connection"})
+    register(&command{name: "time", f: TimeCmd, flag: CmdReadOnly|CmdFast|CmdLoading|CmdStale, arity: 1,
+        group: "server", summary: "Return the current server time"})
+    register(&command{name: "debug", f: DebugCmd, flag: CmdAdmin|CmdNoScript, arity: -2,
+        group: "server", summary: "Debugging commands"})
+    register(&command{name: "role", f: RoleCmd, flag: CmdReadOnly|CmdAdmin|CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: 1,
+        group: "server", summary: "Return the role of the instance in the context of replication"})
+    register(&command{name: "info", f: InfoCmd, flag: CmdReadOnly|CmdLoading|CmdStale, arity: -1,
+        group: "server", summary: "Get information and statistics about the server"})
+    register(&command{name: "flushall", f: FlushAllCmd, flag: CmdWrite|CmdAdmin, arity: -1,
+        group: "server", summary: "Remove all keys"})
 }
-
@@ -0,0 +1,70 @@
+package bitserver
+
+import (
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testCommandSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testCommandSuite{})
+
+func (s *testCommandSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17870
+    config.Dbpath = c.MkDir()
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testCommandSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testCommandSuite) TestCommand(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkInt(c, int64(len(globalCommand)), "command", "count")
+
+    resp := nc.doCmd(c, "command", "info", "get", "nosuchcommand")
+    infos, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(infos.Value, HasLen, 2)
+    info := infos.Value[0].(*redis.Array)
+    c.Assert(info.Value, HasLen, 7)
+    c.Assert(string(info.Value[0].(*redis.BulkBytes).Value), Equals, "get")
+    c.Assert(info.Value[1].(*redis.Int).Value, Equals, int64(2))
+    c.Assert(info.Value[3].(*redis.Int).Value, Equals, int64(1))
+    c.Assert(info.Value[4].(*redis.Int).Value, Equals, int64(1))
+    c.Assert(infos.Value[1].(*redis.BulkBytes).Value, IsNil)
+
+    resp = nc.doCmd(c, "command", "getkeys", "slotsrestore", "a", 0, "x", "b", 0, "y")
+    keys := resp.(*redis.Array)
+    c.Assert(keys.Value, HasLen, 2)
+    c.Assert(string(keys.Value[0].(*redis.BulkBytes).Value), Equals, "a")
+    c.Assert(string(keys.Value[1].(*redis.BulkBytes).Value), Equals, "b")
+    nc.checkError(c, "The command has no key arguments", "command", "getkeys", "ping")
+}
+
+func (s *testCommandSuite) TestArity(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkError(c, "wrong number of arguments for 'get' command", "get")
+    nc.checkError(c, "wrong number of arguments for 'get' command", "get", "a", "b")
+    nc.checkError(c, "wrong number of arguments for 'set' command", "set", "a")
+    nc.checkError(c, "wrong number of arguments for 'del' command", "del")
+}
+
+func (s *testCommandSuite) TestKeys(c *C) {
+    del := globalCommand["del"]
+    keys := del.keys([][]byte{[]byte("a"), []byte("b")})
+    c.Assert(keys, HasLen, 2)
+    mgrt := globalCommand["slotsmgrtone"]
+    keys = mgrt.keys([][]byte{[]byte("host"), []byte("1"), []byte("100"), []byte("k")})
+    c.Assert(keys, DeepEquals, [][]byte{[]byte("k")})
+}
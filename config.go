@@ -1,14 +1,194 @@
 package bitserver
 
+import (
+    "os"
+    "strconv"
+    "strings"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
 type Config struct {
     Listen      int
     Dbpath      string
+    // storage engine, StorageBitcask if empty
+    Storage     string
+    // addresses to listen on, tcp host:port or unix socket paths (unix:/path or /path),
+    // 0.0.0.0:Listen if empty
+    Binds       []string
+    // permissions of unix sockets, 0700 if zero
+    UnixSocketPerm os.FileMode
+
+    // max number of connected clients, 0 means no limit
+    MaxClients  int
+    // close connections idle for more than Timeout seconds, 0 means never
+    Timeout     int
+    // output buffer limits of normal clients and slaves
+    NormalOutputBufferLimit OutputBufferLimit
+    SlaveOutputBufferLimit  OutputBufferLimit
+
+    // password of the default user, empty means no password
+    RequirePass string
+    // password used to auth against master (BSYNC) and migration targets
+    MasterAuth  string
+    // user used with MasterAuth, empty means the default user
+    MasterUser  string
+    // file to load/save acl users, empty means acl is not persisted
+    AclFile     string
+
+    // tls is enabled if both cert and key file are set
+    TLSCertFile string
+    TLSKeyFile  string
+    // ca used to verify peers, system roots if empty
+    TLSCAFile   string
+    // require clients to present a certificate signed by TLSCAFile
+    TLSAuthClients bool
+    // use tls for replication and migration connections
+    TLSReplication bool
+
+    // log commands slower than this many microseconds, negative disables slowlog
+    SlowlogLogSlowerThan int64
+    // max number of slowlog entries, 0 or less keeps none
+    SlowlogMaxLen   int
+    // record latency events of at least this many milliseconds, 0 disables
+    LatencyMonitorThreshold int64
+
+    // http address serving /metrics, /healthz and /readyz, empty disables
+    MetricsAddr string
+
+    // running behind codis, transactions must not span slots and only db 0 is used
+    CodisMode   bool
+    // number of databases of SELECT
+    Databases   int
+    // classes of keyspace events to publish, as redis notify-keyspace-events
+    // plus M for migrated and R for restored keys, empty disables them
+    NotifyKeyspaceEvents string
+
+    // when to fsync data-files: FsyncAlways, FsyncEverySec or FsyncNo
+    AppendFsync string
+
+    // BGSAVE puts backups under it, Dbpath + "-backup" if empty
+    BackupDir   string
+    // data-files are copied here once they rotate out of active, empty disables archiving
+    ArchiveDir  string
+
+    // merge automatically once data-files reach MergeMinSize bytes with
+    // at least MergeDeadBytesRatio of dead bytes, within MergeWindows. A ratio
+    // of 0 merges once data-files grew by MergeMinSize since the last merge,
+    // storages not counting dead bytes need it.
+    AutoMerge   bool
+    MergeMinSize int64
+    MergeDeadBytesRatio float64
+    // "HH:MM-HH:MM[,HH:MM-HH:MM...]" in local time, any time if empty
+    MergeWindows string
+    // merge io in bytes per second, 0 means no limit
+    MergeRateLimit int64
+    // CDC cursors lagging behind hold back merges up to this many bytes of
+    // data-files, then they are dropped. 0 means no limit.
+    CDCMaxHoldBytes int64
+}
+
+// OutputBufferLimit disconnects a client once its pending output reaches Hard bytes,
+// or stays above Soft bytes for SoftSeconds. Zero means no limit.
+type OutputBufferLimit struct {
+    Hard        int64
+    Soft        int64
+    SoftSeconds int
 }
 
 func DefaultConfig() *Config {
     return &Config{
         Listen: 6379,
         Dbpath: "testdb",
+        Storage: StorageBitcask,
+        Databases: 16,
+        MaxClients: 10000,
+        Timeout: 2000,
+        SlaveOutputBufferLimit: OutputBufferLimit{
+            Hard: 256 << 20,
+            Soft: 64 << 20,
+            SoftSeconds: 60,
+        },
+        SlowlogLogSlowerThan: 10000,
+        SlowlogMaxLen: 128,
+        LatencyMonitorThreshold: 100,
+        AppendFsync: FsyncEverySec,
+        MergeMinSize: 512 << 20,
+        CDCMaxHoldBytes: 1 << 30,
     }
 }
 
+// parameters of CONFIG GET, in output order
+var configParams = []struct {
+    name    string
+    get     func(s *Server) string
+    // nil if the parameter can't be changed at runtime
+    set     func(s *Server, value string) error
+}{
+    {"appendfsync", func(s *Server) string { return s.fsync.policy.Get() }, func(s *Server, value string) error {
+        if err := checkFsyncPolicy(value); err != nil {
+            return err
+        }
+        s.fsync.policy.Set(value)
+        return nil
+    }},
+    {"databases", func(s *Server) string { return strconv.Itoa(s.databases()) }, nil},
+    {"notify-keyspace-events", func(s *Server) string { return notifyFlagsString(s.notifyFlags.Get()) }, func(s *Server, value string) error {
+        flags, err := parseNotifyFlags(value)
+        if err != nil {
+            return err
+        }
+        s.notifyFlags.Set(flags)
+        return nil
+    }},
+    {"dir", func(s *Server) string { return s.config.Dbpath }, nil},
+    {"port", func(s *Server) string { return strconv.Itoa(s.port()) }, nil},
+    {"maxclients", func(s *Server) string { return strconv.Itoa(s.config.MaxClients) }, nil},
+    {"timeout", func(s *Server) string { return strconv.Itoa(s.config.Timeout) }, nil},
+    {"slowlog-log-slower-than", func(s *Server) string { return strconv.FormatInt(s.config.SlowlogLogSlowerThan, 10) }, nil},
+    {"slowlog-max-len", func(s *Server) string { return strconv.Itoa(s.config.SlowlogMaxLen) }, nil},
+    {"latency-monitor-threshold", func(s *Server) string { return strconv.FormatInt(s.config.LatencyMonitorThreshold, 10) }, nil},
+}
+
+// CONFIG GET pattern | SET parameter value
+func ConfigCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "get":
+        if len(args) != 2 {
+            return toRespErrorf("len(args) = %d, expect = 2", len(args))
+        }
+        pattern := []byte(strings.ToLower(string(args[1])))
+        resp := newRespMap()
+        for _, p := range configParams {
+            if globMatch(pattern, []byte(p.name)) {
+                resp.Add(p.name, redis.NewBulkBytesWithString(p.get(s)))
+            }
+        }
+        return resp, nil
+    case "set":
+        if len(args) != 3 {
+            return toRespErrorf("len(args) = %d, expect = 3", len(args))
+        }
+        name := strings.ToLower(string(args[1]))
+        for _, p := range configParams {
+            if p.name != name {
+                continue
+            }
+            if p.set == nil {
+                return toRespErrorf("Unsupported CONFIG parameter: %s", name)
+            }
+            if err := p.set(s, string(args[2])); err != nil {
+                return toRespError(err)
+            }
+            return redis.NewString("OK"), nil
+        }
+        return toRespErrorf("Unsupported CONFIG parameter: %s", name)
+    default:
+        return toRespErrorf("unknown CONFIG subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "config", f: ConfigCmd, flag: CmdAdmin|CmdLoading|CmdStale|CmdNoScript, arity: -2,
+        group: "server", summary: "Get or set configuration parameters"})
+}
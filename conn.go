@@ -1,13 +1,14 @@
 package bitserver
 
 import (
-    "log"
+    "errors"
     "net"
     "time"
     "fmt"
     "bufio"
     "sync"
     "strings"
+    "github.com/reborndb/go/atomic2"
     redis "github.com/reborndb/go/redis/resp"
 )
 
@@ -22,10 +23,194 @@ type conn struct {
     summ string
     timeout time.Duration
 
-    // replication
-    syncFileId int64
-    syncOffset int64
+    // authenticated acl user, empty if not authenticated
+    user atomic2.String
+    // protocol version chosen by HELLO, resp2 or resp3
+    proto atomic2.Int64
+    // database chosen by SELECT
+    db atomic2.Int64
+
+    // client info, see CLIENT LIST
+    id int64
+    name atomic2.String
+    createTime time.Time
+    lastTime atomic2.Int64
+    lastCmd atomic2.String
+    // conn to our master, as slave
+    isMaster bool
+    // running slots migration
+    migrating atomic2.Int64
+    noEvict atomic2.Int64
+
+    // output bytes buffered in w or being written to nc
+    obuf atomic2.Int64
+    // output bytes waiting in the pub/sub and monitor queues
+    obufQueued atomic2.Int64
+    // replies buffered in w since the last flush, guarded by wLock
+    pendingReplies int64
+    // since when output is above the soft limit in unix nanoseconds, 0 if below
+    obufSoftSince atomic2.Int64
+
+    // pub/sub state, created by the conn's own goroutine on first SUBSCRIBE
+    sub *subscriber
+    // number of channels and patterns subscribed to
+    subs atomic2.Int64
+    psubs atomic2.Int64
+
+    // CDC stream, created by the conn's own goroutine
+    cdc *cdcCursor
+
+    // set by QUIT and protocol errors, the conn is closed once replies are flushed
+    closeAfterReply bool
+
+    // MULTI state, only used by the conn's own goroutine
+    multi bool
+    multiAborted bool
+    multiSlot int
+    queued []*queuedCommand
+    // versions of WATCHed keys, guarded by s.watch
+    watched map[string]uint64
+    watchFlushes uint64
+    // writes of the transaction being EXECed
+    txBatch *writeBatch
+
+    // replication, the sync position is read by INFO and metrics
+    syncFileId atomic2.Int64
+    syncOffset atomic2.Int64
+    // capabilities the slave announced in BSYNC
+    syncCapa syncCapa
+    // a commit group sent to the slave goes on in the next data-file
+    syncInGroup bool
     isSyncing bool
+    // records of the batch being received from master, and their bytes
+    syncBatch []*syncRecord
+    syncBatchBytes int64
+    // the commit group being received from master, groups may span batches of older masters
+    syncGroup recordGroup
+}
+
+var errOutputBufferLimit = errors.New("output buffer limit reached")
+
+// replies of pipelined requests are flushed once this many bytes are buffered,
+// or once no request is left in the input buffer
+const (
+    replyBufferSize = 16 << 10
+    replyFlushSize = 8 << 10
+)
+
+// how long a write may block when no soft limit sets it
+const defaultWriteTimeout = 30 * time.Second
+
+// connWriter writes to nc, enforcing output buffer limits of conn
+type connWriter struct {
+    c *conn
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+    c := w.c
+    // p is either w's buffer, already counted, or a reply too big for it
+    c.obuf.Set(int64(len(p)))
+    defer c.obuf.Set(0)
+    if err := c.checkOutputLimit(0); err != nil {
+        c.s.counters.obufLimitDisconnections.Incr()
+        c.s.logger.Printf("close conn %s, err = %s", c, err)
+        c.nc.Close()
+        return 0, err
+    }
+
+    if err := c.nc.SetWriteDeadline(time.Now().Add(c.writeTimeout())); err != nil {
+        return 0, err
+    }
+    return c.nc.Write(p)
+}
+
+func (c *conn) outputBufferLimit() *OutputBufferLimit {
+    if c.s.isSlave(c) {
+        return &c.s.config.SlaveOutputBufferLimit
+    }
+    return &c.s.config.NormalOutputBufferLimit
+}
+
+// outputBufferSize returns bytes pending to be sent to the client
+func (c *conn) outputBufferSize() int64 {
+    return c.obuf.Get() + c.obufQueued.Get()
+}
+
+// bufferedOutput updates obuf once w took more output, caller holds wLock
+func (c *conn) bufferedOutput() {
+    c.obuf.Set(int64(c.w.Buffered()))
+}
+
+// queueOutput counts resp as pending output while it waits in a queue,
+// unqueueOutput is called once the queue's writer takes it
+func (c *conn) queueOutput(resp redis.Resp) {
+    c.obufQueued.Add(respSize(resp))
+}
+
+func (c *conn) unqueueOutput(resp redis.Resp) {
+    c.obufQueued.Sub(respSize(resp))
+}
+
+// respSize estimates the encoded size of resp
+func respSize(resp redis.Resp) int64 {
+    switch r := resp.(type) {
+    case *redis.String:
+        return int64(len(r.Value)) + 3
+    case *redis.Error:
+        return int64(len(r.Value)) + 3
+    case *redis.BulkBytes:
+        return int64(len(r.Value)) + 16
+    case *redis.Array:
+        return respArraySize(r.Value)
+    case *respPush:
+        return respArraySize(r.Value)
+    case *respMap:
+        return respArraySize(r.Value)
+    case *respSet:
+        return respArraySize(r.Value)
+    case *respVerbatim:
+        return int64(len(r.Value)) + 20
+    default:
+        return 16
+    }
+}
+
+func respArraySize(values []redis.Resp) int64 {
+    n := int64(16)
+    for _, v := range values {
+        n += respSize(v)
+    }
+    return n
+}
+
+// checkOutputLimit is called with n more bytes of output, on top of what is pending
+func (c *conn) checkOutputLimit(n int64) error {
+    limit := c.outputBufferLimit()
+    size := c.outputBufferSize() + n
+    if limit.Hard > 0 && size > limit.Hard {
+        return errOutputBufferLimit
+    }
+    if limit.Soft > 0 && size > limit.Soft {
+        now := time.Now().UnixNano()
+        since := c.obufSoftSince.Get()
+        if since == 0 {
+            c.obufSoftSince.CompareAndSwap(0, now)
+        } else if time.Duration(now - since) > time.Duration(limit.SoftSeconds) * time.Second {
+            return errOutputBufferLimit
+        }
+    } else {
+        c.obufSoftSince.Set(0)
+    }
+    return nil
+}
+
+// writeTimeout is how long a write may block, so a slow peer can't hold wLock forever
+func (c *conn) writeTimeout() time.Duration {
+    limit := c.outputBufferLimit()
+    if limit.Soft > 0 && limit.SoftSeconds > 0 {
+        return time.Duration(limit.SoftSeconds) * time.Second
+    }
+    return defaultWriteTimeout
 }
 
 func newConn(nc net.Conn, s *Server, timeout int) *conn {
@@ -33,10 +218,14 @@ func newConn(nc net.Conn, s *Server, timeout int) *conn {
         nc: nc,
         s: s,
         r: bufio.NewReader(nc),
-        w: bufio.NewWriter(nc),
         summ: fmt.Sprintf("<local> %s -- %s <remote>", nc.LocalAddr(), nc.RemoteAddr()),
         timeout: time.Duration(timeout) * time.Second,
+        id: s.nextConnId.Incr(),
+        createTime: time.Now(),
     }
+    c.w = bufio.NewWriterSize(&connWriter{c}, replyBufferSize)
+    c.proto.Set(resp2)
+    c.lastTime.Set(c.createTime.UnixNano())
     return c
 }
 
@@ -58,40 +247,59 @@ func (c *conn) serve() error {
     for {
         response, err := c.handleRequest()
         if err != nil {
+            if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                c.s.counters.idleTimeouts.Incr()
+                c.Close()
+            } else {
+                // replies of requests before a bad one
+                c.flushReplies()
+            }
             return err
-        } else if response == nil {
-            continue
         }
 
-        if c.timeout > 0 {
-            deadline := time.Now().Add(c.timeout)
-            if err := c.nc.SetWriteDeadline(deadline); err != nil {
+        if response != nil {
+            if err = c.reply(response); err != nil {
                 return err
             }
         }
-        if err = c.writeRESP(response); err != nil {
+        if c.closeAfterReply {
+            // let the subscriber writer drain queued output first
+            if c.sub != nil {
+                c.s.stopCDC(c)
+                c.s.removeSubscriber(c)
+                <-c.sub.done
+            }
+            err = c.flushReplies()
+            c.Close()
             return err
         }
+        // keep reading pipelined requests, reply once they are drained
+        if c.r.Buffered() == 0 || c.w.Buffered() >= replyFlushSize {
+            if err = c.flushReplies(); err != nil {
+                return err
+            }
+        }
     }
     return nil
 }
 
 func (c *conn) handleRequest() (redis.Resp, error) {
-    if c.timeout > 0 {
+    // slaves send nothing after BSYNC, don't time them out
+    if c.timeout > 0 && !c.s.isSlave(c) {
         deadline := time.Now().Add(c.timeout)
         if err := c.nc.SetReadDeadline(deadline); err != nil {
             return nil, err
         }
     }
-    request, err := redis.DecodeRequest(c.r)
+    request, err := c.readRequest()
     if err != nil {
+        if isProtocolError(err) {
+            c.closeAfterReply = true
+            return redis.NewError(err), nil
+        }
         return nil, err
     }
 
-    if request.Type() == redis.TypePing {
-        return nil, nil
-    }
-
     response, err := c.dispatch(request)
     if err != nil {
         return response, nil
@@ -107,26 +315,129 @@ func (c *conn) dispatch(request redis.Resp) (redis.Resp, error) {
     }
     s := c.s
 
-    if f := c.s.htable[cmd]; f == nil {
-        log.Printf("unknown command: %s", cmd)
+    f := s.htable[cmd]
+    if f == nil {
+        c.s.logger.Printf("unknown command: %s", cmd)
+        c.abortMulti()
         return toRespErrorf("unknown command: %s", cmd)
-    } else {
-        masterAddr := s.repl.masterAddr.Get()
-        if len(masterAddr) > 0 && f.flag&CmdWrite > 0 {
-            return toRespErrorf("READONLY You can't write against a read only slave.")
+    }
+
+    if c.subscriptions() > 0 && c.proto.Get() < resp3 && !allowedInSubscribe(cmd) {
+        c.abortMulti()
+        return toRespErrorf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", cmd)
+    }
+
+    s.counters.commands.Incr()
+    c.lastCmd.Set(cmd)
+    c.lastTime.Set(time.Now().UnixNano())
+    if !f.checkArity(args) {
+        s.counters.commandsFailed.Incr()
+        c.abortMulti()
+        return toRespErrorf("wrong number of arguments for '%s' command", f.name)
+    }
+    if err := s.aclCheck(c, f, args); err != nil {
+        s.counters.commandsFailed.Incr()
+        c.abortMulti()
+        return toRespError(err)
+    }
+    // slots commands move stored keys, those of other dbs included
+    if f.flag&CmdSlots == 0 {
+        for _, key := range f.keys(args) {
+            if reservedKey(key) {
+                s.counters.commandsFailed.Incr()
+                c.abortMulti()
+                return toRespErrorf("keys starting with '{\\xffdb' are reserved")
+            }
         }
+    }
 
-        return f.f(c, args)
+    masterAddr := s.repl.masterAddr.Get()
+    if len(masterAddr) > 0 && f.flag&CmdWrite > 0 {
+        s.counters.commandsFailed.Incr()
+        c.abortMulti()
+        return toRespErrorf("READONLY You can't write against a read only slave.")
     }
+
+    if c.multi && f.queueable() {
+        return c.queueCommand(f, args)
+    }
+
+    s.waitPause(f)
+    // writes go through group commits which take dataLock themselves
+    if f.flag&CmdWrite == 0 && f.firstKey > 0 {
+        s.dataLock.RLock()
+        defer s.dataLock.RUnlock()
+    }
+    return c.call(f, args)
+}
+
+// call runs f and accounts for it in stats, slowlog and monitors
+func (c *conn) call(f *command, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    s.feedMonitorsFromConn(c, f, args)
+    if f.flag&CmdReadOnly != 0 {
+        s.trackReads(c, f, args)
+    }
+
+    start := time.Now()
+    resp, err := f.f(c, args)
+    d := time.Since(start)
+    if err != nil {
+        s.counters.commandsFailed.Incr()
+    }
+    s.commandStatAdd(f.name, d, err != nil)
+    s.slowlogPush(c, f.name, args, d)
+    s.latencyAdd(latencyCommand, d)
+    return resp, err
 }
 
 func (c *conn) writeRESP(resp redis.Resp) error {
     c.wLock.Lock()
     defer c.wLock.Unlock()
 
-    if err := redis.Encode(c.w, resp); err != nil {
+    if err := encodeResp(c.w, resp, int(c.proto.Get())); err != nil {
         return err
     }
+    c.bufferedOutput()
+    return c.flushLocked()
+}
+
+// bufferRESP queues the reply of a request, see flushReplies
+func (c *conn) bufferRESP(resp redis.Resp) error {
+    c.wLock.Lock()
+    defer c.wLock.Unlock()
+
+    if err := encodeResp(c.w, resp, int(c.proto.Get())); err != nil {
+        return err
+    }
+    c.bufferedOutput()
+    c.pendingReplies++
+    return nil
+}
+
+func (c *conn) flushReplies() error {
+    c.wLock.Lock()
+    defer c.wLock.Unlock()
+    return c.flushLocked()
+}
+
+// flushLocked writes buffered output, counting the replies flushed at once as pipeline depth
+func (c *conn) flushLocked() error {
+    if n := c.pendingReplies; n > 0 {
+        c.pendingReplies = 0
+        s := c.s
+        s.counters.replyFlushes.Incr()
+        s.counters.pipelinedReplies.Add(n)
+        for {
+            max := s.counters.maxPipelineDepth.Get()
+            if n <= max || s.counters.maxPipelineDepth.CompareAndSwap(max, n) {
+                break
+            }
+        }
+    }
+    if c.w.Buffered() == 0 {
+        return nil
+    }
     return c.w.Flush()
 }
 
@@ -142,6 +453,23 @@ func (c *conn) ping() error {
     return nil
 }
 
+// auth against the remote side, user may be empty for the default user
+func (c *conn) auth(user string, pass string) error {
+    req := redis.NewRequest("AUTH", pass)
+    if user != "" {
+        req = redis.NewRequest("AUTH", user, pass)
+    }
+    if err := c.writeRESP(req); err != nil {
+        return err
+    }
+    if rsp, err := c.readLine(); err != nil {
+        return err
+    } else if string(rsp) != "+OK" {
+        return fmt.Errorf("auth failed: %s", rsp)
+    }
+    return nil
+}
+
 func (c *conn) readLine() (line []byte, err error) {
     // if we read too many \n only, maybe something is wrong.
     for i := 0; i < 100; i++ {
@@ -0,0 +1,57 @@
+package bitserver
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testConnSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testConnSuite{})
+
+func (s *testConnSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17950
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testConnSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testConnSuite) TestPipeline(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    for i := 0; i < 100; i++ {
+        c.Assert(nc.Send("set", fmt.Sprintf("p%d", i), i), IsNil)
+        c.Assert(nc.Send("get", fmt.Sprintf("p%d", i)), IsNil)
+    }
+    c.Assert(nc.Flush(), IsNil)
+    for i := 0; i < 100; i++ {
+        resp, err := nc.Receive()
+        c.Assert(err, IsNil)
+        c.Assert(resp, DeepEquals, redis.NewString("OK"))
+        resp, err = nc.Receive()
+        c.Assert(err, IsNil)
+        c.Assert(resp, DeepEquals, redis.NewBulkBytesWithString(strconv.Itoa(i)))
+    }
+
+    resp := nc.doCmd(c, "info", "stats")
+    info, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    m := regexp.MustCompile(`pipeline_depth_max:(\d+)`).FindSubmatch(info.Value)
+    c.Assert(m, NotNil)
+    depth, err := strconv.Atoi(string(m[1]))
+    c.Assert(err, IsNil)
+    c.Assert(depth > 1, Equals, true)
+}
@@ -0,0 +1,346 @@
+package bitserver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// Keys of databases other than 0 are stored under a hash tag naming their db,
+// so AllKeysWithTag lists them on any engine. Keys of db 0 are stored as given:
+// codis only uses db 0, its slots and migrations see keys unchanged. The db tag
+// replaces tags of the keys, so slots are only meaningful in db 0.
+const dbTagPrefix = "\xffdb"
+
+var errNoKeyIterator = errors.New("the storage can't list keys of db 0")
+
+// keyIterator is implemented by storages able to list all their keys, bitcask
+// scanning its data-files
+type keyIterator interface {
+    // ForEachKey calls f for every key until it returns false
+    ForEachKey(f func(key []byte) bool) error
+}
+
+func dbTag(db int) []byte {
+    return []byte(dbTagPrefix + strconv.Itoa(db))
+}
+
+// encodeDbKey returns the key stored for key of db
+func encodeDbKey(db int, key []byte) []byte {
+    if db == 0 {
+        return key
+    }
+    tag := dbTag(db)
+    k := make([]byte, 0, len(tag) + 2 + len(key))
+    k = append(k, '{')
+    k = append(k, tag...)
+    k = append(k, '}')
+    return append(k, key...)
+}
+
+// decodeDbKey returns the db of a stored key and the key as seen by clients
+func decodeDbKey(k []byte) (int, []byte) {
+    prefix := "{" + dbTagPrefix
+    if !bytes.HasPrefix(k, []byte(prefix)) {
+        return 0, k
+    }
+    end := bytes.IndexByte(k, '}')
+    if end < 0 {
+        return 0, k
+    }
+    db, err := strconv.Atoi(string(k[len(prefix):end]))
+    if err != nil || db <= 0 {
+        return 0, k
+    }
+    return db, k[end + 1:]
+}
+
+// reservedKey tells if a client key starts as keys of other dbs are stored,
+// in db 0 it would be read back as a key of another db
+func reservedKey(key []byte) bool {
+    return bytes.HasPrefix(key, []byte("{" + dbTagPrefix))
+}
+
+// dbKey returns the stored key of key in the db selected by c
+func (c *conn) dbKey(key []byte) []byte {
+    return encodeDbKey(int(c.db.Get()), key)
+}
+
+func (s *Server) databases() int {
+    if s.config.Databases <= 0 {
+        return 1
+    }
+    return s.config.Databases
+}
+
+// parseDbIndex parses a db index given to SELECT, SWAPDB and MOVE
+func (s *Server) parseDbIndex(arg []byte) (int, error) {
+    db, err := strconv.Atoi(string(arg))
+    if err != nil {
+        return 0, errors.New("invalid DB index")
+    }
+    if db < 0 || db >= s.databases() {
+        return 0, errors.New("DB index is out of range")
+    }
+    return db, nil
+}
+
+// dbKeys returns stored keys of db
+func (s *Server) dbKeys(db int) ([][]byte, error) {
+    s.dataLock.RLock()
+    defer s.dataLock.RUnlock()
+    if db != 0 {
+        return s.bc.AllKeysWithTag(dbTag(db))
+    }
+    it, ok := interface{}(s.bc).(keyIterator)
+    if !ok {
+        return nil, errNoKeyIterator
+    }
+    var keys [][]byte
+    err := it.ForEachKey(func(key []byte) bool {
+        if n, _ := decodeDbKey(key); n == 0 {
+            keys = append(keys, append([]byte{}, key...))
+        }
+        return true
+    })
+    return keys, err
+}
+
+// dbSize returns the number of keys of db, or -1 if the storage can't tell
+func (s *Server) dbSize(db int) int64 {
+    keys, err := s.dbKeys(db)
+    if err != nil {
+        return -1
+    }
+    return int64(len(keys))
+}
+
+// txDbKeys returns keys of db, with those written by the transaction c is EXECing
+func (s *Server) txDbKeys(c *conn, db int) ([][]byte, error) {
+    keys, err := s.dbKeys(db)
+    if err != nil || c == nil || c.txBatch == nil {
+        return keys, err
+    }
+    listed := make(map[string]bool)
+    for _, key := range keys {
+        listed[string(key)] = true
+    }
+    for _, op := range c.txBatch.ops {
+        if n, _ := decodeDbKey(op.key); n == db && !op.clear && !op.del && !listed[string(op.key)] {
+            listed[string(op.key)] = true
+            keys = append(keys, op.key)
+        }
+    }
+    return keys, nil
+}
+
+// rewriteDbs commits the batch build makes out of keys it reads, holding commitMu
+// so no write commits in between. Inside EXEC, which holds it, the batch joins the
+// transaction.
+func (s *Server) rewriteDbs(c *conn, build func(b *writeBatch) error) error {
+    b := &writeBatch{}
+    if c != nil && c.txBatch != nil {
+        if err := build(b); err != nil {
+            return err
+        }
+        return s.commit(c, b)
+    }
+    s.commitMu.Lock()
+    defer s.commitMu.Unlock()
+    if err := build(b); err != nil {
+        return err
+    }
+    if b.Len() == 0 {
+        return nil
+    }
+    return s.applyBatchesLocked(b)
+}
+
+// flushDB deletes keys of db. Without keyIterator db 0 is flushed by clearing
+// all keys and writing back those of the other dbs, in one batch.
+func (s *Server) flushDB(c *conn, db int) error {
+    return s.rewriteDbs(c, func(b *writeBatch) error {
+        keys, err := s.txDbKeys(c, db)
+        switch {
+        case err == nil:
+            for _, key := range keys {
+                b.Delete(key)
+            }
+        case err == errNoKeyIterator:
+            b.Clear()
+            for other := 1; other < s.databases(); other++ {
+                if err := s.copyDbKeys(c, b, other, other); err != nil {
+                    return err
+                }
+            }
+        default:
+            return err
+        }
+        return nil
+    })
+}
+
+// copyDbKeys adds puts of keys of db src into db dst to b
+func (s *Server) copyDbKeys(c *conn, b *writeBatch, src int, dst int) error {
+    keys, err := s.txDbKeys(c, src)
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        value, expireAt, err := s.getWithExpr(c, key)
+        if err == ErrKeyNotFound {
+            continue
+        } else if err != nil {
+            return err
+        }
+        _, k := decodeDbKey(key)
+        b.PutWithExpr(encodeDbKey(dst, k), value, expireAt)
+    }
+    return nil
+}
+
+// SELECT index
+func SelectCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    db, err := c.s.parseDbIndex(args[0])
+    if err != nil {
+        return toRespError(err)
+    }
+    if c.s.config.CodisMode && db != 0 {
+        return toRespErrorf("SELECT is not allowed in cluster mode")
+    }
+    c.db.Set(int64(db))
+    return redis.NewString("OK"), nil
+}
+
+// SWAPDB index1 index2
+func SwapDBCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    if s.config.CodisMode {
+        return toRespErrorf("SWAPDB is not allowed in cluster mode")
+    }
+    db1, err := s.parseDbIndex(args[0])
+    if err != nil {
+        return toRespError(err)
+    }
+    db2, err := s.parseDbIndex(args[1])
+    if err != nil {
+        return toRespError(err)
+    }
+    if db1 == db2 {
+        return redis.NewString("OK"), nil
+    }
+
+    // keys are moved, deletes go first as both dbs may have the same key
+    err = s.rewriteDbs(c, func(b *writeBatch) error {
+        keys1, err := s.txDbKeys(c, db1)
+        if err != nil {
+            return err
+        }
+        keys2, err := s.txDbKeys(c, db2)
+        if err != nil {
+            return err
+        }
+        for _, key := range append(keys1, keys2...) {
+            b.Delete(key)
+        }
+        if err := s.copyDbKeys(c, b, db1, db2); err != nil {
+            return err
+        }
+        return s.copyDbKeys(c, b, db2, db1)
+    })
+    if err != nil {
+        return toRespError(err)
+    }
+    return redis.NewString("OK"), nil
+}
+
+// MOVE key db
+func MoveCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    if s.config.CodisMode {
+        return toRespErrorf("MOVE is not allowed in cluster mode")
+    }
+    db, err := s.parseDbIndex(args[1])
+    if err != nil {
+        return toRespError(err)
+    }
+    if db == int(c.db.Get()) {
+        return toRespErrorf("source and destination objects are the same")
+    }
+
+    src := c.dbKey(args[0])
+    dst := encodeDbKey(db, args[0])
+    value, expireAt, err := s.getWithExpr(c, src)
+    if err == ErrKeyNotFound {
+        return redis.NewInt(0), nil
+    } else if err != nil {
+        return toRespError(err)
+    }
+    if _, err := s.get(c, dst); err == nil {
+        return redis.NewInt(0), nil
+    } else if err != ErrKeyNotFound {
+        return toRespError(err)
+    }
+
+    b := &writeBatch{}
+    b.Delete(src)
+    b.PutWithExpr(dst, value, expireAt)
+    b.notify(notifyGeneric, "move_from", src)
+    b.notify(notifyGeneric, "move_to", dst)
+    if err := s.commit(c, b); err != nil {
+        return toRespError(err)
+    }
+    return redis.NewInt(1), nil
+}
+
+// FLUSHDB [ASYNC|SYNC]
+func FlushDBCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if len(args) > 1 {
+        return toRespErrorf("wrong number of arguments for 'flushdb' command")
+    }
+    if len(args) == 1 {
+        switch strings.ToLower(string(args[0])) {
+        case "async", "sync":
+        default:
+            return toRespErrorf("syntax error")
+        }
+    }
+    if err := c.s.flushDB(c, int(c.db.Get())); err != nil {
+        return toRespError(err)
+    }
+    return redis.NewString("OK"), nil
+}
+
+// DBSIZE
+func DBSizeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    n := c.s.dbSize(int(c.db.Get()))
+    if n < 0 {
+        return toRespError(errNoKeyIterator)
+    }
+    return redis.NewInt(n), nil
+}
+
+func infoKeyspace(s *Server, w *bytes.Buffer) {
+    for db := 0; db < s.databases(); db++ {
+        // db 0 is left out if the storage can't count it
+        if n := s.dbSize(db); n > 0 {
+            fmt.Fprintf(w, "db%d:keys=%d\r\n", db, n)
+        }
+    }
+}
+
+func init() {
+    register(&command{name: "select", f: SelectCmd, flag: CmdFast|CmdLoading|CmdStale, arity: 2,
+        group: "connection", summary: "Change the selected database for the current connection"})
+    register(&command{name: "swapdb", f: SwapDBCmd, flag: CmdWrite, arity: 3,
+        group: "server", summary: "Swaps two databases"})
+    register(&command{name: "move", f: MoveCmd, flag: CmdWrite, arity: 3, firstKey: 1, lastKey: 1, keyStep: 1,
+        group: "generic", summary: "Move a key to another database"})
+    register(&command{name: "flushdb", f: FlushDBCmd, flag: CmdWrite, arity: -1,
+        group: "server", summary: "Remove all keys from the current database"})
+    register(&command{name: "dbsize", f: DBSizeCmd, flag: CmdReadOnly|CmdFast, arity: 1,
+        group: "server", summary: "Return the number of keys in the selected database"})
+}
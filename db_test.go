@@ -0,0 +1,166 @@
+package bitserver
+
+import (
+    "bytes"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testDBSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testDBSuite{})
+
+func (s *testDBSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17980
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testDBSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testDBSuite) TestEncodeKey(c *C) {
+    c.Assert(encodeDbKey(0, []byte("a")), DeepEquals, []byte("a"))
+    for _, key := range []string{"a", "{tag}b", ""} {
+        db, k := decodeDbKey(encodeDbKey(3, []byte(key)))
+        c.Assert(db, Equals, 3)
+        c.Assert(string(k), Equals, key)
+    }
+    tag, _ := HashKeyToSlot(encodeDbKey(3, []byte("{tag}b")))
+    c.Assert(tag, DeepEquals, dbTag(3))
+}
+
+func (s *testDBSuite) TestSelect(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "flushall")
+    nc.checkOK(c, "set", "k", "0")
+    nc.checkOK(c, "select", 1)
+    c.Assert(nc.doCmd(c, "get", "k"), DeepEquals, redis.NewBulkBytes(nil))
+    nc.checkOK(c, "set", "k", "1")
+    nc.checkString(c, "1", "get", "k")
+    nc.checkOK(c, "select", 0)
+    nc.checkString(c, "0", "get", "k")
+
+    resp := nc.doCmd(c, "client", "info")
+    c.Assert(resp, FitsTypeOf, (*redis.BulkBytes)(nil))
+    c.Assert(bytes.Contains(resp.(*redis.BulkBytes).Value, []byte(" db=0 ")), Equals, true)
+}
+
+func (s *testDBSuite) TestMove(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "flushall")
+    nc.checkOK(c, "set", "m", "v")
+    nc.checkInt(c, 1, "move", "m", 2)
+    nc.checkInt(c, 0, "move", "m", 2)
+    nc.checkError(c, "source and destination objects are the same", "move", "m", 0)
+    nc.checkOK(c, "select", 2)
+    nc.checkString(c, "v", "get", "m")
+
+    // the key already exists in the target db
+    nc.checkOK(c, "select", 0)
+    nc.checkOK(c, "set", "m", "w")
+    nc.checkInt(c, 0, "move", "m", 2)
+    nc.checkString(c, "w", "get", "m")
+}
+
+func (s *testDBSuite) TestReservedKey(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "flushall")
+    nc.checkOK(c, "select", 1)
+    nc.checkOK(c, "set", "k", "1")
+    nc.checkOK(c, "select", 0)
+    nc.checkError(c, "reserved", "set", "{\xffdb1}k", "0")
+    nc.checkError(c, "reserved", "mget", "a", "{\xffdb1}k")
+    nc.checkOK(c, "select", 1)
+    nc.checkString(c, "1", "get", "k")
+}
+
+func (s *testDBSuite) TestSwapAndFlush(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "flushall")
+    nc.checkOK(c, "set", "a", "0")
+    nc.checkOK(c, "set", "both", "0")
+    nc.checkOK(c, "select", 5)
+    nc.checkOK(c, "set", "b", "5")
+    nc.checkOK(c, "set", "both", "5")
+    nc.checkInt(c, 2, "dbsize")
+
+    nc.checkOK(c, "swapdb", 0, 5)
+    nc.checkString(c, "0", "get", "a")
+    nc.checkString(c, "0", "get", "both")
+    c.Assert(nc.doCmd(c, "get", "b"), DeepEquals, redis.NewBulkBytes(nil))
+
+    resp := nc.doCmd(c, "info", "keyspace")
+    c.Assert(resp, FitsTypeOf, (*redis.BulkBytes)(nil))
+    c.Assert(string(resp.(*redis.BulkBytes).Value), Matches, "(?s).*db0:keys=2\r\ndb5:keys=2\r\n.*")
+
+    nc.checkOK(c, "flushdb")
+    nc.checkInt(c, 0, "dbsize")
+    nc.checkOK(c, "select", 0)
+    nc.checkString(c, "5", "get", "b")
+    nc.checkOK(c, "flushdb")
+    nc.checkInt(c, 0, "dbsize")
+}
+
+func (s *testDBSuite) TestInMulti(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    // FLUSHDB and SWAPDB see writes queued before them
+    nc.checkOK(c, "flushall")
+    nc.checkOK(c, "set", "t0", "0")
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "t1", "1")
+    nc.checkString(c, "QUEUED", "swapdb", 0, 3)
+    nc.checkString(c, "QUEUED", "flushdb")
+    nc.doCmd(c, "exec")
+    nc.checkInt(c, 0, "dbsize")
+    nc.checkOK(c, "select", 3)
+    nc.checkString(c, "0", "get", "t0")
+    nc.checkString(c, "1", "get", "t1")
+    nc.checkInt(c, 2, "dbsize")
+    nc.checkOK(c, "select", 0)
+}
+
+func (s *testDBSuite) TestCodisMode(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17981
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    config.CodisMode = true
+    svr := testCreateServerWithConfig(c, config)
+    defer svr.Close()
+
+    nc := testGetConn(c, svr.port)
+    defer nc.Close()
+    nc.checkOK(c, "select", 0)
+    nc.checkError(c, "SELECT is not allowed in cluster mode", "select", 1)
+    nc.checkError(c, "SWAPDB is not allowed in cluster mode", "swapdb", 0, 1)
+    nc.checkError(c, "MOVE is not allowed in cluster mode", "move", "k", 1)
+}
+
+// testDBBitcaskSuite runs the tests of testDBSuite on bitcask, which lists db 0 from its data-files
+type testDBBitcaskSuite struct {
+    testDBSuite
+}
+
+var _ = Suite(&testDBBitcaskSuite{})
+
+func (s *testDBBitcaskSuite) SetUpSuite(c *C) {
+    s.s = testCreateServer(c, 18030, c.MkDir())
+}
@@ -0,0 +1,163 @@
+package bitserver
+
+import (
+    "sync"
+    "time"
+)
+
+// Keys with a ttl keep their expireAt, in unix seconds, in the storage. Reads
+// hide them once it passed, and the expirer deletes them and tells "expired"
+// events: keys with a ttl are tracked in memory, found by a scan of the storage
+// on start and kept up to date by commits, under commitMu. Slaves leave
+// expiring to their master, whose deletes they sync.
+
+// how often the expirer looks for keys whose ttl passed
+const expireCycleInterval = time.Second
+
+// expired keys deleted per commit of the expirer
+const expireMaxBatch = 1000
+
+type expireState struct {
+    sync.Mutex
+    // stored keys with a ttl and their expireAt
+    keys    map[string]uint32
+    // wakes the expirer up once a read found an expired key
+    wake    chan struct{}
+}
+
+// expired tells if a key with expireAt is expired at now
+func expired(expireAt uint32, now time.Time) bool {
+    return expireAt != 0 && int64(expireAt) <= now.Unix()
+}
+
+func (s *Server) initExpire() {
+    s.expire.keys = make(map[string]uint32)
+    s.expire.wake = make(chan struct{}, 1)
+    s.goFunc(s.scanExpires)
+    s.goFunc(func() {
+        ticker := time.NewTicker(expireCycleInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.signal:
+                return
+            case <-ticker.C:
+            case <-s.expire.wake:
+            }
+            if err := s.expireKeys(); err != nil {
+                s.logger.Printf("delete expired keys failed, err = %s", err)
+            }
+        }
+    })
+}
+
+// scanExpires tracks the keys with a ttl found in the storage on start, those
+// written since are tracked by their commits
+func (s *Server) scanExpires() {
+    it, ok := interface{}(s.bc).(keyIterator)
+    // storages without data-files start empty
+    if !ok || s.bc.GetDataFilePath(s.bc.ActiveFileId()) == "" {
+        return
+    }
+    var keys [][]byte
+    err := it.ForEachKey(func(key []byte) bool {
+        if _, expireAt, err := s.bc.GetWithExpr(key); err == nil && expireAt != 0 {
+            keys = append(keys, append([]byte(nil), key...))
+        }
+        select {
+        case <-s.signal:
+            return false
+        default:
+            return true
+        }
+    })
+    if err != nil {
+        s.logger.Printf("keys with a ttl found so far are tracked, the others once read, err = %s", err)
+    }
+    for _, key := range keys {
+        // read again under commitMu, a commit may have changed it since
+        s.commitMu.Lock()
+        if _, expireAt, err := s.bc.GetWithExpr(key); err == nil {
+            s.trackExpire(key, expireAt)
+        }
+        s.commitMu.Unlock()
+    }
+}
+
+// trackExpire records the expireAt of a stored key, 0 untracks it. Commits call
+// it under commitMu, reads finding an expired key without it: the expirer reads
+// keys again before deleting them.
+func (s *Server) trackExpire(key []byte, expireAt uint32) {
+    s.expire.Lock()
+    defer s.expire.Unlock()
+    if expireAt == 0 {
+        delete(s.expire.keys, string(key))
+    } else {
+        s.expire.keys[string(key)] = expireAt
+    }
+}
+
+// untrackAllExpires forgets all keys once the storage was cleared
+func (s *Server) untrackAllExpires() {
+    s.expire.Lock()
+    defer s.expire.Unlock()
+    s.expire.keys = make(map[string]uint32)
+}
+
+// wakeExpirer asks for expired keys to be deleted soon
+func (s *Server) wakeExpirer() {
+    select {
+    case s.expire.wake <- struct{}{}:
+    default:
+    }
+}
+
+// expireKeys deletes tracked keys whose ttl passed, telling "expired" events
+func (s *Server) expireKeys() error {
+    if len(s.repl.masterAddr.Get()) > 0 {
+        return nil
+    }
+
+    s.commitMu.Lock()
+    defer s.commitMu.Unlock()
+
+    now := time.Now()
+    var due [][]byte
+    s.expire.Lock()
+    for key, expireAt := range s.expire.keys {
+        if len(due) == expireMaxBatch {
+            // the rest at the next cycle
+            s.wakeExpirer()
+            break
+        }
+        if expired(expireAt, now) {
+            due = append(due, []byte(key))
+        }
+    }
+    s.expire.Unlock()
+
+    b := &writeBatch{}
+    for _, key := range due {
+        _, expireAt, err := s.bc.GetWithExpr(key)
+        switch {
+        case err == ErrKeyNotFound:
+            // gone without a commit telling it, e.g. cleared on the master
+            s.trackExpire(key, 0)
+        case err != nil:
+            return err
+        case expired(expireAt, now):
+            b.Delete(key)
+            b.notify(notifyExpired, "expired", key)
+        default:
+            s.trackExpire(key, expireAt)
+        }
+    }
+    if b.Len() == 0 {
+        return nil
+    }
+    if err := s.applyBatchesLocked(b); err != nil {
+        return err
+    }
+    s.counters.expiredKeys.Add(int64(b.Len()))
+    return nil
+}
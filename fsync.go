@@ -0,0 +1,138 @@
+package bitserver
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+    "github.com/reborndb/go/atomic2"
+)
+
+// appendfsync policies
+const (
+    // fsync before replying to writes
+    FsyncAlways = "always"
+    // fsync in background once per second
+    FsyncEverySec = "everysec"
+    // leave it to the os
+    FsyncNo = "no"
+)
+
+func checkFsyncPolicy(policy string) error {
+    switch policy {
+    case FsyncAlways, FsyncEverySec, FsyncNo:
+        return nil
+    }
+    return fmt.Errorf("invalid appendfsync policy '%s'", policy)
+}
+
+// fsyncer is implemented by storages syncing themselves, the data-files of the
+// others are fsynced by path
+type fsyncer interface {
+    Sync() error
+}
+
+type fsyncState struct {
+    // serializes fsyncs
+    sync.Mutex
+    policy      atomic2.String
+    // oldest data-file that may have unsynced writes
+    fileId      int64
+    // bytes written since the last fsync
+    pending     atomic2.Int64
+    lastTime    atomic2.Int64
+    lastUsec    atomic2.Int64
+    count       atomic2.Int64
+    errors      atomic2.Int64
+}
+
+func (s *Server) initFsync() error {
+    policy := s.config.AppendFsync
+    if policy == "" {
+        policy = FsyncEverySec
+    }
+    if err := checkFsyncPolicy(policy); err != nil {
+        return err
+    }
+    s.fsync.policy.Set(policy)
+    s.fsync.fileId = s.bc.ActiveFileId()
+
+    s.goFunc(func() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.signal:
+                return
+            case <-ticker.C:
+                if s.fsync.policy.Get() != FsyncEverySec || s.fsync.pending.Get() == 0 {
+                    continue
+                }
+                if err := s.syncData(); err != nil {
+                    s.logger.Printf("background fsync failed, err = %s", err)
+                }
+            }
+        }
+    })
+    return nil
+}
+
+// afterWrite is called once n bytes of writes were applied,
+// in always mode it returns after they are durable
+func (s *Server) afterWrite(n int64) error {
+    s.fsync.pending.Add(n)
+    s.cdcWake()
+    if s.fsync.policy.Get() == FsyncAlways {
+        return s.syncData()
+    }
+    return nil
+}
+
+// syncData fsyncs data-files written since the last fsync
+func (s *Server) syncData() error {
+    s.fsync.Lock()
+    defer s.fsync.Unlock()
+
+    pending := s.fsync.pending.Get()
+    start := time.Now()
+    activeFileId := s.bc.ActiveFileId()
+
+    var err error
+    if f, ok := interface{}(s.bc).(fsyncer); ok {
+        err = f.Sync()
+    } else {
+        for fileId := s.fsync.fileId; ; {
+            if e := syncFile(s.bc.GetDataFilePath(fileId)); e != nil && !os.IsNotExist(e) {
+                err = e
+            }
+            next := s.bc.NextDataFileId(fileId)
+            if fileId >= activeFileId || next <= fileId {
+                break
+            }
+            fileId = next
+        }
+    }
+
+    d := time.Since(start)
+    s.latencyAdd(latencyFsync, d)
+    if err != nil {
+        s.fsync.errors.Incr()
+        return err
+    }
+    s.fsync.fileId = activeFileId
+    s.fsync.pending.Sub(pending)
+    s.fsync.count.Incr()
+    s.fsync.lastTime.Set(time.Now().Unix())
+    s.fsync.lastUsec.Set(int64(d / time.Microsecond))
+    return nil
+}
+
+// syncFile fsyncs the file at path, which flushes writes through other fds as well
+func syncFile(path string) error {
+    f, err := os.OpenFile(path, os.O_RDONLY, 0)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return f.Sync()
+}
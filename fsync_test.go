@@ -0,0 +1,59 @@
+package bitserver
+
+import (
+    "strings"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testFsyncSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testFsyncSuite{})
+
+func (s *testFsyncSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17900
+    config.Dbpath = c.MkDir()
+    config.AppendFsync = FsyncAlways
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testFsyncSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testFsyncSuite) persistence(c *C, nc *testConn) string {
+    resp := nc.doCmd(c, "info", "persistence")
+    info, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    return string(info.Value)
+}
+
+func (s *testFsyncSuite) TestAlways(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "set", "durable", "1")
+    info := s.persistence(c, nc)
+    c.Assert(strings.Contains(info, "appendfsync:always\r\n"), Equals, true)
+    c.Assert(strings.Contains(info, "fsync_pending_bytes:0\r\n"), Equals, true)
+    c.Assert(strings.Contains(info, "fsync_total:0\r\n"), Equals, false)
+}
+
+func (s *testFsyncSuite) TestConfig(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "config", "set", "appendfsync", "no")
+    resp := nc.doCmd(c, "config", "get", "append*")
+    v := resp.(*redis.Array)
+    c.Assert(v.Value, HasLen, 2)
+    c.Assert(string(v.Value[1].(*redis.BulkBytes).Value), Equals, "no")
+    nc.checkError(c, "invalid appendfsync policy.*", "config", "set", "appendfsync", "sometimes")
+    nc.checkError(c, "Unsupported CONFIG parameter: dir", "config", "set", "dir", "/tmp")
+    nc.checkOK(c, "config", "set", "appendfsync", "always")
+}
@@ -0,0 +1,154 @@
+package bitserver
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "sort"
+    "time"
+)
+
+// sections of INFO, in output order
+var infoSections = []struct {
+    name    string
+    f       func(s *Server, w *bytes.Buffer)
+}{
+    {"server", infoServer},
+    {"clients", infoClients},
+    {"replication", infoReplication},
+    {"persistence", infoPersistence},
+    {"merge", infoMerge},
+    {"stats", infoStats},
+    {"listeners", infoListeners},
+    {"commandstats", infoCommandStats},
+    {"keyspace", infoKeyspace},
+}
+
+// info returns INFO output of section, "all" or "default" for every section
+func (s *Server) info(section string) []byte {
+    var buf bytes.Buffer
+    for _, sec := range infoSections {
+        if section != "all" && section != "default" && section != sec.name {
+            continue
+        }
+        if buf.Len() != 0 {
+            buf.WriteString("\r\n")
+        }
+        fmt.Fprintf(&buf, "# %s%s\r\n", bytes.ToUpper([]byte(sec.name[:1])), sec.name[1:])
+        sec.f(s, &buf)
+    }
+    return buf.Bytes()
+}
+
+func infoServer(s *Server, w *bytes.Buffer) {
+    fmt.Fprintf(w, "bitserver_version:%s\r\n", Version)
+    fmt.Fprintf(w, "run_id:%s\r\n", s.runID)
+    fmt.Fprintf(w, "process_id:%d\r\n", os.Getpid())
+    fmt.Fprintf(w, "tcp_port:%d\r\n", s.port())
+    fmt.Fprintf(w, "uptime_in_seconds:%d\r\n", int64(time.Since(s.startTime).Seconds()))
+    fmt.Fprintf(w, "dbpath:%s\r\n", s.config.Dbpath)
+    fmt.Fprintf(w, "storage:%s\r\n", s.config.Storage)
+}
+
+func infoClients(s *Server, w *bytes.Buffer) {
+    fmt.Fprintf(w, "connected_clients:%d\r\n", s.counters.clients.Get())
+    fmt.Fprintf(w, "maxclients:%d\r\n", s.config.MaxClients)
+}
+
+func infoReplication(s *Server, w *bytes.Buffer) {
+    masterAddr := s.repl.masterAddr.Get()
+    if masterAddr == "" {
+        fmt.Fprintf(w, "role:master\r\n")
+        s.repl.RLock()
+        defer s.repl.RUnlock()
+        fmt.Fprintf(w, "connected_slaves:%d\r\n", len(s.repl.slaves))
+        i := 0
+        for slave, _ := range s.repl.slaves {
+            fmt.Fprintf(w, "slave%d:addr=%s,file_id=%d,offset=%d,lag=%d\r\n", i, slave.nc.RemoteAddr(), slave.syncFileId.Get(), slave.syncOffset.Get(), s.slaveLag(slave))
+            i++
+        }
+    } else {
+        fmt.Fprintf(w, "role:slave\r\n")
+        fmt.Fprintf(w, "master_addr:%s\r\n", masterAddr)
+        fmt.Fprintf(w, "master_link_status:%s\r\n", s.repl.masterConnState.Get())
+    }
+}
+
+func infoPersistence(s *Server, w *bytes.Buffer) {
+    fmt.Fprintf(w, "appendfsync:%s\r\n", s.fsync.policy.Get())
+    fmt.Fprintf(w, "fsync_pending_bytes:%d\r\n", s.fsync.pending.Get())
+    fmt.Fprintf(w, "fsync_last_time:%d\r\n", s.fsync.lastTime.Get())
+    fmt.Fprintf(w, "fsync_last_usec:%d\r\n", s.fsync.lastUsec.Get())
+    fmt.Fprintf(w, "fsync_total:%d\r\n", s.fsync.count.Get())
+    fmt.Fprintf(w, "fsync_errors:%d\r\n", s.fsync.errors.Get())
+    fmt.Fprintf(w, "backup_in_progress:%d\r\n", s.backup.running.Get())
+    fmt.Fprintf(w, "last_backup_time:%d\r\n", s.backup.lastTime.Get())
+    fmt.Fprintf(w, "last_backup_status:%s\r\n", s.backup.lastStatus.Get())
+    fmt.Fprintf(w, "last_backup_dir:%s\r\n", s.backup.lastDir.Get())
+    if s.config.ArchiveDir != "" {
+        fmt.Fprintf(w, "archive_dir:%s\r\n", s.config.ArchiveDir)
+        fmt.Fprintf(w, "archived_files:%d\r\n", s.archive.files.Get())
+        fmt.Fprintf(w, "last_archived_file_id:%d\r\n", s.archive.lastFileId.Get())
+        fmt.Fprintf(w, "archive_errors:%d\r\n", s.archive.errors.Get())
+    }
+}
+
+func infoMerge(s *Server, w *bytes.Buffer) {
+    fmt.Fprintf(w, "auto_merge:%t\r\n", s.config.AutoMerge)
+    s.mergeStatus(w)
+}
+
+func infoStats(s *Server, w *bytes.Buffer) {
+    fmt.Fprintf(w, "total_commands_processed:%d\r\n", s.counters.commands.Get())
+    fmt.Fprintf(w, "total_commands_failed:%d\r\n", s.counters.commandsFailed.Get())
+    fmt.Fprintf(w, "sync_full:%d\r\n", s.counters.syncFull.Get())
+    fmt.Fprintf(w, "sync_partial_ok:%d\r\n", s.counters.syncPartialOK.Get())
+    fmt.Fprintf(w, "sync_partial_err:%d\r\n", s.counters.syncPartialErr.Get())
+    fmt.Fprintf(w, "sync_total_bytes:%d\r\n", s.counters.syncTotalBytes.Get())
+    fmt.Fprintf(w, "rejected_connections:%d\r\n", s.counters.rejectedConns.Get())
+    fmt.Fprintf(w, "client_idle_timeouts:%d\r\n", s.counters.idleTimeouts.Get())
+    fmt.Fprintf(w, "client_output_buffer_limit_disconnections:%d\r\n", s.counters.obufLimitDisconnections.Get())
+    fmt.Fprintf(w, "monitors_dropped:%d\r\n", s.counters.monitorsDropped.Get())
+    s.pubsub.RLock()
+    fmt.Fprintf(w, "pubsub_channels:%d\r\n", len(s.pubsub.channels))
+    fmt.Fprintf(w, "pubsub_patterns:%d\r\n", len(s.pubsub.patterns))
+    s.pubsub.RUnlock()
+    fmt.Fprintf(w, "subscribers_dropped:%d\r\n", s.counters.subscribersDropped.Get())
+    fmt.Fprintf(w, "cdc_cursors:%d\r\n", s.cdc.n.Get())
+    fmt.Fprintf(w, "cdc_cursors_dropped:%d\r\n", s.cdc.dropped.Get())
+    fmt.Fprintf(w, "commit_groups:%d\r\n", s.counters.commitGroups.Get())
+    fmt.Fprintf(w, "commit_batches:%d\r\n", s.counters.commitBatches.Get())
+    flushes, replies := s.counters.replyFlushes.Get(), s.counters.pipelinedReplies.Get()
+    depth := 0.0
+    if flushes > 0 {
+        depth = float64(replies) / float64(flushes)
+    }
+    fmt.Fprintf(w, "reply_flushes:%d\r\n", flushes)
+    fmt.Fprintf(w, "pipeline_depth_avg:%.2f\r\n", depth)
+    fmt.Fprintf(w, "pipeline_depth_max:%d\r\n", s.counters.maxPipelineDepth.Get())
+}
+
+func infoListeners(s *Server, w *bytes.Buffer) {
+    for i, l := range s.listeners {
+        fmt.Fprintf(w, "listener%d:name=%s,network=%s,accepted=%d,connected=%d\r\n",
+            i, l.name, l.network, l.accepted.Get(), l.connected.Get())
+    }
+}
+
+func infoCommandStats(s *Server, w *bytes.Buffer) {
+    names := make([]string, 0, len(s.cmdstats))
+    for name, _ := range s.cmdstats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        st := s.cmdstats[name]
+        calls := st.calls.Get()
+        if calls == 0 {
+            continue
+        }
+        usec := st.usec.Get()
+        fmt.Fprintf(w, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,failed_calls=%d\r\n",
+            name, calls, usec, float64(usec) / float64(calls), st.failed.Get())
+    }
+}
@@ -0,0 +1,172 @@
+package bitserver
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// inline requests are plain text lines, as typed in telnet or sent by health checks
+const maxInlineSize = 64 << 10
+
+var (
+    errInlineTooBig = errors.New("Protocol error: too big inline request")
+    errUnbalancedQuotes = errors.New("Protocol error: unbalanced quotes in request")
+)
+
+// isProtocolError tells errors answered before the connection is closed
+func isProtocolError(err error) bool {
+    return err == errInlineTooBig || err == errUnbalancedQuotes
+}
+
+// readRequest decodes a multibulk request, or an inline one turned into the same array.
+// Empty lines are skipped without a reply.
+func (c *conn) readRequest() (redis.Resp, error) {
+    for {
+        b, err := c.r.Peek(1)
+        if err != nil {
+            return nil, err
+        }
+        if b[0] == '*' {
+            return redis.DecodeRequest(c.r)
+        }
+
+        args, err := c.readInlineArgs()
+        if err != nil {
+            return nil, err
+        }
+        if len(args) == 0 {
+            continue
+        }
+        req := redis.NewArray()
+        for _, arg := range args {
+            req.AppendBulkBytes(arg)
+        }
+        return req, nil
+    }
+}
+
+// readInlineArgs reads one inline line and splits it
+func (c *conn) readInlineArgs() ([][]byte, error) {
+    var line []byte
+    for {
+        part, err := c.r.ReadSlice('\n')
+        line = append(line, part...)
+        if len(line) > maxInlineSize {
+            return nil, errInlineTooBig
+        }
+        if err == nil {
+            break
+        }
+        if err != bufio.ErrBufferFull {
+            return nil, err
+        }
+    }
+    return splitInlineArgs(bytes.TrimRight(line, "\r\n"))
+}
+
+func isSpace(b byte) bool {
+    return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isHex(b byte) bool {
+    return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func hexValue(b byte) byte {
+    switch {
+    case b >= '0' && b <= '9':
+        return b - '0'
+    case b >= 'a' && b <= 'f':
+        return b - 'a' + 10
+    default:
+        return b - 'A' + 10
+    }
+}
+
+// splitInlineArgs splits line like redis-cli does: on spaces, with "double quoted"
+// args supporting \n \r \t \b \a \xHH escapes, and 'single quoted' ones supporting \'
+func splitInlineArgs(line []byte) ([][]byte, error) {
+    var args [][]byte
+    i := 0
+    for {
+        for i < len(line) && isSpace(line[i]) {
+            i++
+        }
+        if i == len(line) {
+            return args, nil
+        }
+
+        var arg []byte
+        inDouble, inSingle := false, false
+        for done := false; !done; {
+            if i == len(line) {
+                if inDouble || inSingle {
+                    return nil, errUnbalancedQuotes
+                }
+                break
+            }
+            p := line[i]
+            switch {
+            case inDouble:
+                if p == '\\' && i + 3 < len(line) && line[i + 1] == 'x' && isHex(line[i + 2]) && isHex(line[i + 3]) {
+                    arg = append(arg, hexValue(line[i + 2]) * 16 + hexValue(line[i + 3]))
+                    i += 3
+                } else if p == '\\' && i + 1 < len(line) {
+                    i++
+                    switch line[i] {
+                    case 'n':
+                        arg = append(arg, '\n')
+                    case 'r':
+                        arg = append(arg, '\r')
+                    case 't':
+                        arg = append(arg, '\t')
+                    case 'b':
+                        arg = append(arg, '\b')
+                    case 'a':
+                        arg = append(arg, '\a')
+                    default:
+                        arg = append(arg, line[i])
+                    }
+                } else if p == '"' {
+                    // the closing quote must be followed by a space or nothing
+                    if i + 1 < len(line) && !isSpace(line[i + 1]) {
+                        return nil, errUnbalancedQuotes
+                    }
+                    done = true
+                } else {
+                    arg = append(arg, p)
+                }
+            case inSingle:
+                if p == '\\' && i + 1 < len(line) && line[i + 1] == '\'' {
+                    arg = append(arg, '\'')
+                    i++
+                } else if p == '\'' {
+                    if i + 1 < len(line) && !isSpace(line[i + 1]) {
+                        return nil, errUnbalancedQuotes
+                    }
+                    done = true
+                } else {
+                    arg = append(arg, p)
+                }
+            case isSpace(p):
+                done = true
+            case p == '"':
+                inDouble = true
+            case p == '\'':
+                inSingle = true
+            default:
+                arg = append(arg, p)
+            }
+            if i < len(line) {
+                i++
+            }
+        }
+        if arg == nil {
+            arg = []byte{}
+        }
+        args = append(args, arg)
+    }
+}
@@ -0,0 +1,117 @@
+package bitserver
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testInlineSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testInlineSuite{})
+
+func (s *testInlineSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17970
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testInlineSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testInlineSuite) dial(c *C) (net.Conn, *bufio.Reader) {
+    nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.s.port))
+    c.Assert(err, IsNil)
+    return nc, bufio.NewReader(nc)
+}
+
+func (s *testInlineSuite) inline(c *C, nc net.Conn, r *bufio.Reader, line string) string {
+    _, err := nc.Write([]byte(line + "\r\n"))
+    c.Assert(err, IsNil)
+    return readRawReply(c, r)
+}
+
+func (s *testInlineSuite) TestSplitArgs(c *C) {
+    args, err := splitInlineArgs([]byte(`set  "a b\x41\n" 'it\'s'  ""`))
+    c.Assert(err, IsNil)
+    c.Assert(args, DeepEquals, [][]byte{[]byte("set"), []byte("a bA\n"), []byte("it's"), []byte{}})
+
+    for _, line := range []string{`get "a`, `get 'a`, `get "a"b`} {
+        _, err := splitInlineArgs([]byte(line))
+        c.Assert(err, Equals, errUnbalancedQuotes)
+    }
+}
+
+func (s *testInlineSuite) TestInline(c *C) {
+    nc, r := s.dial(c)
+    defer nc.Close()
+
+    c.Assert(s.inline(c, nc, r, "PING"), Equals, "+PONG\r\n")
+    // empty lines get no reply, the next request's reply comes first
+    _, err := nc.Write([]byte("\r\n  \r\n"))
+    c.Assert(err, IsNil)
+    c.Assert(s.inline(c, nc, r, `set ikey "hello world"`), Equals, "+OK\r\n")
+    c.Assert(s.inline(c, nc, r, "get ikey"), Equals, "$11\r\nhello world\r\n")
+
+    // inline and multibulk requests mix on a conn
+    w := bufio.NewWriter(nc)
+    c.Assert(redis.Encode(w, redis.NewRequest("echo", "hi")), IsNil)
+    c.Assert(w.Flush(), IsNil)
+    c.Assert(readRawReply(c, r), Equals, "$2\r\nhi\r\n")
+
+    c.Assert(s.inline(c, nc, r, "QUIT"), Equals, "+OK\r\n")
+    _, err = r.ReadByte()
+    c.Assert(err, Equals, io.EOF)
+}
+
+func (s *testInlineSuite) TestProtocolError(c *C) {
+    nc, r := s.dial(c)
+    defer nc.Close()
+
+    c.Assert(s.inline(c, nc, r, `get "ikey`), Matches, "-Protocol error: unbalanced quotes.*\r\n")
+    _, err := r.ReadByte()
+    c.Assert(err, Equals, io.EOF)
+
+    nc2, r2 := s.dial(c)
+    defer nc2.Close()
+    big := make([]byte, maxInlineSize + 1)
+    for i := range big {
+        big[i] = 'a'
+    }
+    c.Assert(s.inline(c, nc2, r2, string(big)), Matches, "-Protocol error: too big inline request\r\n")
+}
+
+func (s *testInlineSuite) TestConnectionCommands(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkString(c, "PONG", "ping")
+    nc.checkString(c, "hello", "ping", "hello")
+    nc.checkError(c, "wrong number of arguments.*", "ping", "a", "b")
+    nc.checkString(c, "hello", "echo", "hello")
+    nc.checkOK(c, "select", 0)
+    nc.checkError(c, "DB index is out of range", "select", 16)
+    nc.checkError(c, "invalid DB index", "select", "x")
+
+    resp := nc.doCmd(c, "time")
+    v, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(v.Value, HasLen, 2)
+    secs, err := strconv.ParseInt(string(v.Value[0].(*redis.BulkBytes).Value), 10, 64)
+    c.Assert(err, IsNil)
+    c.Assert(secs > 0, Equals, true)
+
+    nc.checkOK(c, "debug", "sleep", 0)
+    nc.checkError(c, "unknown subcommand.*", "debug", "nope")
+}
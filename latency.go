@@ -0,0 +1,203 @@
+package bitserver
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// latency events
+const (
+    latencyCommand = "command"
+    latencyMerge = "merge"
+    latencyMigrateBatch = "migrate-batch"
+    latencyBSyncFile = "bsync-file"
+    latencyFsync = "fsync"
+    latencyCommit = "commit"
+)
+
+const latencyHistoryLen = 160
+
+type latencySample struct {
+    time    int64   // unix seconds
+    latency int64   // milliseconds
+}
+
+type latencyEvent struct {
+    // ring buffer of samples, at most one per second
+    samples [latencyHistoryLen]latencySample
+    idx     int
+    max     int64
+}
+
+func (e *latencyEvent) latest() latencySample {
+    return e.samples[(e.idx + latencyHistoryLen - 1) % latencyHistoryLen]
+}
+
+// history in time order
+func (e *latencyEvent) history() []latencySample {
+    var h []latencySample
+    for i := 0; i < latencyHistoryLen; i++ {
+        sample := e.samples[(e.idx + i) % latencyHistoryLen]
+        if sample.time != 0 {
+            h = append(h, sample)
+        }
+    }
+    return h
+}
+
+type latencyMonitor struct {
+    sync.Mutex
+    events  map[string]*latencyEvent
+}
+
+// latencyAdd records an event that took d, if d reaches the monitor threshold
+func (s *Server) latencyAdd(event string, d time.Duration) {
+    threshold := s.config.LatencyMonitorThreshold
+    ms := int64(d / time.Millisecond)
+    if threshold <= 0 || ms < threshold {
+        return
+    }
+
+    m := &s.latency
+    m.Lock()
+    defer m.Unlock()
+    if m.events == nil {
+        m.events = make(map[string]*latencyEvent)
+    }
+    e := m.events[event]
+    if e == nil {
+        e = &latencyEvent{}
+        m.events[event] = e
+    }
+
+    now := time.Now().Unix()
+    if last := e.latest(); last.time == now {
+        if ms > last.latency {
+            e.samples[(e.idx + latencyHistoryLen - 1) % latencyHistoryLen].latency = ms
+        }
+    } else {
+        e.samples[e.idx] = latencySample{now, ms}
+        e.idx = (e.idx + 1) % latencyHistoryLen
+    }
+    if ms > e.max {
+        e.max = ms
+    }
+}
+
+// latencyTrack returns a func that records event with the time elapsed since latencyTrack
+func (s *Server) latencyTrack(event string) func() {
+    start := time.Now()
+    return func() {
+        s.latencyAdd(event, time.Since(start))
+    }
+}
+
+var latencyAdvice = map[string]string{
+    latencyCommand: "Check SLOWLOG GET for the slow commands, large values and reads of cold data-files hit the disk.",
+    latencyMerge: "Merge competes with commands for disk io, schedule merges off-peak or throttle them.",
+    latencyMigrateBatch: "Slot migration is slow, check the network to the target and the size of migrated keys.",
+    latencyBSyncFile: "Syncing data-files to slaves is slow, check the network to slaves and the disk.",
+    latencyFsync: "Fsync of data-files is slow, the disk may be saturated.",
+    latencyCommit: "Group commits are slow, large batches or a slow disk delay all writers.",
+}
+
+func (s *Server) latencyDoctor() string {
+    m := &s.latency
+    var buf bytes.Buffer
+    if len(m.events) == 0 {
+        if s.config.LatencyMonitorThreshold <= 0 {
+            return "Latency monitoring is disabled, set LatencyMonitorThreshold to enable it.\n"
+        }
+        return "No latency spikes were observed.\n"
+    }
+
+    names := make([]string, 0, len(m.events))
+    for name, _ := range m.events {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    buf.WriteString("Latency spikes observed:\n\n")
+    for i, name := range names {
+        e := m.events[name]
+        h := e.history()
+        var sum int64
+        for _, sample := range h {
+            sum += sample.latency
+        }
+        fmt.Fprintf(&buf, "%d. %s: %d latency spikes (average %dms, max %dms, latest %dms at %s).\n",
+            i + 1, name, len(h), sum / int64(len(h)), e.max, e.latest().latency,
+            time.Unix(e.latest().time, 0).Format(time.RFC3339))
+    }
+    buf.WriteString("\nAdvices:\n\n")
+    for _, name := range names {
+        if advice, ok := latencyAdvice[name]; ok {
+            fmt.Fprintf(&buf, "- %s: %s\n", name, advice)
+        }
+    }
+    return buf.String()
+}
+
+// LATENCY LATEST | HISTORY event | RESET [event...] | DOCTOR
+func LatencyCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    m := &c.s.latency
+    m.Lock()
+    defer m.Unlock()
+
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "latest":
+        resp := redis.NewArray()
+        for name, e := range m.events {
+            latest := e.latest()
+            one := redis.NewArray()
+            one.AppendBulkBytes([]byte(name))
+            one.AppendInt(latest.time)
+            one.AppendInt(latest.latency)
+            one.AppendInt(e.max)
+            resp.Append(one)
+        }
+        return resp, nil
+    case "history":
+        if len(args) != 2 {
+            return toRespErrorf("len(args) = %d, expect = 2", len(args))
+        }
+        resp := redis.NewArray()
+        if e := m.events[string(args[1])]; e != nil {
+            for _, sample := range e.history() {
+                one := redis.NewArray()
+                one.AppendInt(sample.time)
+                one.AppendInt(sample.latency)
+                resp.Append(one)
+            }
+        }
+        return resp, nil
+    case "reset":
+        var n int64
+        if len(args) == 1 {
+            n = int64(len(m.events))
+            m.events = nil
+        } else {
+            for _, name := range args[1:] {
+                if _, ok := m.events[string(name)]; ok {
+                    delete(m.events, string(name))
+                    n++
+                }
+            }
+        }
+        return redis.NewInt(n), nil
+    case "doctor":
+        return redis.NewBulkBytesWithString(c.s.latencyDoctor()), nil
+    default:
+        return toRespErrorf("unknown LATENCY subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "latency", f: LatencyCmd, flag: CmdAdmin|CmdLoading|CmdStale|CmdNoScript, arity: -2,
+        group: "server", summary: "Latency monitoring"})
+}
@@ -0,0 +1,108 @@
+package bitserver
+
+import (
+    "crypto/tls"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/reborndb/go/atomic2"
+)
+
+type listener struct {
+    net.Listener
+    // address as configured, e.g. 127.0.0.1:6379 or unix:/tmp/bitserver.sock
+    name        string
+    network     string
+
+    accepted    atomic2.Int64
+    connected   atomic2.Int64
+}
+
+// parseBind splits a bind entry into network and address,
+// unix sockets are given as unix:/path or an absolute path.
+func parseBind(bind string) (string, string) {
+    if strings.HasPrefix(bind, "unix:") {
+        return "unix", bind[len("unix:"):]
+    }
+    if strings.HasPrefix(bind, "/") {
+        return "unix", bind
+    }
+    return "tcp", bind
+}
+
+func (c *Config) binds() []string {
+    if len(c.Binds) != 0 {
+        return c.Binds
+    }
+    return []string{fmt.Sprintf("0.0.0.0:%d", c.Listen)}
+}
+
+func newListener(bind string, c *Config, tlsConfig *tls.Config) (*listener, error) {
+    network, addr := parseBind(bind)
+    if network == "unix" {
+        // remove stale socket left by a previous process
+        if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+            os.Remove(addr)
+        }
+    }
+
+    l, err := net.Listen(network, addr)
+    if err != nil {
+        return nil, err
+    }
+
+    if network == "unix" {
+        perm := c.UnixSocketPerm
+        if perm == 0 {
+            perm = 0700
+        }
+        if err := os.Chmod(addr, perm); err != nil {
+            l.Close()
+            return nil, err
+        }
+    } else if tlsConfig != nil {
+        l = tls.NewListener(l, tlsConfig)
+    }
+
+    return &listener{
+        Listener: l,
+        name: bind,
+        network: network,
+    }, nil
+}
+
+func (s *Server) listen() error {
+    for _, bind := range s.config.binds() {
+        l, err := newListener(bind, s.config, s.tlsConfig)
+        if err != nil {
+            s.closeListeners()
+            return fmt.Errorf("listen on %s failed, err=%s", bind, err)
+        }
+        s.listeners = append(s.listeners, l)
+    }
+    return nil
+}
+
+// useListeners serves on listeners given by the embedding program
+func (s *Server) useListeners(ls []net.Listener) {
+    for _, l := range ls {
+        network := l.Addr().Network()
+        if s.tlsConfig != nil && network != "unix" {
+            l = tls.NewListener(l, s.tlsConfig)
+        }
+        s.listeners = append(s.listeners, &listener{
+            Listener: l,
+            name: l.Addr().String(),
+            network: network,
+        })
+    }
+}
+
+func (s *Server) closeListeners() {
+    for _, l := range s.listeners {
+        l.Close()
+    }
+    s.listeners = nil
+}
@@ -0,0 +1,136 @@
+package bitserver
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testListenerSuite struct {
+    s *testSvrNode
+    sock string
+}
+
+var _ = Suite(&testListenerSuite{})
+
+func (s *testListenerSuite) SetUpSuite(c *C) {
+    s.sock = filepath.Join(c.MkDir(), "bitserver.sock")
+
+    config := DefaultConfig()
+    config.Listen = 17820
+    config.Dbpath = c.MkDir()
+    config.Binds = []string{"127.0.0.1:17820", "unix:" + s.sock}
+    config.UnixSocketPerm = 0770
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testListenerSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testListenerSuite) TestParseBind(c *C) {
+    network, addr := parseBind("127.0.0.1:6379")
+    c.Assert(network, Equals, "tcp")
+    c.Assert(addr, Equals, "127.0.0.1:6379")
+    network, addr = parseBind("unix:/tmp/a.sock")
+    c.Assert(network, Equals, "unix")
+    c.Assert(addr, Equals, "/tmp/a.sock")
+    network, addr = parseBind("/tmp/a.sock")
+    c.Assert(network, Equals, "unix")
+    c.Assert(addr, Equals, "/tmp/a.sock")
+}
+
+func (s *testListenerSuite) TestUnixSocket(c *C) {
+    fi, err := os.Stat(s.sock)
+    c.Assert(err, IsNil)
+    c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0770))
+
+    nc, err := net.Dial("unix", s.sock)
+    c.Assert(err, IsNil)
+    uc := testNewConn(nc)
+    defer uc.Close()
+
+    uc.checkOK(c, "set", "a", "1")
+    s.s.checkString(c, "1", "get", "a")
+
+    resp := uc.doCmd(c, "info", "listeners")
+    info, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(strings.Contains(string(info.Value), fmt.Sprintf("name=unix:%s,network=unix,accepted=1,connected=1", s.sock)), Equals, true)
+}
+
+func (s *testListenerSuite) TestEphemeralPort(c *C) {
+    config := DefaultConfig()
+    config.Listen = 0
+    config.Dbpath = c.MkDir()
+    config.Binds = []string{"127.0.0.1:0"}
+    var logs bytes.Buffer
+    svr, err := NewServerWithOptions(context.Background(), config, &Options{Logger: log.New(&logs, "", 0)})
+    c.Assert(err, IsNil)
+    go svr.Serve()
+
+    port := svr.Addr().(*net.TCPAddr).Port
+    c.Assert(port, Not(Equals), 0)
+    nc := testGetConn(c, port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+    resp := nc.doCmd(c, "info", "server")
+    info, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(strings.Contains(string(info.Value), fmt.Sprintf("tcp_port:%d\r\n", port)), Equals, true)
+
+    svr.Close()
+    svr.Close()
+    c.Assert(svr.Serve(), IsNil)
+    c.Assert(strings.Contains(logs.String(), "new connection"), Equals, true)
+}
+
+func (s *testListenerSuite) TestGivenListener(c *C) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    c.Assert(err, IsNil)
+
+    config := DefaultConfig()
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    ctx, cancel := context.WithCancel(context.Background())
+    svr, err := NewServerWithOptions(ctx, config, &Options{Listeners: []net.Listener{l}})
+    c.Assert(err, IsNil)
+    c.Assert(svr.Addr().String(), Equals, l.Addr().String())
+
+    served := make(chan error, 1)
+    go func() {
+        served <- svr.Serve()
+    }()
+    nc := testGetConn(c, l.Addr().(*net.TCPAddr).Port)
+    nc.checkOK(c, "set", "a", "1")
+    nc.Close()
+
+    // canceling ctx closes the server
+    cancel()
+    select {
+    case err := <-served:
+        c.Assert(err, IsNil)
+    case <-time.After(5 * time.Second):
+        c.Fatal("server not closed")
+    }
+    _, err = net.Dial("tcp", l.Addr().String())
+    c.Assert(err, NotNil)
+}
+
+func (s *testListenerSuite) TestListenError(c *C) {
+    config := DefaultConfig()
+    config.Dbpath = c.MkDir()
+    config.Binds = []string{"127.0.0.1:17820"}
+    _, err := NewServer(config)
+    c.Assert(err, NotNil)
+}
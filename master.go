@@ -4,6 +4,7 @@ import (
     "os"
     "bytes"
     "strconv"
+    "strings"
     "fmt"
     "io"
     "log"
@@ -18,7 +19,7 @@ func (s *Server) initReplication() error {
     s.repl.master = make(chan *conn, 0)
     s.repl.slaveofReply = make(chan struct{}, 1)
 
-    go func() {
+    s.goFunc(func() {
         for {
             pingPeriod := time.Duration(1) * time.Second
             select {
@@ -26,11 +27,11 @@ func (s *Server) initReplication() error {
                 return
             case <-time.After(pingPeriod):
                 if err := s.replicationNotifySlaves(); err != nil {
-                    log.Printf("ping slaves error - %s", err)
+                    s.logger.Printf("ping slaves error - %s", err)
                 }
             }
         }
-    }()
+    })
     return nil
 }
 
@@ -44,20 +45,48 @@ func (s *Server) replicationNotifySlaves() error {
     return nil
 }
 
-// BSYNC runId fileId offset
-func BSyncCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 3 {
-        return toRespErrorf("len(args) = %d, expect = 3", len(args))
+// replication features a slave announces with BSYNC ... CAPA name, so that
+// the master never sends frames older slaves can't parse
+type syncCapa int
+
+const (
+    // the slave understands the caught-up marker
+    syncCapaMarker syncCapa = 1 << iota
+    // the slave applies records batch by batch, see syncBatchFileId
+    syncCapaBatch
+)
+
+var syncCapaNames = map[string]syncCapa{
+    "marker": syncCapaMarker,
+    "batch": syncCapaBatch,
+}
+
+// parseSyncCapa parses CAPA name pairs, unknown capabilities are ignored
+func parseSyncCapa(args [][]byte) (syncCapa, error) {
+    var capa syncCapa
+    for i := 0; i < len(args); i += 2 {
+        if strings.ToLower(string(args[i])) != "capa" || i + 1 >= len(args) {
+            return 0, fmt.Errorf("syntax error")
+        }
+        capa |= syncCapaNames[strings.ToLower(string(args[i + 1]))]
     }
+    return capa, nil
+}
 
+// BSYNC runId fileId offset [CAPA name ...]
+func BSyncCmd(c *conn, args [][]byte) (redis.Resp, error) {
     s := c.s
     if (s.isSlave(c)) {
-        log.Printf("conn %s is already my slave", c)
+        c.s.logger.Printf("conn %s is already my slave", c)
         return nil, nil
     }
 
     // TODO check runId
 
+    if s.bc.GetDataFilePath(s.bc.ActiveFileId()) == "" {
+        return toRespError(errNoDataFiles)
+    }
+
     fileId, err := strconv.ParseInt(string(args[1]), 10, 64)
     if err != nil {
         return nil, err
@@ -66,22 +95,31 @@ func BSyncCmd(c *conn, args [][]byte) (redis.Resp, error) {
     if err != nil {
         return nil, err
     }
-    c.syncFileId = fileId
-    c.syncOffset = offset
-
-    // check data-files between master and slave
-    if s.checkPreSync(c); err != nil {
+    capa, err := parseSyncCapa(args[3:])
+    if err != nil {
+        return toRespError(err)
+    }
+    c.syncCapa = capa
+    c.syncFileId.Set(fileId)
+    c.syncOffset.Set(offset)
+
+    // merges would delete data-files the slave has yet to pull,
+    // from the check of its data-files on
+    s.beginFullSync()
+    if err := s.checkPreSync(c); err != nil {
+        s.endFullSync()
         return nil, err
     }
-
     activeFileId := s.bc.ActiveFileId()
-    for c.syncFileId < activeFileId {
+    for c.syncFileId.Get() < activeFileId {
         err := s.syncDataFile(c)
         if err != nil {
-            log.Println(err)
+            s.endFullSync()
+            c.s.logger.Println(err)
             return nil, err
         }
     }
+    s.endFullSync()
 
     s.startSlaveReplication(c, args)
     return nil, nil
@@ -146,14 +184,15 @@ func (s *Server) checkPreSync(c *conn) error {
     c.w.WriteString(fmt.Sprintf("$%d\r\n", startFileId))
     c.w.Flush()
 
-    c.syncFileId = startFileId
-    c.syncOffset = 0
+    c.syncFileId.Set(startFileId)
+    c.syncOffset.Set(0)
     return nil
 }
 
 func (s *Server) syncDataFile(c *conn) error {
-    fileId := c.syncFileId
-    offset := c.syncOffset
+    defer s.latencyTrack(latencyBSyncFile)()
+    fileId := c.syncFileId.Get()
+    offset := c.syncOffset.Get()
     bc := s.bc
     activeFileId := bc.ActiveFileId()
 
@@ -163,51 +202,98 @@ func (s *Server) syncDataFile(c *conn) error {
     */
     dataPath := bc.GetDataFilePath(fileId)
     if _, err := os.Stat(dataPath); err != nil {
-        log.Printf("data-file[%d] not exists, sync next file", fileId)
+        s.logger.Printf("data-file[%d] not exists, sync next file", fileId)
         fileId = bc.NextDataFileId(fileId)
         offset = 0
     }
 
-    // sync records in current file to slave
+    // sync records in current file to slave, batch by batch
     var reachEOF bool
-    for {
+    for !reachEOF {
+        batch, next, eof, inGroup, err := s.readSyncBatch(fileId, offset, c.syncInGroup)
+        if err != nil {
+            return err
+        }
+        if len(batch) > 0 {
+            if _, err := c.w.Write(batch); err != nil {
+                return err
+            }
+        }
+        // a group going on in the next data-file is ended there
+        if len(batch) > 0 && !inGroup && c.syncCapa&syncCapaBatch != 0 {
+            c.w.WriteString(fmt.Sprintf("$%d\r\n$0\r\n$0\r\n", syncBatchFileId))
+        }
+        c.syncInGroup = inGroup
+        offset = next
+        reachEOF = eof
+    }
+
+    if fileId < activeFileId {
+        fileId = bc.NextDataFileId(fileId)
+        offset = 0
+    }
+
+    c.syncFileId.Set(fileId)
+    c.syncOffset.Set(offset)
+    return c.w.Flush()
+}
+
+// fileId of the marker record, sent once the slave caught up with the active data-file,
+// to slaves with syncCapaMarker
+const syncMarkerFileId = -1
+
+// fileId of the record ending a batch, sent to slaves with syncCapaBatch.
+// The slave applies records of a batch atomically.
+const syncBatchFileId = -2
+
+// bytes of records after which a batch ends at the next commit group end
+const syncBatchSize = 1 << 20
+
+// readSyncBatch encodes records of data-file fileId from offset for the slave,
+// until syncBatchSize and the end of a commit group, or the end of the file.
+// Records of a group but the last are flagged, see record.go; records without
+// trailer, like tombstones, belong to the group around them. inGroup tells
+// whether a group is going on at offset, and after the batch.
+// It holds dataLock, so the active data-file never ends inside a group.
+func (s *Server) readSyncBatch(fileId int64, offset int64, inGroup bool) ([]byte, int64, bool, bool, error) {
+    s.dataLock.RLock()
+    defer s.dataLock.RUnlock()
+
+    bc := s.bc
+    var buf bytes.Buffer
+    for buf.Len() < syncBatchSize || inGroup {
         rec, err := bc.RefRecord(fileId, offset)
         if err != nil {
             if err == io.EOF {
-                reachEOF = true
-            } else {
-                return err
+                return buf.Bytes(), offset, true, inGroup, nil
             }
-            break
+            return nil, offset, false, inGroup, err
         }
 
         size := rec.Size()
-        c.w.WriteString(fmt.Sprintf("$%d\r\n", fileId))
-        c.w.WriteString(fmt.Sprintf("$%d\r\n", offset))
-        c.w.WriteString(fmt.Sprintf("$%d\r\n", size))
         data, err := rec.Encode()
         if err != nil {
             log.Fatalf("encode record failed, %d %d %d", fileId, offset, size)
-            return err
+            return nil, offset, false, inGroup, err
         }
         if len(data) != int(size) {
             log.Fatalf("data_len[%d] != size[%d]", len(data), size)
         }
-        _, err = c.w.Write(data)
-        if err != nil {
-            return err
-        }
+        buf.WriteString(fmt.Sprintf("$%d\r\n", fileId))
+        buf.WriteString(fmt.Sprintf("$%d\r\n", offset))
+        buf.WriteString(fmt.Sprintf("$%d\r\n", size))
+        buf.Write(data)
 
+        if rec.Key() != nil {
+            inGroup = rec.More()
+        }
         offset += size
     }
+    return buf.Bytes(), offset, false, inGroup, nil
+}
 
-    if reachEOF && fileId < activeFileId {
-        fileId = bc.NextDataFileId(fileId)
-        offset = 0
-    }
-
-    c.syncFileId = fileId
-    c.syncOffset = offset
+func (s *Server) sendSyncMarker(c *conn) error {
+    c.w.WriteString(fmt.Sprintf("$%d\r\n$0\r\n$0\r\n", syncMarkerFileId))
     return c.w.Flush()
 }
 
@@ -219,13 +305,14 @@ func (s *Server) startSlaveReplication(c *conn, args [][]byte) {
     s.repl.slaves[c] = ch
     s.repl.Unlock()
 
-    log.Printf("start sync to slave %s", c)
-    go func(c *conn, ch chan struct{}) {
+    s.logger.Printf("start sync to slave %s", c)
+    s.goFunc(func() {
         defer func() {
             s.removeConn(c)
             c.Close()
         }()
 
+        caughtUp := false
         for {
             select {
             case <-s.signal:
@@ -237,15 +324,24 @@ func (s *Server) startSlaveReplication(c *conn, args [][]byte) {
 
                 err := s.syncDataFile(c)
                 if err != nil {
-                    log.Printf("sync slave failed, err=%s", err)
+                    s.logger.Printf("sync slave failed, err=%s", err)
                     return
                 }
+
+                if !caughtUp && c.syncCapa&syncCapaMarker != 0 {
+                    if err := s.sendSyncMarker(c); err != nil {
+                        s.logger.Printf("sync slave failed, err=%s", err)
+                        return
+                    }
+                    caughtUp = true
+                }
             }
         }
-    }(c, ch)
+    })
 }
 
 func init() {
-    Register("bsync", BSyncCmd, CmdReadOnly)
+    register(&command{name: "bsync", f: BSyncCmd, flag: CmdReadOnly|CmdReplication|CmdAdmin|CmdNoScript|CmdNoMulti, arity: -4,
+        group: "server", summary: "Sync data-files to a slave"})
 }
 
@@ -0,0 +1,196 @@
+package bitserver
+
+import (
+    "bytes"
+    "io"
+    "sort"
+    "sync"
+)
+
+// memStorage keeps keys in memory only, for tests and cache-only deployments.
+// It has no data-files, so it can't sync slaves nor be backed up.
+type memStorage struct {
+    sync.RWMutex
+    keys    map[string]*memEntry
+    // keys of each slot, for slot migration
+    slots   [MaxSlotNum]map[string]struct{}
+}
+
+type memEntry struct {
+    value   []byte
+    // kept as given, like bitcask does
+    expireAt uint32
+}
+
+func newMemStorage() *memStorage {
+    return &memStorage{keys: make(map[string]*memEntry)}
+}
+
+func (m *memStorage) Get(key []byte) ([]byte, error) {
+    value, _, err := m.GetWithExpr(key)
+    return value, err
+}
+
+func (m *memStorage) GetWithExpr(key []byte) ([]byte, uint32, error) {
+    m.RLock()
+    defer m.RUnlock()
+    e := m.keys[string(key)]
+    if e == nil {
+        return nil, 0, ErrKeyNotFound
+    }
+    return e.value, e.expireAt, nil
+}
+
+func (m *memStorage) Set(key, value []byte) error {
+    return m.SetWithExpr(key, value, 0)
+}
+
+func (m *memStorage) SetWithExpr(key, value []byte, expireAt uint32) error {
+    m.Lock()
+    defer m.Unlock()
+    m.set(key, value, expireAt)
+    return nil
+}
+
+func (m *memStorage) set(key, value []byte, expireAt uint32) {
+    // copy, args of a request may be reused
+    value = append([]byte{}, value...)
+    m.keys[string(key)] = &memEntry{value: value, expireAt: expireAt}
+    _, slot := HashKeyToSlot(key)
+    if m.slots[slot] == nil {
+        m.slots[slot] = make(map[string]struct{})
+    }
+    m.slots[slot][string(key)] = struct{}{}
+}
+
+func (m *memStorage) Del(key []byte) error {
+    m.Lock()
+    defer m.Unlock()
+    return m.del(key)
+}
+
+func (m *memStorage) del(key []byte) error {
+    if _, ok := m.keys[string(key)]; !ok {
+        return ErrKeyNotFound
+    }
+    delete(m.keys, string(key))
+    _, slot := HashKeyToSlot(key)
+    delete(m.slots[slot], string(key))
+    return nil
+}
+
+func (m *memStorage) DelLocal(key []byte) error {
+    return m.Del(key)
+}
+
+func (m *memStorage) ClearAll() error {
+    m.Lock()
+    defer m.Unlock()
+    m.keys = make(map[string]*memEntry)
+    for i := range m.slots {
+        m.slots[i] = nil
+    }
+    return nil
+}
+
+// ForEachKey lists keys in no particular order, see keyIterator
+func (m *memStorage) ForEachKey(f func(key []byte) bool) error {
+    m.RLock()
+    defer m.RUnlock()
+    for key, _ := range m.keys {
+        if !f([]byte(key)) {
+            break
+        }
+    }
+    return nil
+}
+
+// WriteBatch applies a batch under one lock, see atomicBatchWriter
+func (m *memStorage) WriteBatch(ops []writeOp) error {
+    m.Lock()
+    defer m.Unlock()
+    for _, op := range ops {
+        if op.del {
+            m.del(op.key)
+        } else {
+            m.set(op.key, op.value, op.expireAt)
+        }
+    }
+    return nil
+}
+
+// FirstKeyUnderSlot returns the smallest key of slot
+func (m *memStorage) FirstKeyUnderSlot(slot uint32) ([]byte, error) {
+    m.RLock()
+    defer m.RUnlock()
+    var first []byte
+    for key, _ := range m.slots[slot % MaxSlotNum] {
+        if first == nil || key < string(first) {
+            first = []byte(key)
+        }
+    }
+    return first, nil
+}
+
+func (m *memStorage) AllKeysWithTag(tag []byte) ([][]byte, error) {
+    m.RLock()
+    defer m.RUnlock()
+    var keys []string
+    for key, _ := range m.slots[HashTagToSlot(tag)] {
+        if bytes.Equal(HashTag([]byte(key)), tag) {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    result := make([][]byte, len(keys))
+    for i, key := range keys {
+        result[i] = []byte(key)
+    }
+    return result, nil
+}
+
+// Merge has nothing to reclaim
+func (m *memStorage) Merge(done chan int) {
+    done <- 0
+}
+
+func (m *memStorage) Close() {
+}
+
+// Sync has nothing to flush, see fsyncer
+func (m *memStorage) Sync() error {
+    return nil
+}
+
+// DeadBytes is always 0, see deadBytesCounter
+func (m *memStorage) DeadBytes() int64 {
+    return 0
+}
+
+func (m *memStorage) ActiveFileId() int64 {
+    return 0
+}
+
+func (m *memStorage) NextDataFileId(fileId int64) int64 {
+    return fileId
+}
+
+func (m *memStorage) GetDataFilePath(fileId int64) string {
+    return ""
+}
+
+func (m *memStorage) GetFileMetas() []*FileMeta {
+    return nil
+}
+
+func (m *memStorage) RefRecord(fileId int64, offset int64) (Record, error) {
+    return nil, io.EOF
+}
+
+func (m *memStorage) Truncate(fileId int64) error {
+    return errNoDataFiles
+}
+
+func (m *memStorage) SyncFile(fileId int64, offset int64, length int64, data []byte) error {
+    return errNoDataFiles
+}
@@ -0,0 +1,355 @@
+package bitserver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+const (
+    mergeTriggerManual = "manual"
+    mergeTriggerAuto = "auto"
+)
+
+// how often auto merge checks its triggers
+const mergeCheckInterval = 30 * time.Second
+
+// number of merges kept in history
+const mergeHistoryLen = 16
+
+var (
+    errMergeRunning = errors.New("merge already in progress")
+    errMergeFullSync = errors.New("full sync to slaves in progress, merge later")
+    errMergeNotRunning = errors.New("no merge in progress")
+    errMergeNoAbort = errors.New("the storage can't abort a running merge")
+    errMergeNoThrottle = errors.New("the storage can't throttle merges, unset merge-rate-limit")
+    errMergeNoDeadBytes = errors.New("the storage doesn't count dead bytes, set merge-dead-ratio to 0 to auto merge by growth")
+)
+
+// mergeAborter is implemented by storages able to stop a running merge
+type mergeAborter interface {
+    AbortMerge()
+}
+
+// mergeThrottler is implemented by storages able to limit merge io, in bytes per second
+type mergeThrottler interface {
+    SetMergeRateLimit(bytesPerSec int64)
+}
+
+// mergeWindow is a time of day range in minutes, end may be before start to wrap midnight
+type mergeWindow struct {
+    start   int
+    end     int
+}
+
+func (w mergeWindow) contains(t time.Time) bool {
+    m := t.Hour() * 60 + t.Minute()
+    if w.start <= w.end {
+        return m >= w.start && m < w.end
+    }
+    return m >= w.start || m < w.end
+}
+
+// parseMergeWindows parses "HH:MM-HH:MM[,HH:MM-HH:MM...]", empty means any time
+func parseMergeWindows(s string) ([]mergeWindow, error) {
+    var windows []mergeWindow
+    for _, part := range strings.Split(s, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        se := strings.Split(part, "-")
+        if len(se) != 2 {
+            return nil, fmt.Errorf("invalid merge window %s", part)
+        }
+        var w mergeWindow
+        var err error
+        if w.start, err = parseClock(se[0]); err != nil {
+            return nil, fmt.Errorf("invalid merge window %s", part)
+        }
+        if w.end, err = parseClock(se[1]); err != nil {
+            return nil, fmt.Errorf("invalid merge window %s", part)
+        }
+        windows = append(windows, w)
+    }
+    return windows, nil
+}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", strings.TrimSpace(s))
+    if err != nil {
+        return 0, err
+    }
+    return t.Hour() * 60 + t.Minute(), nil
+}
+
+type mergeRun struct {
+    start       time.Time
+    duration    time.Duration
+    trigger     string
+    // "ok", "aborted" or "err" and the code merge returned
+    status      string
+    before      storageStats
+    after       storageStats
+}
+
+type mergeManager struct {
+    sync.Mutex
+    windows     []mergeWindow
+    running     *mergeRun
+    aborted     bool
+    // BSYNC full syncs in progress, merges don't start meanwhile
+    fullSyncs   int
+    // signaled when a merge or a full sync ends
+    cond        *sync.Cond
+    // data-file bytes after the last merge
+    lastBytes   int64
+    autoRuns    int64
+    history     []*mergeRun
+}
+
+func (s *Server) initMerge() error {
+    windows, err := parseMergeWindows(s.config.MergeWindows)
+    if err != nil {
+        return err
+    }
+    m := &s.mergeMgr
+    m.windows = windows
+    m.cond = sync.NewCond(&m.Mutex)
+    m.lastBytes = s.storageStats().bytes
+
+    if t, ok := interface{}(s.bc).(mergeThrottler); ok {
+        t.SetMergeRateLimit(s.config.MergeRateLimit)
+    } else if s.config.MergeRateLimit > 0 {
+        return errMergeNoThrottle
+    }
+    if _, ok := interface{}(s.bc).(deadBytesCounter); !ok && s.config.AutoMerge && s.config.MergeDeadBytesRatio > 0 {
+        return errMergeNoDeadBytes
+    }
+
+    if s.config.AutoMerge {
+        s.goFunc(func() {
+            ticker := time.NewTicker(mergeCheckInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-s.signal:
+                    return
+                case <-ticker.C:
+                    if s.shouldAutoMerge(time.Now()) {
+                        if err := s.startMerge(mergeTriggerAuto); err != nil {
+                            s.logger.Printf("auto merge not started, err = %s", err)
+                        }
+                    }
+                }
+            }
+        })
+    }
+    return nil
+}
+
+func (s *Server) inMergeWindow(t time.Time) bool {
+    windows := s.mergeMgr.windows
+    if len(windows) == 0 {
+        return true
+    }
+    for _, w := range windows {
+        if w.contains(t) {
+            return true
+        }
+    }
+    return false
+}
+
+// shouldAutoMerge checks the dead bytes ratio once data-files reach MergeMinSize.
+// Without a ratio data-files are merged once they grew by MergeMinSize since the last merge.
+func (s *Server) shouldAutoMerge(now time.Time) bool {
+    if !s.inMergeWindow(now) {
+        return false
+    }
+    st := s.storageStats()
+    if s.config.MergeDeadBytesRatio <= 0 || st.deadBytes < 0 {
+        s.mergeMgr.Lock()
+        lastBytes := s.mergeMgr.lastBytes
+        s.mergeMgr.Unlock()
+        return st.bytes - lastBytes >= s.config.MergeMinSize
+    }
+    if st.bytes < s.config.MergeMinSize || st.bytes == 0 {
+        return false
+    }
+    return float64(st.deadBytes) / float64(st.bytes) >= s.config.MergeDeadBytesRatio
+}
+
+// startMerge runs a merge in background, one at a time and never during a full sync
+func (s *Server) startMerge(trigger string) error {
+    m := &s.mergeMgr
+    m.Lock()
+    defer m.Unlock()
+    if m.running != nil {
+        return errMergeRunning
+    }
+    if m.fullSyncs > 0 {
+        return errMergeFullSync
+    }
+    if s.cdcHoldsMerge() {
+        return errMergeCDC
+    }
+    run := &mergeRun{start: time.Now(), trigger: trigger}
+    m.running = run
+    m.aborted = false
+    if trigger == mergeTriggerAuto {
+        m.autoRuns++
+    }
+
+    s.goFunc(func() {
+        s.runMerge(run)
+    })
+    return nil
+}
+
+func (s *Server) runMerge(run *mergeRun) {
+    // don't delete data-files being backed up
+    s.backup.Lock()
+    run.before = s.storageStats()
+    code := 0
+    // nor data-files rotated since the last archive tick
+    archiveErr := s.archiveDataFilesLocked()
+    if archiveErr == nil {
+        done := make(chan int, 1)
+        go s.bc.Merge(done)
+        select {
+        case code = <-done:
+        case <-s.signal:
+            if _, ok := interface{}(s.bc).(mergeAborter); !ok {
+                // Close doesn't wait for it, run stays running and the storage open
+                s.backup.Unlock()
+                s.logger.Printf("%s merge still running at close", run.trigger)
+                return
+            }
+            // aborted by Close
+            code = <-done
+        }
+    }
+    run.after = s.storageStats()
+    s.backup.Unlock()
+
+    d := time.Since(run.start)
+    run.duration = d
+    s.latencyAdd(latencyMerge, d)
+    s.counters.mergeRuns.Incr()
+    s.counters.mergeUsec.Add(int64(d / time.Microsecond))
+    s.counters.lastMergeUsec.Set(int64(d / time.Microsecond))
+
+    m := &s.mergeMgr
+    m.Lock()
+    defer m.Unlock()
+    switch {
+    case archiveErr != nil:
+        run.status = "archive-failed"
+    case m.aborted:
+        run.status = "aborted"
+    case code != 0:
+        run.status = fmt.Sprintf("err%d", code)
+    default:
+        run.status = "ok"
+    }
+    s.logger.Printf("%s merge %s in %s, reclaimed %d bytes", run.trigger, run.status, d, run.before.bytes - run.after.bytes)
+    m.lastBytes = run.after.bytes
+    m.running = nil
+    m.history = append(m.history, run)
+    if len(m.history) > mergeHistoryLen {
+        m.history = m.history[1:]
+    }
+    m.cond.Broadcast()
+}
+
+func (s *Server) abortMerge() error {
+    m := &s.mergeMgr
+    a, ok := interface{}(s.bc).(mergeAborter)
+    if !ok {
+        return errMergeNoAbort
+    }
+    m.Lock()
+    defer m.Unlock()
+    if m.running == nil {
+        return errMergeNotRunning
+    }
+    m.aborted = true
+    a.AbortMerge()
+    return nil
+}
+
+// beginFullSync waits for a running merge, then keeps merges off until endFullSync
+func (s *Server) beginFullSync() {
+    m := &s.mergeMgr
+    m.Lock()
+    defer m.Unlock()
+    for m.running != nil {
+        m.cond.Wait()
+    }
+    m.fullSyncs++
+}
+
+func (s *Server) endFullSync() {
+    m := &s.mergeMgr
+    m.Lock()
+    defer m.Unlock()
+    m.fullSyncs--
+    m.cond.Broadcast()
+}
+
+func (s *Server) mergeStatus(w *bytes.Buffer) {
+    m := &s.mergeMgr
+    m.Lock()
+    defer m.Unlock()
+    if run := m.running; run != nil {
+        fmt.Fprintf(w, "merge_in_progress:1\r\n")
+        fmt.Fprintf(w, "merge_trigger:%s\r\n", run.trigger)
+        fmt.Fprintf(w, "merge_start_time:%d\r\n", run.start.Unix())
+        fmt.Fprintf(w, "merge_elapsed_ms:%d\r\n", int64(time.Since(run.start) / time.Millisecond))
+    } else {
+        fmt.Fprintf(w, "merge_in_progress:0\r\n")
+    }
+    fmt.Fprintf(w, "merge_full_syncs:%d\r\n", m.fullSyncs)
+    fmt.Fprintf(w, "merge_auto_runs:%d\r\n", m.autoRuns)
+    for i := len(m.history) - 1; i >= 0; i-- {
+        run := m.history[i]
+        fmt.Fprintf(w, "merge%d:start=%d,duration_ms=%d,trigger=%s,status=%s,reclaimed_bytes=%d,removed_files=%d\r\n",
+            len(m.history) - 1 - i, run.start.Unix(), int64(run.duration / time.Millisecond), run.trigger, run.status,
+            run.before.bytes - run.after.bytes, run.before.files - run.after.files)
+    }
+}
+
+// MERGE [STATUS | ABORT]
+func MergeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    if len(args) == 0 {
+        if err := s.startMerge(mergeTriggerManual); err != nil {
+            return toRespError(err)
+        }
+        return redis.NewString("OK"), nil
+    }
+
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "status":
+        var buf bytes.Buffer
+        s.mergeStatus(&buf)
+        return newVerbatim(buf.Bytes()), nil
+    case "abort":
+        if err := s.abortMerge(); err != nil {
+            return toRespError(err)
+        }
+        return redis.NewString("OK"), nil
+    default:
+        return toRespErrorf("unknown MERGE subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "merge", f: MergeCmd, flag: CmdAdmin|CmdNoScript, arity: -1,
+        group: "server", summary: "Merge data-files to reclaim space of dead records, or report or abort a merge"})
+}
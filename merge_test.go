@@ -0,0 +1,86 @@
+package bitserver
+
+import (
+    "strings"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testMergeSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testMergeSuite{})
+
+func (s *testMergeSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17920
+    config.Dbpath = c.MkDir()
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testMergeSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testMergeSuite) TestMergeWindows(c *C) {
+    windows, err := parseMergeWindows("02:00-05:30, 23:00-01:00")
+    c.Assert(err, IsNil)
+    c.Assert(windows, DeepEquals, []mergeWindow{{120, 330}, {1380, 60}})
+
+    at := func(hour, min int) time.Time {
+        return time.Date(2020, 1, 1, hour, min, 0, 0, time.Local)
+    }
+    c.Assert(windows[0].contains(at(3, 0)), Equals, true)
+    c.Assert(windows[0].contains(at(5, 30)), Equals, false)
+    c.Assert(windows[1].contains(at(23, 30)), Equals, true)
+    c.Assert(windows[1].contains(at(0, 59)), Equals, true)
+    c.Assert(windows[1].contains(at(12, 0)), Equals, false)
+
+    _, err = parseMergeWindows("02:00")
+    c.Assert(err, NotNil)
+    _, err = parseMergeWindows("25:00-26:00")
+    c.Assert(err, NotNil)
+}
+
+func (s *testMergeSuite) TestMergeStatus(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "set", "merge:a", "1")
+    nc.checkOK(c, "set", "merge:a", "2")
+    nc.checkOK(c, "merge")
+
+    // wait for the merge to show up in history
+    for i := 0; ; i++ {
+        resp := nc.doCmd(c, "merge", "status")
+        status := string(resp.(*redis.BulkBytes).Value)
+        if strings.Contains(status, "merge_in_progress:0\r\n") {
+            c.Assert(strings.Contains(status, "merge0:"), Equals, true)
+            c.Assert(strings.Contains(status, "trigger=manual"), Equals, true)
+            break
+        }
+        c.Assert(i < 100, Equals, true)
+        time.Sleep(50 * time.Millisecond)
+    }
+    nc.checkError(c, "the storage can't abort a running merge", "merge", "abort")
+    nc.checkString(c, "2", "get", "merge:a")
+}
+
+func (s *testMergeSuite) TestUnsupportedConfig(c *C) {
+    config := DefaultConfig()
+    config.Listen = 18040
+    config.Dbpath = c.MkDir()
+    config.MergeRateLimit = 1 << 20
+    _, err := NewServer(config)
+    c.Assert(err, Equals, errMergeNoThrottle)
+
+    config.MergeRateLimit = 0
+    config.AutoMerge = true
+    config.MergeDeadBytesRatio = 0.5
+    _, err = NewServer(config)
+    c.Assert(err, Equals, errMergeNoDeadBytes)
+}
@@ -0,0 +1,252 @@
+package bitserver
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/reborndb/go/atomic2"
+)
+
+// upper bounds in seconds of the command latency histogram
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type commandStat struct {
+    calls   atomic2.Int64
+    failed  atomic2.Int64
+    usec    atomic2.Int64
+    // not cumulative, buckets[len(latencyBuckets)] counts calls above the last bound
+    buckets []atomic2.Int64
+}
+
+func (s *Server) initCommandStats() {
+    s.cmdstats = make(map[string]*commandStat)
+    for name, _ := range s.htable {
+        s.cmdstats[name] = &commandStat{
+            buckets: make([]atomic2.Int64, len(latencyBuckets) + 1),
+        }
+    }
+}
+
+func (s *Server) commandStatAdd(name string, d time.Duration, failed bool) {
+    st := s.cmdstats[name]
+    if st == nil {
+        return
+    }
+    st.calls.Incr()
+    if failed {
+        st.failed.Incr()
+    }
+    st.usec.Add(int64(d / time.Microsecond))
+    i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+    st.buckets[i].Incr()
+}
+
+// deadBytesCounter is implemented by storages counting bytes of dead records
+type deadBytesCounter interface {
+    DeadBytes() int64
+}
+
+type storageStats struct {
+    files       int64
+    bytes       int64
+    // -1 if the storage can't tell
+    deadBytes   int64
+}
+
+// storageStats stats data-files, GetFileMetas would hash them on every scrape
+func (s *Server) storageStats() storageStats {
+    st := storageStats{deadBytes: -1}
+    for _, fileId := range dataFileIds(s.bc) {
+        if fi, err := os.Stat(s.bc.GetDataFilePath(fileId)); err == nil {
+            st.files++
+            st.bytes += fi.Size()
+        }
+    }
+    if dc, ok := interface{}(s.bc).(deadBytesCounter); ok {
+        st.deadBytes = dc.DeadBytes()
+    }
+    return st
+}
+
+// slaveLag returns bytes of data-files not yet sent to slave c
+func (s *Server) slaveLag(c *conn) int64 {
+    bc := s.bc
+    activeFileId := bc.ActiveFileId()
+    syncFileId, syncOffset := c.syncFileId.Get(), c.syncOffset.Get()
+    var lag int64
+    for fileId := syncFileId; fileId <= activeFileId; fileId = bc.NextDataFileId(fileId) {
+        if fi, err := os.Stat(bc.GetDataFilePath(fileId)); err == nil {
+            lag += fi.Size()
+        }
+        if fileId == syncFileId {
+            lag -= syncOffset
+        }
+        if fileId == activeFileId {
+            break
+        }
+    }
+    if lag < 0 {
+        lag = 0
+    }
+    return lag
+}
+
+// ready tells whether the server can serve reads,
+// a slave is not ready until its initial BSYNC caught up with master
+func (s *Server) ready() bool {
+    if s.repl.masterAddr.Get() == "" {
+        return true
+    }
+    return s.repl.masterConnState.Get() == masterStateConnected
+}
+
+type metricsWriter struct {
+    bytes.Buffer
+}
+
+func (w *metricsWriter) header(name string, typ string, help string) {
+    fmt.Fprintf(w, "# HELP bitserver_%s %s\n# TYPE bitserver_%s %s\n", name, help, name, typ)
+}
+
+func (w *metricsWriter) metric(name string, labels string, v interface{}) {
+    if labels != "" {
+        fmt.Fprintf(w, "bitserver_%s{%s} %v\n", name, labels, v)
+    } else {
+        fmt.Fprintf(w, "bitserver_%s %v\n", name, v)
+    }
+}
+
+func (w *metricsWriter) one(name string, typ string, help string, v interface{}) {
+    w.header(name, typ, help)
+    w.metric(name, "", v)
+}
+
+func (s *Server) writeMetrics(w *metricsWriter) {
+    w.one("uptime_seconds", "gauge", "Seconds since the server started.", int64(time.Since(s.startTime).Seconds()))
+
+    // connections
+    w.one("connected_clients", "gauge", "Number of connected clients.", s.counters.clients.Get())
+    w.one("rejected_connections_total", "counter", "Connections rejected by maxclients.", s.counters.rejectedConns.Get())
+    w.header("listener_accepted_total", "counter", "Connections accepted per listener.")
+    for _, l := range s.listeners {
+        w.metric("listener_accepted_total", fmt.Sprintf("listener=%q", l.name), l.accepted.Get())
+    }
+    w.header("listener_connected", "gauge", "Connected clients per listener.")
+    for _, l := range s.listeners {
+        w.metric("listener_connected", fmt.Sprintf("listener=%q", l.name), l.connected.Get())
+    }
+
+    // commands
+    names := make([]string, 0, len(s.cmdstats))
+    for name, _ := range s.cmdstats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    w.header("commands_total", "counter", "Commands processed per command.")
+    for _, name := range names {
+        w.metric("commands_total", fmt.Sprintf("cmd=%q", name), s.cmdstats[name].calls.Get())
+    }
+    w.header("commands_failed_total", "counter", "Commands failed per command.")
+    for _, name := range names {
+        w.metric("commands_failed_total", fmt.Sprintf("cmd=%q", name), s.cmdstats[name].failed.Get())
+    }
+    w.header("command_duration_seconds", "histogram", "Command latency.")
+    for _, name := range names {
+        st := s.cmdstats[name]
+        if st.calls.Get() == 0 {
+            continue
+        }
+        var cum int64
+        for i, bound := range latencyBuckets {
+            cum += st.buckets[i].Get()
+            w.metric("command_duration_seconds_bucket", fmt.Sprintf("cmd=%q,le=%q", name, strconv.FormatFloat(bound, 'g', -1, 64)), cum)
+        }
+        cum += st.buckets[len(latencyBuckets)].Get()
+        w.metric("command_duration_seconds_bucket", fmt.Sprintf("cmd=%q,le=\"+Inf\"", name), cum)
+        w.metric("command_duration_seconds_sum", fmt.Sprintf("cmd=%q", name), float64(st.usec.Get()) / 1e6)
+        w.metric("command_duration_seconds_count", fmt.Sprintf("cmd=%q", name), cum)
+    }
+
+    // replication
+    w.one("ready", "gauge", "1 if the server is ready to serve reads.", boolToInt(s.ready()))
+    w.header("slave_lag_bytes", "gauge", "Bytes of data-files not yet sent to each slave.")
+    s.repl.RLock()
+    for slave, _ := range s.repl.slaves {
+        w.metric("slave_lag_bytes", fmt.Sprintf("slave=%q", slave.nc.RemoteAddr().String()), s.slaveLag(slave))
+    }
+    s.repl.RUnlock()
+
+    // migration
+    w.one("migrated_keys_total", "counter", "Keys migrated to other servers.", s.counters.mgrtKeys.Get())
+    w.one("migrate_batches_total", "counter", "Migration batches sent.", s.counters.mgrtBatches.Get())
+    w.one("migrate_errors_total", "counter", "Migration batches failed.", s.counters.mgrtErrors.Get())
+    w.one("restored_keys_total", "counter", "Keys restored from other servers.", s.counters.restoredKeys.Get())
+    w.one("expired_keys_total", "counter", "Keys deleted once their ttl passed.", s.counters.expiredKeys.Get())
+
+    // storage
+    st := s.storageStats()
+    w.one("data_files", "gauge", "Number of data-files.", st.files)
+    w.one("data_bytes", "gauge", "Total size of data-files.", st.bytes)
+    if st.deadBytes >= 0 {
+        w.one("dead_bytes", "gauge", "Bytes of data-files taken by overwritten or deleted records.", st.deadBytes)
+        ratio := 0.0
+        if st.bytes > 0 {
+            ratio = float64(st.deadBytes) / float64(st.bytes)
+        }
+        w.one("dead_bytes_ratio", "gauge", "Ratio of dead bytes in data-files.", ratio)
+    }
+    w.one("merge_runs_total", "counter", "Merges run.", s.counters.mergeRuns.Get())
+    w.one("merge_duration_seconds_total", "counter", "Total time spent merging.", float64(s.counters.mergeUsec.Get()) / 1e6)
+    w.one("last_merge_duration_seconds", "gauge", "Duration of the last merge.", float64(s.counters.lastMergeUsec.Get()) / 1e6)
+}
+
+func boolToInt(b bool) int {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func (s *Server) metricsHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+        var w metricsWriter
+        s.writeMetrics(&w)
+        rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        rw.Write(w.Bytes())
+    })
+    mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+        rw.Write([]byte("ok\n"))
+    })
+    mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+        if !s.ready() {
+            http.Error(rw, "not ready: syncing with master", http.StatusServiceUnavailable)
+            return
+        }
+        rw.Write([]byte("ok\n"))
+    })
+    return mux
+}
+
+func (s *Server) startMetrics() error {
+    if s.config.MetricsAddr == "" {
+        return nil
+    }
+    l, err := net.Listen("tcp", s.config.MetricsAddr)
+    if err != nil {
+        return err
+    }
+    s.metricsListener = l
+    s.goFunc(func() {
+        if err := http.Serve(l, s.metricsHandler()); err != nil {
+            s.logger.Printf("metrics server stopped, err = %s", err)
+        }
+    })
+    return nil
+}
@@ -0,0 +1,61 @@
+package bitserver
+
+import (
+    "io/ioutil"
+    "net/http"
+    "strings"
+    . "gopkg.in/check.v1"
+)
+
+type testMetricsSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testMetricsSuite{})
+
+func (s *testMetricsSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17860
+    config.Dbpath = c.MkDir()
+    config.MetricsAddr = "127.0.0.1:17861"
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testMetricsSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testMetricsSuite) get(c *C, path string) (int, string) {
+    rsp, err := http.Get("http://127.0.0.1:17861" + path)
+    c.Assert(err, IsNil)
+    defer rsp.Body.Close()
+    body, err := ioutil.ReadAll(rsp.Body)
+    c.Assert(err, IsNil)
+    return rsp.StatusCode, string(body)
+}
+
+func (s *testMetricsSuite) TestMetrics(c *C) {
+    s.s.checkOK(c, "set", "a", "1")
+    s.s.checkString(c, "1", "get", "a")
+
+    code, body := s.get(c, "/metrics")
+    c.Assert(code, Equals, http.StatusOK)
+    for _, expect := range []string{
+        "bitserver_commands_total{cmd=\"set\"} 1\n",
+        "bitserver_command_duration_seconds_count{cmd=\"get\"} 1\n",
+        "bitserver_command_duration_seconds_bucket{cmd=\"get\",le=\"+Inf\"} 1\n",
+        "# TYPE bitserver_data_files gauge\n",
+        "bitserver_ready 1\n",
+    } {
+        c.Assert(strings.Contains(body, expect), Equals, true, Commentf("missing %q", expect))
+    }
+}
+
+func (s *testMetricsSuite) TestHealth(c *C) {
+    code, _ := s.get(c, "/healthz")
+    c.Assert(code, Equals, http.StatusOK)
+    code, _ = s.get(c, "/readyz")
+    c.Assert(code, Equals, http.StatusOK)
+}
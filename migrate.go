@@ -1,163 +1,61 @@
 package bitserver
 
 import (
-    "container/list"
-    "net"
-    "bufio"
-    "time"
-    "log"
     "fmt"
     "sync"
+    "time"
 
     redis "github.com/reborndb/go/redis/resp"
-    "github.com/rocket323/bitcask"
+    "github.com/rocket323/bitserver/client"
 )
 
-var mgrtPoolMap struct {
-    m map[string]*list.List
-    sync.Mutex
-}
-
-type mgrtConn struct {
-    summ string
-    nc net.Conn
-    last time.Time
-    err error
-    r *bufio.Reader
-    w *bufio.Writer
-}
-
-func (c *mgrtConn) encodeResp(resp redis.Resp, timeout time.Duration) error {
-    if err := c.nc.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-        return err
-    }
-    if err := redis.Encode(c.w, resp); err != nil {
-        return err
-    }
-    return c.w.Flush()
-}
-
-func (c *mgrtConn) decodeResp(timeout time.Duration) (redis.Resp, error) {
-    if err := c.nc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-        return nil, err
-    }
-    return redis.Decode(c.r)
-}
-
-func (c *mgrtConn) Do(cmd *redis.Array, timeout time.Duration) (redis.Resp, error) {
-    if c.err != nil {
-        return nil, c.err
-    }
-    if err := c.encodeResp(cmd, timeout); err != nil {
-        c.err = err
-        log.Printf("encode resp failed, err = %s", err)
-        return nil, err
-    }
-    if rsp, err := c.decodeResp(timeout); err != nil {
-        c.err = err
-        log.Printf("decode resp failed, err = %s", err)
-        return nil, err
-    } else {
-        c.last = time.Now()
-        return rsp, nil
-    }
-}
-
-func (c *mgrtConn) DoMustOK(cmd *redis.Array, timeout time.Duration) error {
-    if rsp, err := c.Do(cmd, timeout); err != nil {
-        return err
-    } else {
-        s, ok := rsp.(*redis.String)
-        if ok {
-            if s.Value == "OK" {
-                return nil
-            }
-            c.err = fmt.Errorf("not ok, got %s", s.Value)
-        } else {
-            c.err = fmt.Errorf("not string response, got %v", rsp.Type())
-        }
-        return c.err
-    }
-}
-
-func (c *mgrtConn) String() string {
-    return c.summ
-}
-
 const maxConnIdletime = 10 * time.Second
 
-func init() {
-    mgrtPoolMap.m = make(map[string]*list.List)
-    go func () {
-        time.Sleep(time.Second)
-        mgrtPoolMap.Lock()
-        for addr, pool := range mgrtPoolMap.m {
-            for i := pool.Len(); i != 0; i-- {
-                c := pool.Remove(pool.Front()).(*mgrtConn)
-                if time.Now().Before(c.last.Add(maxConnIdletime)) {
-                    pool.PushBack(c)
-                } else {
-                    c.nc.Close()
-                    log.Printf("close mgrt connection %s : %s", addr, c)
-                }
-            }
-            if pool.Len() != 0 {
-                continue
-            }
-            delete(mgrtPoolMap.m, addr)
-        }
-        mgrtPoolMap.Unlock()
-    }()
+// mgrtPools keeps connections to migration targets, one pool per address
+type mgrtPools struct {
+    sync.Mutex
+    m   map[string]*client.Pool
 }
 
-func getMgrtConn(addr string, timeout time.Duration) (*mgrtConn, error) {
-    mgrtPoolMap.Lock()
-    if pool := mgrtPoolMap.m[addr]; pool != nil && pool.Len() != 0 {
-        c := pool.Remove(pool.Front()).(*mgrtConn)
-        mgrtPoolMap.Unlock()
-        return c, nil
+func (s *Server) mgrtPool(addr string, timeout time.Duration) *client.Pool {
+    s.mgrt.Lock()
+    defer s.mgrt.Unlock()
+    if s.mgrt.m == nil {
+        s.mgrt.m = make(map[string]*client.Pool)
     }
-    mgrtPoolMap.Unlock()
-    nc, err := net.DialTimeout("tcp", addr, timeout)
-    if err != nil {
-        return nil, err
-    }
-
-    c := &mgrtConn{
-        summ: fmt.Sprintf("<local> %s -- %s <remote>", nc.LocalAddr(), nc.RemoteAddr()),
-        nc: nc,
-        last: time.Now(),
-        r: bufio.NewReader(nc),
-        w: bufio.NewWriter(nc),
+    p := s.mgrt.m[addr]
+    if p == nil {
+        p = client.NewPool(addr, &client.Options{
+            Dial: s.dial,
+            DialTimeout: timeout,
+            User: s.config.MasterUser,
+            Password: s.config.MasterAuth,
+            IdleTimeout: maxConnIdletime,
+        })
+        s.mgrt.m[addr] = p
     }
-    log.Printf("create mgrt connection %s: %s", addr, c)
-    return c, nil
+    return p
 }
 
-func putMgrtConn(addr string, c *mgrtConn) {
-    if c.err != nil {
-        c.nc.Close()
-        log.Printf("close err mgrt connection %s: %s, err = %s", addr, c, c.err)
-    } else {
-        mgrtPoolMap.Lock()
-        pool := mgrtPoolMap.m[addr]
-        if pool == nil {
-            pool = list.New()
-            mgrtPoolMap.m[addr] = pool
-        }
-        c.last = time.Now()
-        pool.PushFront(c)
-        mgrtPoolMap.Unlock()
+func (s *Server) closeMgrtPools() {
+    s.mgrt.Lock()
+    defer s.mgrt.Unlock()
+    for _, p := range s.mgrt.m {
+        p.Close()
     }
+    s.mgrt.m = nil
 }
 
-func doMigrate(bc *bitcask.BitCask, addr string, timeout time.Duration, keys ...[]byte) (int64, error) {
-    c, err := getMgrtConn(addr, timeout)
+func doMigrate(s *Server, addr string, timeout time.Duration, keys ...[]byte) (int64, error) {
+    bc := s.bc
+    pool := s.mgrtPool(addr, timeout)
+    c, err := pool.Get()
     if err != nil {
-        log.Printf("connect to %s failed, timeout = %d, err = %s", addr, timeout, err)
+        s.logger.Printf("connect to %s failed, timeout = %d, err = %s", addr, timeout, err)
         return 0, err
     }
-    defer putMgrtConn(addr, c)
+    defer pool.Put(c)
+    c.SetTimeout(timeout)
 
     cmd := redis.NewArray()
     cmd.AppendBulkBytes([]byte("slotsrestore"))
@@ -165,26 +63,39 @@ func doMigrate(bc *bitcask.BitCask, addr string, timeout time.Duration, keys ...
     for _, key := range keys {
         value, expr, err := bc.GetWithExpr(key)
         if err != nil {
-            log.Printf("mgrt key[%s] missing", key)
+            s.logger.Printf("mgrt key[%s] missing", key)
             continue
         }
+        // SLOTSRESTORE takes the ttl left in ms, 0 for none
+        var ttlms int64
+        if expr != 0 {
+            if ttlms = (int64(expr) - time.Now().Unix()) * 1000; ttlms <= 0 {
+                s.logger.Printf("mgrt key[%s] expired", key)
+                continue
+            }
+        }
         cmd.AppendBulkBytes(key)
-        cmd.AppendBulkBytes([]byte(fmt.Sprintf("%d", expr)))
+        cmd.AppendBulkBytes([]byte(fmt.Sprintf("%d", ttlms)))
         cmd.AppendBulkBytes(value)
         cnt++
     }
 
     if cnt == 0 {
-        log.Printf("no key to migrate")
+        s.logger.Printf("no key to migrate")
         return 0, nil
     }
 
-    if err := c.DoMustOK(cmd, timeout); err != nil {
-        log.Printf("command restore failed, addr = %s, len(keys) = %d, err = %s", addr, len(keys), err)
+    done := s.latencyTrack(latencyMigrateBatch)
+    err = client.OK(c.DoRequest(cmd))
+    done()
+    s.counters.mgrtBatches.Incr()
+    if err != nil {
+        s.counters.mgrtErrors.Incr()
+        s.logger.Printf("command restore failed, addr = %s, len(keys) = %d, err = %s", addr, len(keys), err)
         return 0, err
     } else {
         // log.Printf("command restore ok, addr = %s, cnt = %d", addr, cnt)
+        s.counters.mgrtKeys.Add(cnt)
         return cnt, nil
     }
 }
-
@@ -0,0 +1,192 @@
+package bitserver
+
+import (
+    "bytes"
+    "fmt"
+    "sync"
+    "time"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// lines queued per monitor, monitors that fall behind are dropped
+const monitorQueueLen = 4096
+
+// tags of traffic not coming from normal clients
+const (
+    monitorTagMigrate = "migrate"
+    monitorTagReplication = "replication"
+)
+
+type monitor struct {
+    c       *conn
+    ch      chan string
+}
+
+type monitors struct {
+    sync.RWMutex
+    m       map[*conn]*monitor
+    // number of monitors, so dispatch can skip formatting without locking
+    n       int64
+}
+
+// reprArg quotes arg as redis does for MONITOR
+func reprArg(buf *bytes.Buffer, arg []byte) {
+    buf.WriteByte('"')
+    for _, b := range arg {
+        switch b {
+        case '\\', '"':
+            buf.WriteByte('\\')
+            buf.WriteByte(b)
+        case '\n':
+            buf.WriteString("\\n")
+        case '\r':
+            buf.WriteString("\\r")
+        case '\t':
+            buf.WriteString("\\t")
+        case '\a':
+            buf.WriteString("\\a")
+        case '\b':
+            buf.WriteString("\\b")
+        default:
+            if b >= 0x20 && b < 0x7f {
+                buf.WriteByte(b)
+            } else {
+                fmt.Fprintf(buf, "\\x%02x", b)
+            }
+        }
+    }
+    buf.WriteByte('"')
+}
+
+func monitorLine(t time.Time, db int, tag string, addr string, cmd string, args [][]byte) string {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "%d.%06d [%d ", t.Unix(), t.Nanosecond() / 1000, db)
+    if tag != "" {
+        buf.WriteString(tag)
+        buf.WriteByte(' ')
+    }
+    buf.WriteString(addr)
+    buf.WriteString("] ")
+    reprArg(&buf, []byte(cmd))
+    for _, arg := range args {
+        buf.WriteByte(' ')
+        reprArg(&buf, arg)
+    }
+    return buf.String()
+}
+
+func (s *Server) addMonitor(c *conn) {
+    s.monitors.Lock()
+    defer s.monitors.Unlock()
+    if s.monitors.m == nil {
+        s.monitors.m = make(map[*conn]*monitor)
+    }
+    if _, ok := s.monitors.m[c]; ok {
+        return
+    }
+
+    m := &monitor{
+        c: c,
+        ch: make(chan string, monitorQueueLen),
+    }
+    s.monitors.m[c] = m
+    s.monitors.n++
+
+    s.goFunc(func() {
+        for line := range m.ch {
+            resp := redis.NewString(line)
+            c.unqueueOutput(resp)
+            if err := c.writeRESP(resp); err != nil {
+                s.logger.Printf("monitor %s lost, err = %s", c, err)
+                s.removeMonitor(c)
+                c.Close()
+                return
+            }
+        }
+    })
+}
+
+func (s *Server) removeMonitor(c *conn) {
+    s.monitors.Lock()
+    defer s.monitors.Unlock()
+    if m, ok := s.monitors.m[c]; ok {
+        delete(s.monitors.m, c)
+        s.monitors.n--
+        close(m.ch)
+    }
+}
+
+func (s *Server) isMonitor(c *conn) bool {
+    s.monitors.RLock()
+    defer s.monitors.RUnlock()
+    _, ok := s.monitors.m[c]
+    return ok
+}
+
+// feedMonitors sends a command to every monitor, without blocking
+func (s *Server) feedMonitors(db int, tag string, addr string, cmd string, args [][]byte) {
+    s.monitors.RLock()
+    if s.monitors.n == 0 {
+        s.monitors.RUnlock()
+        return
+    }
+    line := monitorLine(time.Now(), db, tag, addr, cmd, args)
+    resp := redis.NewString(line)
+    var slow []*conn
+    for c, m := range s.monitors.m {
+        if c.checkOutputLimit(respSize(resp)) != nil {
+            slow = append(slow, c)
+            continue
+        }
+        c.queueOutput(resp)
+        select {
+        case m.ch <- line:
+        default:
+            c.unqueueOutput(resp)
+            slow = append(slow, c)
+        }
+    }
+    s.monitors.RUnlock()
+
+    for _, c := range slow {
+        s.logger.Printf("drop monitor %s, output buffer overflow", c)
+        s.counters.monitorsDropped.Incr()
+        s.removeMonitor(c)
+        c.Close()
+    }
+}
+
+// hidesCredentials tells if command name may carry passwords in its args,
+// HELLO does with its AUTH option
+func hidesCredentials(name string) bool {
+    switch name {
+    case "auth", "acl", "hello":
+        return true
+    }
+    return false
+}
+
+// feedMonitorsFromConn feeds a command dispatched on conn c
+func (s *Server) feedMonitorsFromConn(c *conn, f *command, args [][]byte) {
+    if hidesCredentials(f.name) {
+        // never show credentials
+        return
+    }
+    switch f.name {
+    case "slotsrestore":
+        s.feedMonitors(int(c.db.Get()), monitorTagMigrate, c.nc.RemoteAddr().String(), f.name, args)
+    default:
+        s.feedMonitors(int(c.db.Get()), "", c.nc.RemoteAddr().String(), f.name, args)
+    }
+}
+
+// MONITOR
+func MonitorCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.addMonitor(c)
+    return redis.NewString("OK"), nil
+}
+
+func init() {
+    register(&command{name: "monitor", f: MonitorCmd, flag: CmdAdmin|CmdLoading|CmdStale|CmdNoScript|CmdNoMulti, arity: 1,
+        group: "server", summary: "Stream commands processed by the server"})
+}
@@ -0,0 +1,66 @@
+package bitserver
+
+import (
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testMonitorSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testMonitorSuite{})
+
+func (s *testMonitorSuite) SetUpSuite(c *C) {
+    s.s = testCreateServer(c, 17850, c.MkDir())
+}
+
+func (s *testMonitorSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testMonitorSuite) TestMonitorLine(c *C) {
+    t := time.Unix(1339518083, 107412000)
+    line := monitorLine(t, 0, "", "127.0.0.1:60866", "set", [][]byte{[]byte("k\"1"), []byte("a\r\n\x01")})
+    c.Assert(line, Equals, `1339518083.107412 [0 127.0.0.1:60866] "set" "k\"1" "a\r\n\x01"`)
+
+    line = monitorLine(t, 0, monitorTagMigrate, "127.0.0.1:60866", "slotsrestore", nil)
+    c.Assert(line, Equals, `1339518083.107412 [0 migrate 127.0.0.1:60866] "slotsrestore"`)
+}
+
+func (s *testMonitorSuite) TestMonitor(c *C) {
+    mc := testGetConn(c, s.s.port)
+    defer mc.Close()
+    mc.checkOK(c, "monitor")
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+
+    resp, err := mc.Receive()
+    c.Assert(err, IsNil)
+    line, ok := resp.(*redis.String)
+    c.Assert(ok, Equals, true)
+    c.Assert(line.Value, Matches, `[0-9]+\.[0-9]{6} \[0 127\.0\.0\.1:[0-9]+\] "set" "a" "1"`)
+}
+
+func (s *testMonitorSuite) TestMonitorHidesHello(c *C) {
+    mc := testGetConn(c, s.s.port)
+    defer mc.Close()
+    mc.checkOK(c, "monitor")
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.doCmd(c, "hello", 2, "setname", "secret")
+    nc.checkOK(c, "set", "b", "1")
+
+    // HELLO may carry AUTH, the first line seen is the SET
+    resp, err := mc.Receive()
+    c.Assert(err, IsNil)
+    line, ok := resp.(*redis.String)
+    c.Assert(ok, Equals, true)
+    c.Assert(line.Value, Matches, `[0-9]+\.[0-9]{6} \[0 127\.0\.0\.1:[0-9]+\] "set" "b" "1"`)
+}
@@ -0,0 +1,243 @@
+package bitserver
+
+import (
+    "sync"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type queuedCommand struct {
+    f       *command
+    args    [][]byte
+}
+
+// watchedKeys tracks versions of keys WATCHed by any conn.
+// Keys nobody watches are not tracked, a write to them costs one map lookup.
+type watchedKeys struct {
+    sync.Mutex
+    keys    map[string]*watchedKey
+    // bumped by writes whose keys are unknown, FLUSHALL and replication
+    flushes uint64
+}
+
+type watchedKey struct {
+    version uint64
+    // number of conns watching the key
+    refs    int
+}
+
+// touchKeys invalidates WATCHes and client side caches of keys, it's called
+// after every write
+func (s *Server) touchKeys(keys ...[]byte) {
+    s.invalidateKeys(keys...)
+    s.watch.Lock()
+    defer s.watch.Unlock()
+    for _, key := range keys {
+        if wk := s.watch.keys[string(key)]; wk != nil {
+            wk.version++
+        }
+    }
+}
+
+// touchAllKeys invalidates all WATCHes and client side caches
+func (s *Server) touchAllKeys() {
+    s.invalidateAllKeys()
+    s.watch.Lock()
+    defer s.watch.Unlock()
+    s.watch.flushes++
+}
+
+func (s *Server) watchKeys(c *conn, keys [][]byte) {
+    s.watch.Lock()
+    defer s.watch.Unlock()
+    if s.watch.keys == nil {
+        s.watch.keys = make(map[string]*watchedKey)
+    }
+    if c.watched == nil {
+        c.watched = make(map[string]uint64)
+        c.watchFlushes = s.watch.flushes
+    }
+    for _, key := range keys {
+        if _, ok := c.watched[string(key)]; ok {
+            continue
+        }
+        wk := s.watch.keys[string(key)]
+        if wk == nil {
+            wk = &watchedKey{}
+            s.watch.keys[string(key)] = wk
+        }
+        wk.refs++
+        c.watched[string(key)] = wk.version
+    }
+}
+
+func (s *Server) unwatchAll(c *conn) {
+    s.watch.Lock()
+    defer s.watch.Unlock()
+    for key, _ := range c.watched {
+        if wk := s.watch.keys[key]; wk != nil {
+            wk.refs--
+            if wk.refs <= 0 {
+                delete(s.watch.keys, key)
+            }
+        }
+    }
+    c.watched = nil
+}
+
+// watchDirty reports whether any key WATCHed by c was written since
+func (s *Server) watchDirty(c *conn) bool {
+    s.watch.Lock()
+    defer s.watch.Unlock()
+    if c.watched == nil {
+        return false
+    }
+    if c.watchFlushes != s.watch.flushes {
+        return true
+    }
+    for key, version := range c.watched {
+        if wk := s.watch.keys[key]; wk == nil || wk.version != version {
+            return true
+        }
+    }
+    return false
+}
+
+// queueable reports whether f is queued rather than run inside MULTI
+func (f *command) queueable() bool {
+    switch f.name {
+    case "multi", "exec", "discard", "watch", "unwatch", "quit":
+        return false
+    }
+    return true
+}
+
+func (c *conn) queueCommand(f *command, args [][]byte) (redis.Resp, error) {
+    if f.flag&CmdNoMulti != 0 {
+        c.multiAborted = true
+        return toRespErrorf("Command %s not allowed inside a transaction", f.name)
+    }
+    if c.s.config.CodisMode {
+        for _, key := range f.keys(args) {
+            _, slot := HashKeyToSlot(key)
+            if c.multiSlot == -1 {
+                c.multiSlot = int(slot)
+            } else if c.multiSlot != int(slot) {
+                c.multiAborted = true
+                return toRespErrorf("CROSSSLOT Keys in request don't hash to the same slot")
+            }
+        }
+    }
+    c.queued = append(c.queued, &queuedCommand{f: f, args: args})
+    return redis.NewString("QUEUED"), nil
+}
+
+// abortMulti makes EXEC fail after a command was rejected while queuing
+func (c *conn) abortMulti() {
+    if c.multi {
+        c.multiAborted = true
+    }
+}
+
+func (c *conn) discardMulti() {
+    c.multi = false
+    c.multiAborted = false
+    c.queued = nil
+    c.s.unwatchAll(c)
+}
+
+// MULTI
+func MultiCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if c.multi {
+        return toRespErrorf("MULTI calls can not be nested")
+    }
+    c.multi = true
+    c.multiAborted = false
+    c.multiSlot = -1
+    c.queued = nil
+    return redis.NewString("OK"), nil
+}
+
+// EXEC
+func ExecCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if !c.multi {
+        return toRespErrorf("EXEC without MULTI")
+    }
+    s := c.s
+    queued := c.queued
+    defer c.discardMulti()
+
+    if c.multiAborted {
+        return toRespErrorf("EXECABORT Transaction discarded because of previous errors.")
+    }
+
+    for _, q := range queued {
+        s.waitPause(q.f)
+    }
+
+    // no group commit is applied until the writes of the transaction,
+    // collected in txBatch, are committed as one batch
+    s.commitMu.Lock()
+    defer s.commitMu.Unlock()
+
+    // a null array, *-1 in RESP2 and _ in RESP3
+    if s.watchDirty(c) {
+        return &redis.Array{}, nil
+    }
+
+    c.txBatch = &writeBatch{}
+    // not nil, an empty transaction replies an empty array
+    resp := &redis.Array{Value: []redis.Resp{}}
+    for _, q := range queued {
+        r, _ := c.call(q.f, q.args)
+        resp.Append(r)
+    }
+    b := c.txBatch
+    c.txBatch = nil
+    if b.Len() > 0 {
+        if err := s.applyBatchesLocked(b); err != nil {
+            return toRespError(err)
+        }
+    }
+    return resp, nil
+}
+
+// DISCARD
+func DiscardCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if !c.multi {
+        return toRespErrorf("DISCARD without MULTI")
+    }
+    c.discardMulti()
+    return redis.NewString("OK"), nil
+}
+
+// WATCH key [key ...]
+func WatchCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    if c.multi {
+        return toRespErrorf("WATCH inside MULTI is not allowed")
+    }
+    keys := make([][]byte, len(args))
+    for i, key := range args {
+        keys[i] = c.dbKey(key)
+    }
+    c.s.watchKeys(c, keys)
+    return redis.NewString("OK"), nil
+}
+
+// UNWATCH
+func UnwatchCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.unwatchAll(c)
+    return redis.NewString("OK"), nil
+}
+
+func init() {
+    register(&command{name: "multi", f: MultiCmd, flag: CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: 1,
+        group: "transactions", summary: "Mark the start of a transaction block"})
+    register(&command{name: "exec", f: ExecCmd, flag: CmdLoading|CmdStale|CmdNoScript, arity: 1,
+        group: "transactions", summary: "Execute all commands issued after MULTI"})
+    register(&command{name: "discard", f: DiscardCmd, flag: CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: 1,
+        group: "transactions", summary: "Discard all commands issued after MULTI"})
+    register(&command{name: "watch", f: WatchCmd, flag: CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: -2, firstKey: 1, lastKey: -1, keyStep: 1,
+        group: "transactions", summary: "Watch keys to determine execution of the MULTI/EXEC block"})
+    register(&command{name: "unwatch", f: UnwatchCmd, flag: CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: 1,
+        group: "transactions", summary: "Forget about all watched keys"})
+}
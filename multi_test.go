@@ -0,0 +1,136 @@
+package bitserver
+
+import (
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testMultiSuite struct {
+    s *testSvrNode
+    codis *testSvrNode
+}
+
+var _ = Suite(&testMultiSuite{})
+
+func (s *testMultiSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17880
+    config.Dbpath = c.MkDir()
+    s.s = testCreateServerWithConfig(c, config)
+
+    config = DefaultConfig()
+    config.Listen = 17881
+    config.Dbpath = c.MkDir()
+    config.CodisMode = true
+    s.codis = testCreateServerWithConfig(c, config)
+}
+
+func (s *testMultiSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+    if s.codis != nil {
+        s.codis.Close()
+    }
+}
+
+func (s *testMultiSuite) TestExec(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "set", "{acct}a", "10")
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "{acct}a", "5")
+    nc.checkString(c, "QUEUED", "set", "{acct}b", "5")
+    nc.checkString(c, "QUEUED", "get", "{acct}a")
+    resp := nc.doCmd(c, "exec")
+    v, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(v.Value, HasLen, 3)
+    c.Assert(string(v.Value[2].(*redis.BulkBytes).Value), Equals, "5")
+    nc.checkString(c, "5", "get", "{acct}b")
+
+    nc.checkError(c, "EXEC without MULTI", "exec")
+    nc.checkOK(c, "multi")
+    nc.checkError(c, "MULTI calls can not be nested", "multi")
+    nc.checkString(c, "QUEUED", "set", "{acct}a", "0")
+    nc.checkOK(c, "discard")
+    nc.checkString(c, "5", "get", "{acct}a")
+}
+
+func (s *testMultiSuite) TestExecAbort(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "abort", "1")
+    nc.checkError(c, "wrong number of arguments.*", "get")
+    nc.checkError(c, "Command monitor not allowed inside a transaction", "monitor")
+    nc.checkError(c, "EXECABORT.*", "exec")
+    resp := nc.doCmd(c, "get", "abort")
+    c.Assert(resp.(*redis.BulkBytes).Value, IsNil)
+}
+
+func (s *testMultiSuite) TestWatch(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    other := testGetConn(c, s.s.port)
+    defer other.Close()
+
+    // untouched watch
+    nc.checkOK(c, "watch", "w")
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "w", "1")
+    resp := nc.doCmd(c, "exec")
+    c.Assert(resp, FitsTypeOf, (*redis.Array)(nil))
+
+    // written by another conn
+    nc.checkOK(c, "watch", "w")
+    other.checkOK(c, "set", "w", "2")
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "w", "3")
+    resp = nc.doCmd(c, "exec")
+    c.Assert(resp, FitsTypeOf, (*redis.Array)(nil))
+    c.Assert(resp.(*redis.Array).Value, IsNil)
+    nc.checkString(c, "2", "get", "w")
+
+    // written by slotsrestore
+    nc.checkOK(c, "watch", "w")
+    other.checkOK(c, "slotsrestore", "w", 0, "4")
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "w", "5")
+    resp = nc.doCmd(c, "exec")
+    c.Assert(resp, FitsTypeOf, (*redis.Array)(nil))
+    c.Assert(resp.(*redis.Array).Value, IsNil)
+
+    // unwatched
+    nc.checkOK(c, "watch", "w")
+    nc.checkOK(c, "unwatch")
+    other.checkOK(c, "set", "w", "6")
+    nc.checkOK(c, "multi")
+    nc.checkError(c, "WATCH inside MULTI is not allowed", "watch", "w")
+    nc.checkString(c, "QUEUED", "set", "w", "7")
+    resp = nc.doCmd(c, "exec")
+    c.Assert(resp, FitsTypeOf, (*redis.Array)(nil))
+    nc.checkString(c, "7", "get", "w")
+}
+
+func (s *testMultiSuite) TestCrossSlot(c *C) {
+    _, slotA := HashKeyToSlot([]byte("a"))
+    _, slotB := HashKeyToSlot([]byte("b"))
+    c.Assert(slotA, Not(Equals), slotB)
+
+    nc := testGetConn(c, s.codis.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "{t}a", "1")
+    nc.checkString(c, "QUEUED", "set", "{t}b", "1")
+    resp := nc.doCmd(c, "exec")
+    c.Assert(resp, FitsTypeOf, (*redis.Array)(nil))
+
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "a", "1")
+    nc.checkError(c, "CROSSSLOT.*", "set", "b", "1")
+    nc.checkError(c, "EXECABORT.*", "exec")
+}
@@ -0,0 +1,144 @@
+package bitserver
+
+import (
+    "fmt"
+    "strconv"
+)
+
+// classes of keyspace events, as letters of notify-keyspace-events
+const (
+    notifyKeyspace int64 = 1 << iota // K, on __keyspace@<db>__:<key>
+    notifyKeyevent                   // E, on __keyevent@<db>__:<event>
+    notifyGeneric                    // g, del and move
+    notifyString                     // $, set
+    notifyMigrated                   // M, keys deleted once migrated to another instance
+    notifyRestored                   // R, keys written by SLOTSRESTORE
+    notifyExpired                    // x, keys deleted once their ttl passed
+
+    // A, every class of event
+    notifyAll = notifyGeneric|notifyString|notifyMigrated|notifyRestored|notifyExpired
+)
+
+// letters of notify-keyspace-events besides A
+var notifyFlagLetters = []struct {
+    flag    int64
+    letter  byte
+}{
+    {notifyKeyspace, 'K'},
+    {notifyKeyevent, 'E'},
+    {notifyGeneric, 'g'},
+    {notifyString, '$'},
+    {notifyMigrated, 'M'},
+    {notifyRestored, 'R'},
+    {notifyExpired, 'x'},
+}
+
+// parseNotifyFlags parses notify-keyspace-events, e.g. "KEA" or "Kg$M"
+func parseNotifyFlags(s string) (int64, error) {
+    var flags int64
+    for i := 0; i < len(s); i++ {
+        if s[i] == 'A' {
+            flags |= notifyAll
+            continue
+        }
+        // keys are never evicted, there are no such events
+        if s[i] == 'e' {
+            return 0, fmt.Errorf("notify-keyspace-events class '%c' is not supported", s[i])
+        }
+        found := false
+        for _, fl := range notifyFlagLetters {
+            if s[i] == fl.letter {
+                flags |= fl.flag
+                found = true
+                break
+            }
+        }
+        if !found {
+            return 0, fmt.Errorf("invalid notify-keyspace-events '%s'", s)
+        }
+    }
+    // events are sent nowhere without K or E
+    if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+        return 0, nil
+    }
+    return flags, nil
+}
+
+func notifyFlagsString(flags int64) string {
+    var buf []byte
+    for _, fl := range notifyFlagLetters {
+        if flags&notifyAll == notifyAll && fl.flag&notifyAll != 0 {
+            continue
+        }
+        if flags&fl.flag != 0 {
+            buf = append(buf, fl.letter)
+        }
+    }
+    if flags&notifyAll == notifyAll {
+        buf = append(buf, 'A')
+    }
+    return string(buf)
+}
+
+func (s *Server) initNotify() error {
+    flags, err := parseNotifyFlags(s.config.NotifyKeyspaceEvents)
+    if err != nil {
+        return err
+    }
+    s.notifyFlags.Set(flags)
+    return nil
+}
+
+// keyEvent is published once the batch it belongs to is applied
+type keyEvent struct {
+    class   int64
+    event   string
+    // stored key, its db is decoded when publishing
+    key     []byte
+}
+
+// notify adds an event on the stored key to b
+func (b *writeBatch) notify(class int64, event string, key []byte) {
+    b.events = append(b.events, keyEvent{class, event, key})
+}
+
+// notifyKeyspaceEvent publishes event on key, if its class is enabled
+func (s *Server) notifyKeyspaceEvent(class int64, event string, storedKey []byte) {
+    flags := s.notifyFlags.Get()
+    if flags&class == 0 {
+        return
+    }
+    db, key := decodeDbKey(storedKey)
+    prefix := "__keyspace@" + strconv.Itoa(db) + "__:"
+    if flags&notifyKeyspace != 0 {
+        s.publish(append([]byte(prefix), key...), []byte(event))
+    }
+    if flags&notifyKeyevent != 0 {
+        s.publish([]byte("__keyevent@" + strconv.Itoa(db) + "__:" + event), key)
+    }
+}
+
+func (s *Server) notifyBatches(batches []*writeBatch) {
+    if s.notifyFlags.Get() == 0 {
+        return
+    }
+    for _, b := range batches {
+        for _, e := range b.events {
+            s.notifyKeyspaceEvent(e.class, e.event, e.key)
+        }
+    }
+}
+
+// notifySyncRecords notifies the writes of records synced from master
+func (s *Server) notifySyncRecords(recs []Record) {
+    if s.notifyFlags.Get() == 0 {
+        return
+    }
+    for _, rec := range recs {
+        if rec.Deleted() {
+            s.notifyKeyspaceEvent(notifyGeneric, "del", rec.Key())
+        } else {
+            s.notifyKeyspaceEvent(notifyString, "set", rec.Key())
+        }
+    }
+}
@@ -0,0 +1,187 @@
+package bitserver
+
+import (
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testNotifySuite struct {
+    src *testSvrNode
+    dst *testSvrNode
+}
+
+var _ = Suite(&testNotifySuite{})
+
+func (s *testNotifySuite) SetUpSuite(c *C) {
+    for i, node := range []**testSvrNode{&s.src, &s.dst} {
+        config := DefaultConfig()
+        config.Listen = 18000 + i
+        config.Dbpath = c.MkDir()
+        config.Storage = StorageMemory
+        config.NotifyKeyspaceEvents = "KEA"
+        *node = testCreateServerWithConfig(c, config)
+    }
+}
+
+func (s *testNotifySuite) TearDownSuite(c *C) {
+    if s.src != nil {
+        s.src.Close()
+    }
+    if s.dst != nil {
+        s.dst.Close()
+    }
+}
+
+func (s *testNotifySuite) TestParseFlags(c *C) {
+    flags, err := parseNotifyFlags("KEA")
+    c.Assert(err, IsNil)
+    c.Assert(flags, Equals, notifyKeyspace|notifyKeyevent|notifyAll)
+    c.Assert(notifyFlagsString(flags), Equals, "KEA")
+
+    flags, err = parseNotifyFlags("Kg$M")
+    c.Assert(err, IsNil)
+    c.Assert(notifyFlagsString(flags), Equals, "Kg$M")
+
+    // no K nor E means no event at all
+    flags, err = parseNotifyFlags("A")
+    c.Assert(err, IsNil)
+    c.Assert(flags, Equals, int64(0))
+
+    _, err = parseNotifyFlags("KZ")
+    c.Assert(err, NotNil)
+    _, err = parseNotifyFlags("Ke")
+    c.Assert(err, ErrorMatches, ".*'e' is not supported")
+    flags, err = parseNotifyFlags("Kx")
+    c.Assert(err, IsNil)
+    c.Assert(flags, Equals, notifyKeyspace|notifyExpired)
+}
+
+func (s *testNotifySuite) subscribe(c *C, port int, pattern string) *testConn {
+    nc := testGetConn(c, port)
+    c.Assert(nc.Send("psubscribe", pattern), IsNil)
+    c.Assert(nc.Flush(), IsNil)
+    _, err := nc.Receive()
+    c.Assert(err, IsNil)
+    return nc
+}
+
+func (s *testNotifySuite) expect(c *C, nc *testConn, pattern string, channel string, message string) {
+    resp, err := nc.Receive()
+    c.Assert(err, IsNil)
+    c.Assert(resp, DeepEquals, testStrings("pmessage", pattern, channel, message))
+}
+
+func (s *testNotifySuite) TestWrites(c *C) {
+    sub := s.subscribe(c, s.src.port, "__keyspace@*__:nk*")
+    defer sub.Close()
+
+    nc := testGetConn(c, s.src.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "nk1", "v")
+    nc.checkInt(c, 1, "del", "nk1", "nk2")
+    nc.checkOK(c, "set", "nk3", "v")
+    nc.checkInt(c, 1, "move", "nk3", 1)
+
+    p := "__keyspace@*__:nk*"
+    s.expect(c, sub, p, "__keyspace@0__:nk1", "set")
+    s.expect(c, sub, p, "__keyspace@0__:nk1", "del")
+    s.expect(c, sub, p, "__keyspace@0__:nk3", "set")
+    s.expect(c, sub, p, "__keyspace@0__:nk3", "move_from")
+    s.expect(c, sub, p, "__keyspace@1__:nk3", "move_to")
+
+    // only the generic class now
+    nc.checkOK(c, "config", "set", "notify-keyspace-events", "Eg")
+    c.Assert(nc.doCmd(c, "config", "get", "notify-keyspace-events"), DeepEquals, testStrings("notify-keyspace-events", "gE"))
+    ev := s.subscribe(c, s.src.port, "__keyevent@0__:*")
+    defer ev.Close()
+    nc.checkOK(c, "set", "nk4", "v")
+    nc.checkInt(c, 1, "del", "nk4")
+    s.expect(c, ev, "__keyevent@0__:*", "__keyevent@0__:del", "nk4")
+    nc.checkOK(c, "config", "set", "notify-keyspace-events", "KEA")
+}
+
+func (s *testNotifySuite) TestMigration(c *C) {
+    p := "__keyevent@0__:*"
+    src := s.subscribe(c, s.src.port, p)
+    defer src.Close()
+    dst := s.subscribe(c, s.dst.port, p)
+    defer dst.Close()
+
+    nc := testGetConn(c, s.src.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "{mk}1", "v")
+    nc.checkInt(c, 1, "slotsmgrtone", "127.0.0.1", s.dst.port, 1000, "{mk}1")
+
+    s.expect(c, src, p, "__keyevent@0__:set", "{mk}1")
+    s.expect(c, src, p, "__keyevent@0__:migrated", "{mk}1")
+    s.expect(c, dst, p, "__keyevent@0__:restored", "{mk}1")
+}
+
+func (s *testNotifySuite) TestExpired(c *C) {
+    p := "__keyevent@0__:*"
+    sub := s.subscribe(c, s.src.port, p)
+    defer sub.Close()
+
+    // a ttl of 1ms expires by the next second
+    nc := testGetConn(c, s.src.port)
+    defer nc.Close()
+    nc.checkOK(c, "slotsrestore", "xk1", 1, "v")
+    s.expect(c, sub, p, "__keyevent@0__:restored", "xk1")
+    s.expect(c, sub, p, "__keyevent@0__:expired", "xk1")
+    c.Assert(nc.doCmd(c, "get", "xk1"), DeepEquals, redis.NewBulkBytes(nil))
+}
+
+type testNotifyReplSuite struct {
+    master *testSvrNode
+    slave  *testSvrNode
+}
+
+var _ = Suite(&testNotifyReplSuite{})
+
+func (s *testNotifyReplSuite) SetUpSuite(c *C) {
+    for i, node := range []**testSvrNode{&s.master, &s.slave} {
+        config := DefaultConfig()
+        config.Listen = 18020 + i
+        config.Dbpath = c.MkDir()
+        config.NotifyKeyspaceEvents = "KEA"
+        *node = testCreateServerWithConfig(c, config)
+    }
+}
+
+func (s *testNotifyReplSuite) TearDownSuite(c *C) {
+    if s.master != nil {
+        s.master.Close()
+    }
+    if s.slave != nil {
+        s.slave.Close()
+    }
+}
+
+func (s *testNotifyReplSuite) TestSlaveEvents(c *C) {
+    p := "__keyspace@*__:*rk*"
+    ns := &testNotifySuite{}
+    sub := ns.subscribe(c, s.slave.port, p)
+    defer sub.Close()
+
+    s.slave.checkOK(c, "slaveof", "127.0.0.1", s.master.port)
+    defer s.slave.checkOK(c, "slaveof", "no", "one")
+    for i := 0; i < 200 && s.slave.svr.repl.masterConnState.Get() != masterStateConnected; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    s.master.checkOK(c, "set", "rk1", "v")
+    s.master.checkInt(c, 1, "del", "rk1")
+    nc := testGetConn(c, s.master.port)
+    defer nc.Close()
+    nc.checkOK(c, "multi")
+    nc.checkString(c, "QUEUED", "set", "{rk}2", "v")
+    nc.checkString(c, "QUEUED", "set", "{rk}3", "v")
+    nc.doCmd(c, "exec")
+
+    // writes applied through replication are told on the slave, with their keys
+    ns.expect(c, sub, p, "__keyspace@0__:rk1", "set")
+    ns.expect(c, sub, p, "__keyspace@0__:rk1", "del")
+    ns.expect(c, sub, p, "__keyspace@0__:{rk}2", "set")
+    ns.expect(c, sub, p, "__keyspace@0__:{rk}3", "set")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "flag"
+    "log"
+    "github.com/rocket323/bitserver"
+)
+
+/*
+    point-in-time restore, offline:
+
+    bit-pitr -base <backup> -archive <archive-dir> -db <fresh-db> -target <fileId:offset|unixtime|RFC3339>
+
+    restores the base backup, then replays archived data-files up to the target
+*/
+
+var (
+    base string
+    archiveDir string
+    dbpath string
+    target string
+)
+
+func init() {
+    flag.StringVar(&base, "base", "", "base backup taken by BACKUP or BGSAVE")
+    flag.StringVar(&archiveDir, "archive", "", "archive directory of the server, see -archive-dir")
+    flag.StringVar(&dbpath, "db", "", "empty db path to restore into")
+    flag.StringVar(&target, "target", "", "stop at fileId:offset, a unix timestamp or an RFC3339 time")
+}
+
+func main() {
+    flag.Parse()
+
+    log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+    if base == "" || archiveDir == "" || dbpath == "" || target == "" {
+        flag.Usage()
+        log.Fatal("-base, -archive, -db and -target are required")
+    }
+    t, err := bitserver.ParseRestoreTarget(target)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if err := bitserver.RestorePointInTime(base, archiveDir, dbpath, t); err != nil {
+        log.Fatalf("restore failed, err=%s", err)
+    }
+    log.Printf("restored into %s", dbpath)
+}
@@ -0,0 +1,318 @@
+package bitserver
+
+import (
+    "sort"
+    "strings"
+    "sync"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// messages queued per subscriber, subscribers that fall behind are dropped
+const pubsubQueueLen = 4096
+
+type pubsub struct {
+    sync.RWMutex
+    // subscribers of each channel and pattern
+    channels map[string]map[*conn]struct{}
+    patterns map[string]map[*conn]struct{}
+    // conns tracking each stored key, see CLIENT TRACKING
+    tracking map[string]map[*conn]struct{}
+}
+
+// subscriber is the pub/sub state of a conn. Once a conn subscribed, all its
+// output goes through ch, written by its own goroutine, so publishers never
+// wait for the conn's wLock and replies stay ordered with messages.
+type subscriber struct {
+    ch      chan redis.Resp
+    // closed once ch is drained and closed
+    done    chan struct{}
+    // guarded by s.pubsub
+    channels map[string]struct{}
+    patterns map[string]struct{}
+    // CLIENT TRACKING is on, and the stored keys read since
+    tracking bool
+    tracked map[string]struct{}
+    closed  bool
+}
+
+// subscriptions returns the number of channels and patterns c subscribed to
+func (c *conn) subscriptions() int64 {
+    return c.subs.Get() + c.psubs.Get()
+}
+
+// reply queues the reply of a request, behind messages if c is a subscriber
+func (c *conn) reply(resp redis.Resp) error {
+    if c.sub != nil {
+        c.queueOutput(resp)
+        c.sub.ch <- resp
+        return nil
+    }
+    return c.bufferRESP(resp)
+}
+
+// subscriber returns the subscriber of c, starting its writer on first use
+func (s *Server) subscriber(c *conn) *subscriber {
+    if c.sub != nil {
+        return c.sub
+    }
+    sub := &subscriber{
+        ch: make(chan redis.Resp, pubsubQueueLen),
+        done: make(chan struct{}),
+        channels: make(map[string]struct{}),
+        patterns: make(map[string]struct{}),
+        tracked: make(map[string]struct{}),
+    }
+    c.sub = sub
+
+    s.goFunc(func() {
+        defer close(sub.done)
+        var err error
+        for resp := range sub.ch {
+            c.unqueueOutput(resp)
+            // keep draining after an error, the conn may still queue replies
+            if err != nil {
+                continue
+            }
+            c.wLock.Lock()
+            err = encodeResp(c.w, resp, int(c.proto.Get()))
+            if err == nil {
+                c.bufferedOutput()
+            }
+            if err == nil && len(sub.ch) == 0 {
+                err = c.flushLocked()
+            }
+            c.wLock.Unlock()
+            if err != nil {
+                s.logger.Printf("subscriber %s lost, err = %s", c, err)
+                c.Close()
+            }
+        }
+    })
+    return sub
+}
+
+// push queues resp to a subscriber without blocking, s.pubsub must be held.
+// A subscriber whose queue is full or over its output limits is closed.
+func (s *Server) push(c *conn, resp redis.Resp) bool {
+    if err := c.checkOutputLimit(respSize(resp)); err != nil {
+        s.logger.Printf("drop subscriber %s, err = %s", c, err)
+        s.counters.obufLimitDisconnections.Incr()
+        c.Close()
+        return false
+    }
+    c.queueOutput(resp)
+    select {
+    case c.sub.ch <- resp:
+        return true
+    default:
+        c.unqueueOutput(resp)
+        s.logger.Printf("drop subscriber %s, buffer overflow", c)
+        s.counters.subscribersDropped.Incr()
+        c.Close()
+        return false
+    }
+}
+
+// removeSubscriber unsubscribes c from everything and closes its queue
+func (s *Server) removeSubscriber(c *conn) {
+    sub := c.sub
+    if sub == nil {
+        return
+    }
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    if sub.closed {
+        return
+    }
+    for channel, _ := range sub.channels {
+        s.unsubscribeLocked(s.pubsub.channels, channel, c)
+    }
+    for pattern, _ := range sub.patterns {
+        s.unsubscribeLocked(s.pubsub.patterns, pattern, c)
+    }
+    s.untrackLocked(c)
+    sub.closed = true
+    close(sub.ch)
+}
+
+func (s *Server) unsubscribeLocked(m map[string]map[*conn]struct{}, name string, c *conn) {
+    if conns := m[name]; conns != nil {
+        delete(conns, c)
+        if len(conns) == 0 {
+            delete(m, name)
+        }
+    }
+}
+
+// subscribe handles SUBSCRIBE and PSUBSCRIBE. Confirmations are queued under
+// the lock, so they come before any message of the new subscriptions.
+func (s *Server) subscribe(c *conn, names [][]byte, pattern bool) {
+    sub := s.subscriber(c)
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    m, own, kind := &s.pubsub.channels, sub.channels, "subscribe"
+    if pattern {
+        m, own, kind = &s.pubsub.patterns, sub.patterns, "psubscribe"
+    }
+    if *m == nil {
+        *m = make(map[string]map[*conn]struct{})
+    }
+    for _, name := range names {
+        if _, ok := own[string(name)]; !ok {
+            own[string(name)] = struct{}{}
+            if (*m)[string(name)] == nil {
+                (*m)[string(name)] = make(map[*conn]struct{})
+            }
+            (*m)[string(name)][c] = struct{}{}
+        }
+        c.subs.Set(int64(len(sub.channels)))
+        c.psubs.Set(int64(len(sub.patterns)))
+        if !s.push(c, newPush(kind, redis.NewBulkBytes(name), redis.NewInt(c.subscriptions()))) {
+            return
+        }
+    }
+}
+
+// unsubscribe handles UNSUBSCRIBE and PUNSUBSCRIBE, from all if names is empty
+func (s *Server) unsubscribe(c *conn, names [][]byte, pattern bool) {
+    sub := s.subscriber(c)
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    m, own, kind := s.pubsub.channels, sub.channels, "unsubscribe"
+    if pattern {
+        m, own, kind = s.pubsub.patterns, sub.patterns, "punsubscribe"
+    }
+    if len(names) == 0 {
+        for name, _ := range own {
+            names = append(names, []byte(name))
+        }
+        sort.Slice(names, func(i, j int) bool {
+            return string(names[i]) < string(names[j])
+        })
+    }
+    if len(names) == 0 {
+        s.push(c, newPush(kind, redis.NewBulkBytes(nil), redis.NewInt(c.subscriptions())))
+        return
+    }
+    for _, name := range names {
+        delete(own, string(name))
+        s.unsubscribeLocked(m, string(name), c)
+        c.subs.Set(int64(len(sub.channels)))
+        c.psubs.Set(int64(len(sub.patterns)))
+        if !s.push(c, newPush(kind, redis.NewBulkBytes(name), redis.NewInt(c.subscriptions()))) {
+            return
+        }
+    }
+}
+
+// publish sends message to subscribers of channel and of matching patterns,
+// returning the number of messages queued
+func (s *Server) publish(channel []byte, message []byte) int64 {
+    s.pubsub.RLock()
+    defer s.pubsub.RUnlock()
+    var n int64
+    for c, _ := range s.pubsub.channels[string(channel)] {
+        if s.push(c, newPush("message", redis.NewBulkBytes(channel), redis.NewBulkBytes(message))) {
+            n++
+        }
+    }
+    for pattern, conns := range s.pubsub.patterns {
+        if !globMatch([]byte(pattern), channel) {
+            continue
+        }
+        for c, _ := range conns {
+            if s.push(c, newPush("pmessage", redis.NewBulkBytesWithString(pattern), redis.NewBulkBytes(channel), redis.NewBulkBytes(message))) {
+                n++
+            }
+        }
+    }
+    return n
+}
+
+// allowedInSubscribe reports whether cmd may run on a RESP2 conn with subscriptions
+func allowedInSubscribe(cmd string) bool {
+    switch cmd {
+    case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ping", "quit", "reset":
+        return true
+    }
+    return false
+}
+
+// SUBSCRIBE channel [channel ...]
+func SubscribeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.subscribe(c, args, false)
+    return nil, nil
+}
+
+// UNSUBSCRIBE [channel ...]
+func UnsubscribeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.unsubscribe(c, args, false)
+    return nil, nil
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func PsubscribeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.subscribe(c, args, true)
+    return nil, nil
+}
+
+// PUNSUBSCRIBE [pattern ...]
+func PunsubscribeCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    c.s.unsubscribe(c, args, true)
+    return nil, nil
+}
+
+// PUBLISH channel message
+func PublishCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    return redis.NewInt(c.s.publish(args[0], args[1])), nil
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func PubsubCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    s.pubsub.RLock()
+    defer s.pubsub.RUnlock()
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "channels":
+        if len(args) > 2 {
+            return toRespErrorf("wrong number of arguments for 'pubsub channels' command")
+        }
+        var channels []string
+        for channel, _ := range s.pubsub.channels {
+            if len(args) == 1 || globMatch(args[1], []byte(channel)) {
+                channels = append(channels, channel)
+            }
+        }
+        sort.Strings(channels)
+        resp := redis.NewArray()
+        for _, channel := range channels {
+            resp.AppendBulkBytes([]byte(channel))
+        }
+        return resp, nil
+    case "numsub":
+        resp := newRespMap()
+        for _, channel := range args[1:] {
+            resp.Add(string(channel), redis.NewInt(int64(len(s.pubsub.channels[string(channel)]))))
+        }
+        return resp, nil
+    case "numpat":
+        return redis.NewInt(int64(len(s.pubsub.patterns))), nil
+    default:
+        return toRespErrorf("unknown PUBSUB subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "subscribe", f: SubscribeCmd, flag: CmdPubSub|CmdLoading|CmdStale|CmdNoScript|CmdNoMulti, arity: -2,
+        group: "pubsub", summary: "Listen for messages published to the given channels"})
+    register(&command{name: "unsubscribe", f: UnsubscribeCmd, flag: CmdPubSub|CmdLoading|CmdStale|CmdNoScript|CmdNoMulti, arity: -1,
+        group: "pubsub", summary: "Stop listening for messages posted to the given channels"})
+    register(&command{name: "psubscribe", f: PsubscribeCmd, flag: CmdPubSub|CmdLoading|CmdStale|CmdNoScript|CmdNoMulti, arity: -2,
+        group: "pubsub", summary: "Listen for messages published to channels matching the given patterns"})
+    register(&command{name: "punsubscribe", f: PunsubscribeCmd, flag: CmdPubSub|CmdLoading|CmdStale|CmdNoScript|CmdNoMulti, arity: -1,
+        group: "pubsub", summary: "Stop listening for messages posted to channels matching the given patterns"})
+    register(&command{name: "publish", f: PublishCmd, flag: CmdPubSub|CmdLoading|CmdStale|CmdFast, arity: 3,
+        group: "pubsub", summary: "Post a message to a channel"})
+    register(&command{name: "pubsub", f: PubsubCmd, flag: CmdPubSub|CmdLoading|CmdStale, arity: -2,
+        group: "pubsub", summary: "Inspect the state of the Pub/Sub subsystem"})
+}
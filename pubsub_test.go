@@ -0,0 +1,135 @@
+package bitserver
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testPubsubSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testPubsubSuite{})
+
+func (s *testPubsubSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17990
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testPubsubSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func testStrings(values ...interface{}) *redis.Array {
+    resp := redis.NewArray()
+    for _, v := range values {
+        switch x := v.(type) {
+        case int:
+            resp.AppendInt(int64(x))
+        case string:
+            resp.AppendBulkBytes([]byte(x))
+        }
+    }
+    return resp
+}
+
+func (s *testPubsubSuite) receive(c *C, nc *testConn) redis.Resp {
+    resp, err := nc.Receive()
+    c.Assert(err, IsNil)
+    return resp
+}
+
+func (s *testPubsubSuite) TestSubscribe(c *C) {
+    sc := testGetConn(c, s.s.port)
+    defer sc.Close()
+    pc := testGetConn(c, s.s.port)
+    defer pc.Close()
+
+    c.Assert(sc.Send("subscribe", "news", "sport"), IsNil)
+    c.Assert(sc.Flush(), IsNil)
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("subscribe", "news", 1))
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("subscribe", "sport", 2))
+    c.Assert(sc.Send("psubscribe", "n*"), IsNil)
+    c.Assert(sc.Flush(), IsNil)
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("psubscribe", "n*", 3))
+
+    pc.checkInt(c, 2, "publish", "news", "hello")
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("message", "news", "hello"))
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("pmessage", "n*", "news", "hello"))
+    pc.checkInt(c, 0, "publish", "other", "hello")
+
+    c.Assert(pc.doCmd(c, "pubsub", "channels"), DeepEquals, testStrings("news", "sport"))
+    c.Assert(pc.doCmd(c, "pubsub", "channels", "s*"), DeepEquals, testStrings("sport"))
+    c.Assert(pc.doCmd(c, "pubsub", "numsub", "news", "other"), DeepEquals, testStrings("news", 1, "other", 0))
+    pc.checkInt(c, 1, "pubsub", "numpat")
+
+    // only pub/sub commands are allowed while subscribed
+    c.Assert(sc.Send("get", "k"), IsNil)
+    c.Assert(sc.Send("ping"), IsNil)
+    c.Assert(sc.Flush(), IsNil)
+    c.Assert(s.receive(c, sc), FitsTypeOf, (*redis.Error)(nil))
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("pong", ""))
+
+    c.Assert(sc.Send("unsubscribe"), IsNil)
+    c.Assert(sc.Send("punsubscribe"), IsNil)
+    c.Assert(sc.Flush(), IsNil)
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("unsubscribe", "news", 2))
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("unsubscribe", "sport", 1))
+    c.Assert(s.receive(c, sc), DeepEquals, testStrings("punsubscribe", "n*", 0))
+
+    // back to normal mode, replies still come in order
+    sc.checkString(c, "PONG", "ping")
+    c.Assert(sc.doCmd(c, "get", "k"), DeepEquals, redis.NewBulkBytes(nil))
+    pc.checkInt(c, 0, "publish", "news", "hello")
+}
+
+func (s *testPubsubSuite) TestResp3Push(c *C) {
+    nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.s.port))
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    r := bufio.NewReader(nc)
+    w := bufio.NewWriter(nc)
+    send := func(cmd string, args ...interface{}) {
+        c.Assert(redis.Encode(w, redis.NewRequest(cmd, args...)), IsNil)
+        c.Assert(w.Flush(), IsNil)
+    }
+
+    send("hello", 3)
+    readRawReply(c, r)
+    send("subscribe", "r3")
+    c.Assert(readRawReply(c, r), Equals, ">3\r\n$9\r\nsubscribe\r\n$2\r\nr3\r\n:1\r\n")
+
+    // RESP3 subscribers may run any command
+    send("set", "r3key", "v")
+    c.Assert(readRawReply(c, r), Equals, "+OK\r\n")
+
+    pc := testGetConn(c, s.s.port)
+    defer pc.Close()
+    pc.checkInt(c, 1, "publish", "r3", "hi")
+    c.Assert(readRawReply(c, r), Equals, ">3\r\n$7\r\nmessage\r\n$2\r\nr3\r\n$2\r\nhi\r\n")
+}
+
+func (s *testPubsubSuite) TestQuitWhileSubscribed(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    c.Assert(nc.Send("subscribe", "q"), IsNil)
+    c.Assert(nc.Send("quit"), IsNil)
+    c.Assert(nc.Flush(), IsNil)
+    c.Assert(s.receive(c, nc), DeepEquals, testStrings("subscribe", "q", 1))
+    c.Assert(s.receive(c, nc), DeepEquals, redis.NewString("OK"))
+    _, err := nc.Receive()
+    c.Assert(err, NotNil)
+
+    pc := testGetConn(c, s.s.port)
+    defer pc.Close()
+    pc.checkInt(c, 0, "publish", "q", "gone")
+}
@@ -0,0 +1,160 @@
+package bitserver
+
+import (
+    "encoding/binary"
+)
+
+// Values written by bitcaskStorage end with a trailer describing their record, so
+// records read back from data-files tell their key, time and commit group, which
+// bitcask records don't expose. An encoded record ends with its value, so the
+// trailer ends the record as well:
+//
+//     value | key | flags | expireAt | timestamp | len(key) | len(value) | recordMagic
+//
+// flags is one byte, the others are 4 byte little endian integers. Records without
+// a trailer, bitcask's tombstones and values of older versions, decode with a nil key.
+const recordMagic = "\xffbsrec1\xff"
+
+const recordTrailerSize = 1 + 4 + 4 + 4 + 4 + len(recordMagic)
+
+// flags of a record trailer
+const (
+    recordDeleted byte = 1 << iota
+    // the commit group goes on with the next record
+    recordMore
+)
+
+type recordMeta struct {
+    key         []byte
+    value       []byte
+    flags       byte
+    expireAt    uint32
+    // unix time the record was written at
+    timestamp   uint32
+}
+
+func encodeRecordValue(m *recordMeta) []byte {
+    buf := make([]byte, 0, len(m.value) + len(m.key) + recordTrailerSize)
+    buf = append(buf, m.value...)
+    buf = append(buf, m.key...)
+    buf = append(buf, m.flags)
+    var n [4]byte
+    for _, v := range []uint32{m.expireAt, m.timestamp, uint32(len(m.key)), uint32(len(m.value))} {
+        binary.LittleEndian.PutUint32(n[:], v)
+        buf = append(buf, n[:]...)
+    }
+    return append(buf, recordMagic...)
+}
+
+// decodeRecordValue decodes the trailer data ends with, data being a stored value
+// or a whole encoded record. Slices of the result point into data.
+func decodeRecordValue(data []byte) (*recordMeta, bool) {
+    if len(data) < recordTrailerSize || string(data[len(data) - len(recordMagic):]) != recordMagic {
+        return nil, false
+    }
+    t := data[len(data) - recordTrailerSize:]
+    m := &recordMeta{
+        flags: t[0],
+        expireAt: binary.LittleEndian.Uint32(t[1:]),
+        timestamp: binary.LittleEndian.Uint32(t[5:]),
+    }
+    keyLen := int64(binary.LittleEndian.Uint32(t[9:]))
+    valueLen := int64(binary.LittleEndian.Uint32(t[13:]))
+    end := int64(len(data) - recordTrailerSize)
+    if keyLen + valueLen > end {
+        return nil, false
+    }
+    m.key = data[end - keyLen:end]
+    m.value = data[end - keyLen - valueLen:end - keyLen]
+    return m, true
+}
+
+// dataRecord is a record of a bitcask data-file with its trailer decoded
+type dataRecord struct {
+    size    int64
+    data    []byte
+    // nil for records without trailer
+    meta    *recordMeta
+}
+
+func newDataRecord(size int64, data []byte) *dataRecord {
+    meta, _ := decodeRecordValue(data)
+    return &dataRecord{size: size, data: data, meta: meta}
+}
+
+func (r *dataRecord) Size() int64 {
+    return r.size
+}
+
+func (r *dataRecord) Encode() ([]byte, error) {
+    return r.data, nil
+}
+
+func (r *dataRecord) Key() []byte {
+    if r.meta == nil {
+        return nil
+    }
+    return r.meta.key
+}
+
+func (r *dataRecord) Value() []byte {
+    if r.meta == nil {
+        return nil
+    }
+    return r.meta.value
+}
+
+func (r *dataRecord) ExpireAt() uint32 {
+    if r.meta == nil {
+        return 0
+    }
+    return r.meta.expireAt
+}
+
+func (r *dataRecord) Timestamp() uint32 {
+    if r.meta == nil {
+        return 0
+    }
+    return r.meta.timestamp
+}
+
+func (r *dataRecord) Deleted() bool {
+    return r.meta != nil && r.meta.flags&recordDeleted != 0
+}
+
+func (r *dataRecord) More() bool {
+    return r.meta != nil && r.meta.flags&recordMore != 0
+}
+
+// recordGroup follows the commit groups of records read in order, so readers of
+// data-files see whole groups. A group may span data-files.
+type recordGroup struct {
+    inGroup bool
+    recs    []Record
+    // bitcask's tombstone expected next, after a delete
+    tombstone bool
+    // a record without trailer hid its key, a value of an older version
+    hidden  bool
+}
+
+// add takes the next record and returns the records of the group it ends. Records
+// without trailer, tombstones and older values, belong to the group around them
+// and are skipped.
+func (g *recordGroup) add(rec Record) []Record {
+    if rec.Key() == nil {
+        if !g.tombstone {
+            g.hidden = true
+        }
+        g.tombstone = false
+        return nil
+    }
+    g.recs = append(g.recs, rec)
+    g.inGroup = rec.More()
+    g.tombstone = rec.Deleted()
+    if g.inGroup {
+        return nil
+    }
+    recs := g.recs
+    g.recs = nil
+    return recs
+}
@@ -1,6 +1,11 @@
 package bitserver
 
 import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "net"
+    "os"
     "time"
     . "gopkg.in/check.v1"
     redis "github.com/reborndb/go/redis/resp"
@@ -69,3 +74,97 @@ func (s *testReplSuite) TestReplication(c *C) {
     slave.checkRole(c, "master")
 }
 
+
+func (s *testReplSuite) TestSyncCapa(c *C) {
+    capa, err := parseSyncCapa(nil)
+    c.Assert(err, IsNil)
+    c.Assert(capa, Equals, syncCapa(0))
+
+    capa, err = parseSyncCapa([][]byte{[]byte("CAPA"), []byte("marker"), []byte("capa"), []byte("future")})
+    c.Assert(err, IsNil)
+    c.Assert(capa, Equals, syncCapaMarker)
+
+    _, err = parseSyncCapa([][]byte{[]byte("capa")})
+    c.Assert(err, NotNil)
+}
+
+func (s *testReplSuite) TestSyncBatchGroups(c *C) {
+    svr := s.master.svr
+    fileId := svr.bc.ActiveFileId()
+    fi, err := os.Stat(svr.bc.GetDataFilePath(fileId))
+    c.Assert(err, IsNil)
+    start := fi.Size()
+
+    // a group bigger than syncBatchSize, then a small one
+    b := &writeBatch{}
+    big := bytes.Repeat([]byte("x"), 600 << 10)
+    for i := 0; i < 3; i++ {
+        b.Put([]byte(fmt.Sprintf("group:%d", i)), big)
+    }
+    c.Assert(svr.applyBatches(b), IsNil)
+    small := &writeBatch{}
+    small.Put([]byte("group:small"), []byte("1"))
+    c.Assert(svr.applyBatches(small), IsNil)
+    if svr.bc.ActiveFileId() != fileId {
+        c.Skip("the active data-file rotated")
+    }
+
+    // the batch goes past syncBatchSize up to the end of the group
+    _, next, eof, inGroup, err := svr.readSyncBatch(fileId, start, false)
+    c.Assert(err, IsNil)
+    c.Assert(eof, Equals, false)
+    c.Assert(inGroup, Equals, false)
+    var last Record
+    for offset := start; offset < next; {
+        rec, err := svr.bc.RefRecord(fileId, offset)
+        c.Assert(err, IsNil)
+        if rec.Key() != nil {
+            last = rec
+        }
+        offset += rec.Size()
+    }
+    c.Assert(string(last.Key()), Equals, "group:2")
+
+    _, _, eof, inGroup, err = svr.readSyncBatch(fileId, next, false)
+    c.Assert(err, IsNil)
+    c.Assert(eof, Equals, true)
+    c.Assert(inGroup, Equals, false)
+}
+
+func (s *testReplSuite) TestOldMaster(c *C) {
+    // a master predating BSYNC capabilities rejects them, then gets 3 args
+    l, err := net.Listen("tcp", "127.0.0.1:18050")
+    c.Assert(err, IsNil)
+    defer l.Close()
+    nargs := make(chan int, 2)
+    go func() {
+        for {
+            nc, err := l.Accept()
+            if err != nil {
+                return
+            }
+            resp, err := redis.Decode(bufio.NewReader(nc))
+            if req, ok := resp.(*redis.Array); err == nil && ok {
+                select {
+                case nargs <- len(req.Value):
+                default:
+                }
+                if len(req.Value) != 4 {
+                    nc.Write([]byte("-ERR wrong number of arguments for 'bsync' command\r\n"))
+                }
+            }
+            nc.Close()
+        }
+    }()
+
+    s.slave.checkOK(c, "slaveof", "127.0.0.1", 18050)
+    defer s.slave.checkOK(c, "slaveof", "no", "one")
+    for _, expect := range []int{8, 4} {
+        select {
+        case n := <-nargs:
+            c.Assert(n, Equals, expect)
+        case <-time.After(5 * time.Second):
+            c.Fatal("no BSYNC from the slave")
+        }
+    }
+}
@@ -0,0 +1,276 @@
+package bitserver
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// protocol versions of HELLO, RESP2 is the default
+const (
+    resp2 = 2
+    resp3 = 3
+)
+
+// RESP3 types, unknown to reborndb/go/redis/resp. They are downgraded for RESP2 connections.
+const (
+    TypeMap      redis.RespType = '%'
+    TypeSet      redis.RespType = '~'
+    TypeDouble   redis.RespType = ','
+    TypeBool     redis.RespType = '#'
+    TypeNull     redis.RespType = '_'
+    TypeVerbatim redis.RespType = '='
+    TypePush     redis.RespType = '>'
+)
+
+// respMap keeps keys and values in order, a flat array in RESP2
+type respMap struct {
+    Value []redis.Resp
+}
+
+// respSet is an array in RESP2
+type respSet struct {
+    Value []redis.Resp
+}
+
+// respDouble is a bulk string in RESP2
+type respDouble struct {
+    Value float64
+}
+
+// respBool is an integer 1 or 0 in RESP2
+type respBool struct {
+    Value bool
+}
+
+// respNull is a nil bulk string in RESP2
+type respNull struct{}
+
+// respVerbatim is a bulk string in RESP2, Format is "txt" or "mkd"
+type respVerbatim struct {
+    Format string
+    Value  []byte
+}
+
+// respPush is an out of band message, an array in RESP2
+type respPush struct {
+    Value []redis.Resp
+}
+
+func (*respMap) Type() redis.RespType      { return TypeMap }
+func (*respSet) Type() redis.RespType      { return TypeSet }
+func (*respDouble) Type() redis.RespType   { return TypeDouble }
+func (*respBool) Type() redis.RespType     { return TypeBool }
+func (*respNull) Type() redis.RespType     { return TypeNull }
+func (*respVerbatim) Type() redis.RespType { return TypeVerbatim }
+func (*respPush) Type() redis.RespType     { return TypePush }
+
+func newRespMap() *respMap {
+    return &respMap{}
+}
+
+// Add appends key as a bulk string, and its value
+func (m *respMap) Add(key string, value redis.Resp) {
+    m.Value = append(m.Value, redis.NewBulkBytesWithString(key), value)
+}
+
+func newVerbatim(text []byte) *respVerbatim {
+    return &respVerbatim{Format: "txt", Value: text}
+}
+
+func newPush(kind string, values ...redis.Resp) *respPush {
+    return &respPush{Value: append([]redis.Resp{redis.NewBulkBytesWithString(kind)}, values...)}
+}
+
+func formatDouble(f float64) string {
+    switch {
+    case math.IsInf(f, 1):
+        return "inf"
+    case math.IsInf(f, -1):
+        return "-inf"
+    case math.IsNaN(f):
+        return "nan"
+    }
+    return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// encodeResp writes r in protocol version proto
+func encodeResp(w *bufio.Writer, r redis.Resp, proto int) error {
+    switch x := r.(type) {
+    case *redis.String:
+        return writeLine(w, '+', x.Value)
+    case *redis.Error:
+        return writeLine(w, '-', x.Value)
+    case *redis.Int:
+        return writeLine(w, ':', strconv.FormatInt(x.Value, 10))
+    case *redis.BulkBytes:
+        if x.Value == nil {
+            return encodeNull(w, '$', proto)
+        }
+        return writeBulk(w, '$', x.Value)
+    case *redis.Array:
+        if x.Value == nil {
+            return encodeNull(w, '*', proto)
+        }
+        return encodeAggregate(w, '*', x.Value, proto)
+    case *respMap:
+        if proto < resp3 {
+            return encodeAggregate(w, '*', x.Value, proto)
+        }
+        if err := writeLine(w, '%', strconv.Itoa(len(x.Value) / 2)); err != nil {
+            return err
+        }
+        return encodeElems(w, x.Value, proto)
+    case *respSet:
+        if proto < resp3 {
+            return encodeAggregate(w, '*', x.Value, proto)
+        }
+        return encodeAggregate(w, '~', x.Value, proto)
+    case *respPush:
+        if proto < resp3 {
+            return encodeAggregate(w, '*', x.Value, proto)
+        }
+        return encodeAggregate(w, '>', x.Value, proto)
+    case *respDouble:
+        if proto < resp3 {
+            return writeBulk(w, '$', []byte(formatDouble(x.Value)))
+        }
+        return writeLine(w, ',', formatDouble(x.Value))
+    case *respBool:
+        if proto < resp3 {
+            if x.Value {
+                return writeLine(w, ':', "1")
+            }
+            return writeLine(w, ':', "0")
+        }
+        if x.Value {
+            return writeLine(w, '#', "t")
+        }
+        return writeLine(w, '#', "f")
+    case *respNull:
+        return encodeNull(w, '$', proto)
+    case *respVerbatim:
+        if proto < resp3 {
+            return writeBulk(w, '$', x.Value)
+        }
+        return writeBulk(w, '=', append([]byte(x.Format + ":"), x.Value...))
+    default:
+        return fmt.Errorf("can't encode resp type %T", r)
+    }
+}
+
+// encodeNull writes a null, typed by prefix in RESP2
+func encodeNull(w *bufio.Writer, prefix byte, proto int) error {
+    if proto < resp3 {
+        return writeLine(w, prefix, "-1")
+    }
+    return writeLine(w, '_', "")
+}
+
+func encodeAggregate(w *bufio.Writer, prefix byte, elems []redis.Resp, proto int) error {
+    if err := writeLine(w, prefix, strconv.Itoa(len(elems))); err != nil {
+        return err
+    }
+    return encodeElems(w, elems, proto)
+}
+
+func encodeElems(w *bufio.Writer, elems []redis.Resp, proto int) error {
+    for _, e := range elems {
+        if err := encodeResp(w, e, proto); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func writeLine(w *bufio.Writer, prefix byte, s string) error {
+    w.WriteByte(prefix)
+    w.WriteString(s)
+    _, err := w.WriteString("\r\n")
+    return err
+}
+
+func writeBulk(w *bufio.Writer, prefix byte, b []byte) error {
+    if err := writeLine(w, prefix, strconv.Itoa(len(b))); err != nil {
+        return err
+    }
+    w.Write(b)
+    _, err := w.WriteString("\r\n")
+    return err
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func HelloCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    s := c.s
+    proto := c.proto.Get()
+    if len(args) != 0 {
+        ver, err := strconv.ParseInt(string(args[0]), 10, 64)
+        if err != nil {
+            return toRespErrorf("Protocol version is not an integer or out of range")
+        }
+        if ver != resp2 && ver != resp3 {
+            return toRespErrorf("NOPROTO unsupported protocol version")
+        }
+        proto = ver
+    }
+
+    var user, pass, name []byte
+    for i := 1; i < len(args); i++ {
+        switch opt := strings.ToLower(string(args[i])); {
+        case opt == "auth" && i + 2 < len(args):
+            user, pass = args[i + 1], args[i + 2]
+            i += 2
+        case opt == "setname" && i + 1 < len(args):
+            name = args[i + 1]
+            if bytes.IndexAny(name, " \n") != -1 {
+                return toRespErrorf("Client names cannot contain spaces, newlines or special characters.")
+            }
+            i++
+        default:
+            return toRespErrorf("Syntax error in HELLO option '%s'", args[i])
+        }
+    }
+
+    if user != nil {
+        if err := s.aclAuth(string(user), string(pass)); err != nil {
+            return toRespError(err)
+        }
+        c.user.Set(string(user))
+    } else {
+        s.acl.RLock()
+        err := s.aclDefaultLogin(c)
+        s.acl.RUnlock()
+        if err != nil {
+            return toRespError(err)
+        }
+    }
+    if name != nil {
+        c.name.Set(string(name))
+    }
+    // the reply is encoded in the new version already
+    c.proto.Set(proto)
+
+    role := "master"
+    if s.repl.masterAddr.Get() != "" {
+        role = "slave"
+    }
+    resp := newRespMap()
+    resp.Add("server", redis.NewBulkBytesWithString("bitserver"))
+    resp.Add("version", redis.NewBulkBytesWithString(Version))
+    resp.Add("proto", redis.NewInt(proto))
+    resp.Add("id", redis.NewInt(c.id))
+    resp.Add("mode", redis.NewBulkBytesWithString("standalone"))
+    resp.Add("role", redis.NewBulkBytesWithString(role))
+    resp.Add("modules", &redis.Array{Value: []redis.Resp{}})
+    return resp, nil
+}
+
+func init() {
+    register(&command{name: "hello", f: HelloCmd, flag: CmdNoAuth|CmdFast|CmdLoading|CmdStale|CmdNoScript, arity: -1,
+        group: "connection", summary: "Handshake, choosing the protocol version and optionally authenticating"})
+}
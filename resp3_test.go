@@ -0,0 +1,150 @@
+package bitserver
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "strconv"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testResp3Suite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testResp3Suite{})
+
+func (s *testResp3Suite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17960
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testResp3Suite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+// readRawReply returns one reply as sent on the wire
+func readRawReply(c *C, r *bufio.Reader) string {
+    line, err := r.ReadString('\n')
+    c.Assert(err, IsNil)
+    n, _ := strconv.Atoi(line[1:len(line) - 2])
+    switch line[0] {
+    case '$', '=':
+        if n < 0 {
+            return line
+        }
+        data := make([]byte, n + 2)
+        _, err := io.ReadFull(r, data)
+        c.Assert(err, IsNil)
+        return line + string(data)
+    case '*', '~', '>', '%':
+        if line[0] == '%' {
+            n *= 2
+        }
+        for i := 0; i < n; i++ {
+            line += readRawReply(c, r)
+        }
+    }
+    return line
+}
+
+func (s *testResp3Suite) rawCmd(c *C, nc net.Conn, r *bufio.Reader, cmd string, args ...interface{}) string {
+    w := bufio.NewWriter(nc)
+    c.Assert(redis.Encode(w, redis.NewRequest(cmd, args...)), IsNil)
+    c.Assert(w.Flush(), IsNil)
+    return readRawReply(c, r)
+}
+
+func (s *testResp3Suite) TestHello(c *C) {
+    nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.s.port))
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    r := bufio.NewReader(nc)
+
+    c.Assert(s.rawCmd(c, nc, r, "hello", 4), Matches, "-NOPROTO.*\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "get", "missing"), Equals, "$-1\r\n")
+
+    reply := s.rawCmd(c, nc, r, "hello", 3, "setname", "r3")
+    c.Assert(reply, Matches, "(?s)%7\r\n\\$6\r\nserver\r\n\\$9\r\nbitserver\r\n.*\\$5\r\nproto\r\n:3\r\n.*")
+    c.Assert(s.rawCmd(c, nc, r, "get", "missing"), Equals, "_\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "config", "get", "appendfsync"), Equals, "%1\r\n$11\r\nappendfsync\r\n$8\r\neverysec\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "client", "info"), Matches, "(?s)=[0-9]+\r\ntxt:id=.* name=r3 .* resp=3\n\r\n")
+
+    c.Assert(s.rawCmd(c, nc, r, "hello", 2), Matches, "(?s)\\*14\r\n.*")
+    c.Assert(s.rawCmd(c, nc, r, "config", "get", "appendfsync"), Equals, "*2\r\n$11\r\nappendfsync\r\n$8\r\neverysec\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "hello", 3, "auth", "default", "wrong"), Matches, "-WRONGPASS.*\r\n")
+}
+
+func (s *testResp3Suite) TestTracking(c *C) {
+    nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.s.port))
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    r := bufio.NewReader(nc)
+
+    c.Assert(s.rawCmd(c, nc, r, "client", "tracking", "on"), Matches, "-.*RESP3.*\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "hello", 3), Matches, "(?s)%.*")
+    c.Assert(s.rawCmd(c, nc, r, "client", "tracking", "on"), Equals, "+OK\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "get", "tk"), Equals, "_\r\n")
+
+    // told once, until read again
+    s.s.checkOK(c, "set", "tk", "1")
+    s.s.checkOK(c, "set", "tk", "2")
+    c.Assert(readRawReply(c, r), Equals, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\ntk\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "get", "tk"), Equals, "$1\r\n2\r\n")
+
+    c.Assert(s.rawCmd(c, nc, r, "client", "tracking", "off"), Equals, "+OK\r\n")
+    s.s.checkOK(c, "set", "tk", "3")
+    c.Assert(s.rawCmd(c, nc, r, "get", "tk"), Equals, "$1\r\n3\r\n")
+}
+
+func (s *testResp3Suite) TestExecNull(c *C) {
+    nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.s.port))
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    r := bufio.NewReader(nc)
+
+    c.Assert(s.rawCmd(c, nc, r, "multi"), Equals, "+OK\r\n")
+    c.Assert(s.rawCmd(c, nc, r, "exec"), Equals, "*0\r\n")
+
+    // EXEC aborted by WATCH replies a null array
+    for _, proto := range []int{2, 3} {
+        c.Assert(s.rawCmd(c, nc, r, "hello", proto), Matches, "(?s)[*%].*")
+        c.Assert(s.rawCmd(c, nc, r, "watch", "nx"), Equals, "+OK\r\n")
+        s.s.checkOK(c, "set", "nx", proto)
+        c.Assert(s.rawCmd(c, nc, r, "multi"), Equals, "+OK\r\n")
+        c.Assert(s.rawCmd(c, nc, r, "get", "nx"), Equals, "+QUEUED\r\n")
+        if proto == 2 {
+            c.Assert(s.rawCmd(c, nc, r, "exec"), Equals, "*-1\r\n")
+        } else {
+            c.Assert(s.rawCmd(c, nc, r, "exec"), Equals, "_\r\n")
+        }
+    }
+}
+
+func (s *testResp3Suite) TestEncode(c *C) {
+    encode := func(resp redis.Resp, proto int) string {
+        var b bytes.Buffer
+        w := bufio.NewWriter(&b)
+        c.Assert(encodeResp(w, resp, proto), IsNil)
+        c.Assert(w.Flush(), IsNil)
+        return b.String()
+    }
+    c.Assert(encode(&respDouble{1.5}, resp3), Equals, ",1.5\r\n")
+    c.Assert(encode(&respDouble{math.Inf(-1)}, resp2), Equals, "$4\r\n-inf\r\n")
+    c.Assert(encode(&respBool{true}, resp3), Equals, "#t\r\n")
+    c.Assert(encode(&respBool{false}, resp2), Equals, ":0\r\n")
+    c.Assert(encode(&respNull{}, resp2), Equals, "$-1\r\n")
+    c.Assert(encode(&respSet{Value: []redis.Resp{redis.NewInt(1)}}, resp3), Equals, "~1\r\n:1\r\n")
+    c.Assert(encode(newPush("message", redis.NewBulkBytesWithString("a")), resp3), Equals, ">2\r\n$7\r\nmessage\r\n$1\r\na\r\n")
+    c.Assert(encode(newPush("message"), resp2), Equals, "*1\r\n$7\r\nmessage\r\n")
+    c.Assert(encode(&redis.Array{}, resp3), Equals, "_\r\n")
+}
@@ -1,29 +1,61 @@
 package bitserver
 
 import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "time"
     "sync"
-    "net"
     "fmt"
+    "net"
+    "strings"
     "log"
-    "github.com/rocket323/bitcask"
 
     "github.com/reborndb/go/atomic2"
     redis "github.com/reborndb/go/redis/resp"
 )
 
+// Version is reported by INFO and HELLO
+const Version = "0.1.0"
+
 type Server struct {
     mu          sync.Mutex
     runID       []byte
+    startTime   time.Time
 
-    bc          *bitcask.BitCask
+    bc          Storage
     config      *Config
     htable      map[string]*command
-    l           net.Listener
+    listeners   []*listener
+    metricsListener net.Listener
+    tlsConfig   *tls.Config
+    logger      *log.Logger
+    // closed by Close, stops background goroutines
     signal      chan int
+    // background goroutines and connections, Close waits for them
+    wg          sync.WaitGroup
+    serveOnce   sync.Once
+    closeOnce   sync.Once
+    // closed once all listeners stopped accepting
+    served      chan struct{}
 
     // conn mutex
     connMu      sync.Mutex
     conns       map[*conn]struct{}
+    connsClosed bool
+    nextConnId  atomic2.Int64
+    // conns accepted from listeners, reserved before they are served for maxclients
+    acceptedConns atomic2.Int64
+
+    // CLIENT PAUSE
+    pause struct {
+        sync.Mutex
+        until time.Time
+        all bool
+        // closed on unpause
+        ch chan struct{}
+    }
 
     repl struct {
         sync.RWMutex
@@ -38,6 +70,35 @@ type Server struct {
         slaveofReply chan struct{}
         syncFileId  int64
         syncOffset  int64
+        // set once the master rejected BSYNC capabilities, it predates them
+        noSyncCapa  atomic2.Int64
+    }
+
+    // held exclusively while a group of batches is written, shared by readers
+    dataLock    sync.RWMutex
+    // serializes group commits, EXEC holds it from checking WATCH to its commit
+    commitMu    sync.Mutex
+    commits     chan *commitReq
+    watch       watchedKeys
+    fsync       fsyncState
+    backup      backupState
+    archive     archiveState
+    mergeMgr    mergeManager
+    mgrt        mgrtPools
+
+    cmdstats    map[string]*commandStat
+    slowlog     slowlog
+    monitors    monitors
+    pubsub      pubsub
+    cdc         cdcState
+    // classes of keyspace events to publish, see notify-keyspace-events
+    notifyFlags atomic2.Int64
+    expire      expireState
+    latency     latencyMonitor
+
+    acl struct {
+        sync.RWMutex
+        users map[string]*aclUser
     }
 
     counters struct {
@@ -48,29 +109,123 @@ type Server struct {
         syncFull        atomic2.Int64
         syncPartialOK   atomic2.Int64
         syncPartialErr  atomic2.Int64
+        rejectedConns   atomic2.Int64
+        idleTimeouts    atomic2.Int64
+        obufLimitDisconnections atomic2.Int64
+        monitorsDropped atomic2.Int64
+        subscribersDropped atomic2.Int64
+        mgrtKeys        atomic2.Int64
+        mgrtBatches     atomic2.Int64
+        mgrtErrors      atomic2.Int64
+        restoredKeys    atomic2.Int64
+        expiredKeys     atomic2.Int64
+        mergeRuns       atomic2.Int64
+        mergeUsec       atomic2.Int64
+        lastMergeUsec   atomic2.Int64
+        commitGroups    atomic2.Int64
+        commitBatches   atomic2.Int64
+        replyFlushes    atomic2.Int64
+        pipelinedReplies atomic2.Int64
+        maxPipelineDepth atomic2.Int64
     }
 }
 
+// Options of a server embedded in another program
+type Options struct {
+    // serve on these instead of listening on Config.Binds, they are closed by Close
+    Listeners   []net.Listener
+    // logger of the server, the standard logger if nil
+    Logger      *log.Logger
+}
+
 func NewServer(c *Config) (*Server, error) {
-    opts := bitcask.NewOptions()
-    bc, err := bitcask.Open(c.Dbpath, opts)
-    if err != nil {
-        log.Fatal(err)
+    return NewServerWithOptions(context.Background(), c, nil)
+}
+
+// NewServerWithOptions opens the storage and listens, the server is closed once ctx is done.
+// Listening on port 0 picks a free port, see Addr.
+func NewServerWithOptions(ctx context.Context, c *Config, opts *Options) (*Server, error) {
+    if opts == nil {
+        opts = &Options{}
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    logger := opts.Logger
+    if logger == nil {
+        logger = log.New(log.Writer(), log.Prefix(), log.Flags())
     }
 
-    addr := fmt.Sprintf("0.0.0.0:%d", c.Listen)
-    l, err := net.Listen("tcp", addr)
+    bc, err := openStorage(c)
     if err != nil {
-        log.Fatalf("listen failed, err=%s", err)
+        return nil, err
+    }
+
+    var tlsConfig *tls.Config
+    if c.tlsEnabled() {
+        if tlsConfig, err = newTLSConfig(c); err != nil {
+            bc.Close()
+            return nil, err
+        }
     }
 
+    runID := make([]byte, 20)
+    rand.Read(runID)
+
     server := &Server{
+        runID: []byte(hex.EncodeToString(runID)),
+        startTime: time.Now(),
         bc: bc,
         config: c,
         htable: globalCommand,
         signal: make(chan int, 0),
         conns: make(map[*conn]struct{}),
-        l: l,
+        commits: make(chan *commitReq, maxCommitGroup),
+        tlsConfig: tlsConfig,
+        logger: logger,
+        served: make(chan struct{}),
+    }
+
+    server.initCommandStats()
+    server.goFunc(server.committer)
+
+    if len(opts.Listeners) != 0 {
+        server.useListeners(opts.Listeners)
+    } else if err := server.listen(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    if err := server.startMetrics(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    if err := server.initAcl(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    if err := server.initNotify(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    server.initExpire()
+
+    if err := server.initFsync(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    if err := server.initArchive(); err != nil {
+        server.Close()
+        return nil, err
+    }
+
+    if err := server.initMerge(); err != nil {
+        server.Close()
+        return nil, err
     }
 
     if err := server.initReplication(); err != nil {
@@ -78,33 +233,138 @@ func NewServer(c *Config) (*Server, error) {
         return nil, err
     }
 
-    go server.daemonSyncMaster()
+    server.goFunc(server.daemonSyncMaster)
+
+    // not waited by Close, as it may call it
+    go func() {
+        select {
+        case <-ctx.Done():
+            server.Close()
+        case <-server.signal:
+        }
+    }()
     return server, nil
 }
 
+// goFunc runs f in a goroutine Close waits for
+func (s *Server) goFunc(f func()) {
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        f()
+    }()
+}
+
+// Serve accepts connections until the server is closed or its listeners fail.
+// Calling it again just waits for the first call to return.
 func (s *Server) Serve() error {
-    log.Printf("listen on %d\ndbpath: %s", s.config.Listen, s.config.Dbpath)
+    s.serveOnce.Do(func() {
+        s.mu.Lock()
+        listeners := s.listeners
+        s.mu.Unlock()
+
+        var addrs []string
+        for _, l := range listeners {
+            addrs = append(addrs, l.Addr().String())
+        }
+        s.logger.Printf("listen on %s\ndbpath: %s", strings.Join(addrs, ","), s.config.Dbpath)
+
+        var wg sync.WaitGroup
+        for _, l := range listeners {
+            wg.Add(1)
+            l := l
+            s.goFunc(func() {
+                defer wg.Done()
+                s.serveListener(l)
+            })
+        }
+        s.goFunc(func() {
+            wg.Wait()
+            close(s.served)
+        })
+    })
+    <-s.served
+    return nil
+}
+
+// Addr returns the address of the first listener, nil if closed
+func (s *Server) Addr() net.Addr {
+    if addrs := s.Addrs(); len(addrs) != 0 {
+        return addrs[0]
+    }
+    return nil
+}
+
+// Addrs returns the bound addresses of all listeners
+func (s *Server) Addrs() []net.Addr {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var addrs []net.Addr
+    for _, l := range s.listeners {
+        addrs = append(addrs, l.Addr())
+    }
+    return addrs
+}
+
+// port returns the bound tcp port, Config.Listen if there is no tcp listener
+func (s *Server) port() int {
+    for _, addr := range s.Addrs() {
+        if tcp, ok := addr.(*net.TCPAddr); ok {
+            return tcp.Port
+        }
+    }
+    return s.config.Listen
+}
+
+func (s *Server) serveListener(l *listener) {
     for {
-        if nc, err := s.l.Accept(); err != nil {
-            log.Println(err)
+        if nc, err := l.Accept(); err != nil {
+            select {
+            case <-s.signal:
+                return
+            default:
+            }
+            s.logger.Println(err)
+            if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+                return
+            }
         } else {
-            go func() {
-                c := newConn(nc, s, 2000)
-                log.Printf("new connection: %s", c)
+            l.accepted.Incr()
+            if !s.reserveConn() {
+                s.counters.rejectedConns.Incr()
+                nc.SetWriteDeadline(time.Now().Add(time.Second))
+                nc.Write([]byte("-ERR max number of clients reached\r\n"))
+                nc.Close()
+                continue
+            }
+            s.goFunc(func() {
+                defer s.acceptedConns.Decr()
+                l.connected.Incr()
+                defer l.connected.Decr()
+
+                c := newConn(nc, s, s.config.Timeout)
+                s.logger.Printf("new connection: %s", c)
 
                 if err := c.serve(); err != nil {
-                    log.Printf("connection lost: %s\n", err)
+                    s.logger.Printf("connection lost: %s\n", err)
                 }
-            }()
+            })
         }
     }
-    return nil
 }
 
-func (s *Server) merge() error {
-    done := make(chan int, 1)
-    s.bc.Merge(done)
-    return nil
+// reserveConn takes a slot for an accepted conn, false if maxclients are connected
+func (s *Server) reserveConn() bool {
+    max := int64(s.config.MaxClients)
+    for {
+        n := s.acceptedConns.Get()
+        if max > 0 && n >= max {
+            return false
+        }
+        if s.acceptedConns.CompareAndSwap(n, n + 1) {
+            return true
+        }
+    }
 }
 
 func (s *Server) isSlave(c *conn) bool {
@@ -114,24 +374,62 @@ func (s *Server) isSlave(c *conn) bool {
     return ok
 }
 
+// Close stops listening, closes connections and waits for background goroutines,
+// then closes the storage. A running merge is aborted if the storage can, else
+// Close doesn't wait for it and leaves the storage open.
 func (s *Server) Close() {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+    s.closeOnce.Do(func() {
+        close(s.signal)
 
-    s.bc.Close()
-    s.closeConns()
+        s.mu.Lock()
+        s.closeListeners()
+        if s.metricsListener != nil {
+            s.metricsListener.Close()
+        }
+        s.mu.Unlock()
+
+        // a merge the storage can't abort is left running, see runMerge
+        if err := s.abortMerge(); err != nil && err != errMergeNotRunning && err != errMergeNoAbort {
+            s.logger.Printf("abort merge failed, err = %s", err)
+        }
+        s.closeConns()
+        s.wg.Wait()
+        s.closeMgrtPools()
+        s.mergeMgr.Lock()
+        merging := s.mergeMgr.running != nil
+        s.mergeMgr.Unlock()
+        if merging {
+            s.logger.Printf("a merge is still running, the storage is left open")
+            return
+        }
+        s.bc.Close()
+    })
 }
 
 func (s *Server) removeConn(c *conn) {
     s.connMu.Lock()
     defer s.connMu.Unlock()
-    delete(s.conns, c)
+    if _, ok := s.conns[c]; ok {
+        delete(s.conns, c)
+        s.counters.clients.Decr()
+    }
+    s.removeMonitor(c)
+    s.stopCDC(c)
+    s.removeSubscriber(c)
+    s.unwatchAll(c)
 }
 
 func (s *Server) addConn(c *conn) {
     s.connMu.Lock()
     defer s.connMu.Unlock()
-    s.conns[c] = struct{}{}
+    if s.connsClosed {
+        c.Close()
+        return
+    }
+    if _, ok := s.conns[c]; !ok {
+        s.conns[c] = struct{}{}
+        s.counters.clients.Incr()
+    }
 }
 
 func (s *Server) closeConns() {
@@ -141,6 +439,8 @@ func (s *Server) closeConns() {
         c.Close()
     }
     s.conns = make(map[*conn]struct{})
+    s.connsClosed = true
+    s.counters.clients.Set(0)
 }
 
 func toRespError(err error) (redis.Resp, error) {
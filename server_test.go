@@ -2,7 +2,6 @@ package bitserver
 
 import (
     "time"
-    "bufio"
     "fmt"
     "net"
     "math/rand"
@@ -10,6 +9,7 @@ import (
     "testing"
     . "gopkg.in/check.v1"
     redis "github.com/reborndb/go/redis/resp"
+    "github.com/rocket323/bitserver/client"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -56,6 +56,12 @@ func (s *testSvrNode) checkIntArray(c *C, expect []int64, cmd string, args ...in
     nc.checkIntArray(c, expect, cmd, args...)
 }
 
+func (s *testSvrNode) checkError(c *C, pattern string, cmd string, args ...interface{}) {
+    nc := testGetConn(c, s.port)
+    defer nc.Close()
+    nc.checkError(c, pattern, cmd, args...)
+}
+
 func (s *testSvrNode) checkRole(c *C, expect string) {
     r := s.doCmd(c, "ROLE")
     resp, ok := r.(*redis.Array)
@@ -70,6 +76,12 @@ func testCreateServer(c *C, port int, dbpath string) *testSvrNode {
     config := DefaultConfig()
     config.Dbpath = dbpath
     config.Listen = port
+    return testCreateServerWithConfig(c, config)
+}
+
+func testCreateServerWithConfig(c *C, config *Config) *testSvrNode {
+    port := config.Listen
+    dbpath := config.Dbpath
     s, err := NewServer(config)
     c.Assert(err, IsNil)
 
@@ -122,40 +134,26 @@ func randomKey(c *C) string {
 }
 
 type testConn struct {
-    nc net.Conn
+    *client.Conn
+}
+
+func testNewConn(nc net.Conn) *testConn {
+    return &testConn{client.NewConn(nc, 0)}
 }
 
 func testGetConn(c *C, port int) *testConn {
     url := fmt.Sprintf("127.0.0.1:%d", port)
-    nc, err := net.Dial("tcp", url)
+    cc, err := client.Dial(url, nil)
     if err != nil {
         log.Printf("dial server[%s] failed, err = %s", url, err)
     }
     c.Assert(err, IsNil)
-
-    return &testConn{
-        nc: nc,
-    }
-}
-
-func (tc *testConn) Close() {
-    tc.nc.Close()
+    return &testConn{cc}
 }
 
 func (tc *testConn) doCmd(c *C, cmd string, args ...interface{}) redis.Resp {
-    r := bufio.NewReaderSize(tc.nc, 32)
-    w := bufio.NewWriterSize(tc.nc, 32)
-
-    req := redis.NewRequest(cmd, args...)
-    err := redis.Encode(w, req)
-    c.Assert(err, IsNil)
-
-    err = w.Flush()
-    c.Assert(err, IsNil)
-
-    resp, err := redis.Decode(r)
+    resp, err := tc.Do(cmd, args...)
     c.Assert(err, IsNil)
-
     return resp
 }
 
@@ -175,6 +173,12 @@ func (tc *testConn) checkString(c *C, expect string, cmd string, args ...interfa
     }
 }
 
+func (tc *testConn) checkError(c *C, pattern string, cmd string, args ...interface{}) {
+    resp := tc.doCmd(c, cmd, args...)
+    c.Assert(resp, FitsTypeOf, (*redis.Error)(nil))
+    c.Assert(resp.(*redis.Error).Value, Matches, pattern)
+}
+
 func (tc *testConn) checkInt(c *C, expect int64, cmd string, args ...interface{}) {
     resp := tc.doCmd(c, cmd, args...)
     c.Assert(resp, DeepEquals, redis.NewInt(expect))
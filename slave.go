@@ -8,7 +8,6 @@ import (
     "time"
     "fmt"
     "log"
-    "net"
     redis "github.com/reborndb/go/redis/resp"
 )
 
@@ -20,17 +19,24 @@ const (
     masterConnConnected = 4         // connected to master
 )
 
+// states of repl.masterConnState
+const (
+    masterStateConnecting = "connecting"
+    masterStateSyncing = "sync"
+    masterStateConnected = "connected"
+)
+
 // SLAVEOF host port
 func SlaveOfCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 2 {
-        return toRespErrorf("len(args) = %d, expect = 2", len(args))
-    }
     addr := fmt.Sprintf("%s:%s", string(args[0]), string(args[1]))
-    log.Printf("set slave of %s", addr)
+    c.s.logger.Printf("set slave of %s", addr)
 
     var cc *conn
     var err error
     if strings.ToLower(addr) != "no:one" {
+        if c.s.bc.GetDataFilePath(c.s.bc.ActiveFileId()) == "" {
+            return toRespError(errNoDataFiles)
+        }
         if cc, err = c.s.replicationConnectMaster(addr); err != nil {
             return toRespError(err)
         }
@@ -49,12 +55,13 @@ func SlaveOfCmd(c *conn, args [][]byte) (redis.Resp, error) {
 }
 
 func (s *Server) replicationConnectMaster(addr string) (*conn, error) {
-    nc, err := net.DialTimeout("tcp", addr, time.Second)
+    nc, err := s.dial(addr, time.Second)
     if err != nil {
         return nil, err
     }
 
     c := newConn(nc, s, 0)
+    c.isMaster = true
     return c, nil
 }
 
@@ -75,18 +82,19 @@ LOOP:
         case <-lost:
             // here means replication conn was broken, we will reconnect it
             last = nil
-            log.Printf("replication connection from master %s was broken, try reconnect 1s later", s.repl.masterAddr.Get())
+            s.logger.Printf("replication connection from master %s was broken, try reconnect 1s later", s.repl.masterAddr.Get())
             retryTimer.Reset(time.Second)
             continue LOOP
         case <-s.signal:
             exit = true
         case c = <-s.repl.master:
             needSlaveOfReply = true
+            s.repl.noSyncCapa.Set(0)
         case <-retryTimer.C:
-            log.Printf("try reconnect to master %s", s.repl.masterAddr.Get())
+            s.logger.Printf("try reconnect to master %s", s.repl.masterAddr.Get())
             c, err = s.replicationConnectMaster(s.repl.masterAddr.Get())
             if err != nil {
-                log.Printf("replication reconnect to master %s failed, try 1s laster again -%s", s.repl.masterAddr, err)
+                s.logger.Printf("replication reconnect to master %s failed, try 1s laster again -%s", s.repl.masterAddr, err)
                 retryTimer.Reset(time.Second)
                 continue LOOP
             }
@@ -103,6 +111,7 @@ LOOP:
         if c != nil {
             masterAddr := c.nc.RemoteAddr().String()
             s.repl.masterAddr.Set(masterAddr)
+            s.repl.masterConnState.Set(masterStateConnecting)
             activeFileId := s.bc.ActiveFileId()
             path := s.bc.GetDataFilePath(activeFileId)
 
@@ -110,14 +119,18 @@ LOOP:
                 defer func() {
                     lost <- 0
                 }()
+                s.addConn(c)
+                defer s.removeConn(c)
                 defer c.Close()
                 err := s.bsync(c, activeFileId, path)
-                log.Printf("slave %s do bsync err - %s", c, err)
+                s.logger.Printf("slave %s do bsync err - %s", c, err)
+                s.repl.masterConnState.Set(masterStateConnecting)
             }(activeFileId, path)
-            log.Printf("slaveof %s", s.repl.masterAddr.Get())
+            s.logger.Printf("slaveof %s", s.repl.masterAddr.Get())
         } else {
             s.repl.masterAddr.Set("")
-            log.Printf("slaveof no one")
+            s.repl.masterConnState.Set("")
+            s.logger.Printf("slaveof no one")
         }
 
         if needSlaveOfReply {
@@ -126,11 +139,25 @@ LOOP:
     }
 }
 
+// bytes of records a slave holds for a batch, past it they are applied before
+// the batch ends and readers may see part of a big commit group
+const syncMaxBatchBytes = 64 << 20
+
+// masterError is an error reply of master
+type masterError string
+
+func (e masterError) Error() string {
+    return "master replied " + string(e)
+}
+
 func readInt(c *conn) (int64, error) {
     line, err := c.readLine()
     if err != nil {
         return 0, err
     }
+    if line[0] == '-' {
+        return 0, masterError(line[1:])
+    }
     if line[0] != '$' {
         return 0, fmt.Errorf("invalid number, resp = %s", line)
     }
@@ -145,33 +172,51 @@ func (s *Server) bsync(c *conn, activeFileId int64, path string) error {
     // send bsync command
     deadline := time.Now().Add(time.Second * 5)
     if err := c.nc.SetWriteDeadline(deadline); err != nil {
-        log.Println(err)
+        s.logger.Println(err)
         return err
     }
 
+    if s.config.MasterAuth != "" {
+        if err := c.auth(s.config.MasterUser, s.config.MasterAuth); err != nil {
+            s.logger.Println(err)
+            return err
+        }
+    }
+
     fi, err := os.Stat(path)
     if err != nil {
         return err
     }
     offset := fi.Size()
 
-    if err := c.writeRESP(redis.NewRequest("BSYNC", "", activeFileId, offset)); err != nil {
-        log.Println(err)
+    s.repl.masterConnState.Set(masterStateSyncing)
+    req := redis.NewRequest("BSYNC", "", activeFileId, offset)
+    if s.repl.noSyncCapa.Get() == 0 {
+        req = redis.NewRequest("BSYNC", "", activeFileId, offset, "CAPA", "marker", "CAPA", "batch")
+        c.syncCapa = syncCapaMarker|syncCapaBatch
+    }
+    if err := c.writeRESP(req); err != nil {
+        s.logger.Println(err)
         return err
     }
 
     // send current fileIds and md5s
     if err := s.preSync(c); err != nil {
-        log.Printf("preSync failed, err = %s", err)
+        if _, ok := err.(masterError); ok && c.syncCapa != 0 {
+            // masters before capabilities take 3 args only, the next attempt goes without
+            s.logger.Printf("master rejected BSYNC capabilities, retrying without them")
+            s.repl.noSyncCapa.Set(1)
+        }
+        s.logger.Printf("preSync failed, err = %s", err)
         return err
     }
 
-    log.Printf("start sync from master")
+    s.logger.Printf("start sync from master")
     // sync data files
     for {
         err := s.syncFromMaster(c)
         if err != nil {
-            log.Printf("sync file from master failed, err = %s", err)
+            s.logger.Printf("sync file from master failed, err = %s", err)
             return err
         }
     }
@@ -199,7 +244,7 @@ func (s *Server) preSync(c *conn) error {
     if err != nil {
         return err
     }
-    log.Printf("start sync master from data-file[%d]", startFileId)
+    s.logger.Printf("start sync master from data-file[%d]", startFileId)
 
     if err := s.bc.Truncate(startFileId); err != nil {
         return err
@@ -221,6 +266,14 @@ func (s *Server) syncFromMaster(c *conn) error {
     if err != nil {
         return err
     }
+    switch fileId {
+    case syncMarkerFileId:
+        s.logger.Printf("caught up with master %s", c)
+        s.repl.masterConnState.Set(masterStateConnected)
+        return nil
+    case syncBatchFileId:
+        return s.applySyncBatch(c)
+    }
     data := make([]byte, int(length))
     var n int
     if length > 0 {
@@ -232,15 +285,65 @@ func (s *Server) syncFromMaster(c *conn) error {
         }
     }
 
-    err = s.bc.SyncFile(fileId, offset, length, data)
-    if err != nil {
-        log.Println(err)
-        return err
+    c.syncBatch = append(c.syncBatch, &syncRecord{fileId, offset, length, data})
+    c.syncBatchBytes += length
+    // masters without batches never end one, each record is applied as it comes
+    if c.syncCapa&syncCapaBatch == 0 || c.syncBatchBytes >= syncMaxBatchBytes {
+        return s.applySyncBatch(c)
     }
     return nil
 }
 
+// a record received from master, waiting for the end of its batch
+type syncRecord struct {
+    fileId int64
+    offset int64
+    length int64
+    data []byte
+}
+
+// applySyncBatch writes records of a batch, readers see all of them or none
+func (s *Server) applySyncBatch(c *conn) error {
+    batch := c.syncBatch
+    c.syncBatch = nil
+    c.syncBatchBytes = 0
+
+    s.commitMu.Lock()
+    defer s.commitMu.Unlock()
+    s.dataLock.Lock()
+    defer s.dataLock.Unlock()
+
+    var n int64
+    var done []Record
+    for _, rec := range batch {
+        n += rec.length
+        s.feedMonitors(0, monitorTagReplication, c.nc.RemoteAddr().String(), "syncfile",
+            [][]byte{[]byte(strconv.FormatInt(rec.fileId, 10)), []byte(strconv.FormatInt(rec.offset, 10)), []byte(strconv.FormatInt(rec.length, 10))})
+        if err := s.bc.SyncFile(rec.fileId, rec.offset, rec.length, rec.data); err != nil {
+            s.logger.Println(err)
+            return err
+        }
+        // writes of a group are told once it ends
+        done = append(done, c.syncGroup.add(newDataRecord(rec.length, rec.data))...)
+    }
+    if c.syncGroup.hidden {
+        c.syncGroup.hidden = false
+        s.touchAllKeys()
+    }
+    for _, rec := range done {
+        s.touchKeys(rec.Key())
+        if rec.Deleted() {
+            s.trackExpire(rec.Key(), 0)
+        } else {
+            s.trackExpire(rec.Key(), rec.ExpireAt())
+        }
+    }
+    s.notifySyncRecords(done)
+    return s.afterWrite(n)
+}
+
 func init() {
-    Register("slaveof", SlaveOfCmd, CmdReadOnly)
+    register(&command{name: "slaveof", f: SlaveOfCmd, flag: CmdAdmin|CmdReplication|CmdStale|CmdNoScript|CmdNoMulti, arity: 3,
+        group: "server", summary: "Make the server a slave of another instance, or promote it as master"})
 }
 
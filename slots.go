@@ -2,16 +2,15 @@ package bitserver
 
 import (
     "fmt"
-    "log"
+    "math"
     "strconv"
-    "hash/crc32"
     "time"
-    "bytes"
     redis "github.com/reborndb/go/redis/resp"
+    "github.com/rocket323/bitserver/client"
 )
 
 const (
-    MaxSlotNum = 1024
+    MaxSlotNum = client.MaxSlotNum
     MaxExpireAt = 1e15
 )
 
@@ -27,27 +26,18 @@ func TTLmsToExpireAt(ttlms int64) (int64, bool) {
     return expireat, true
 }
 
+// hashing is shared with clients, see package client
+
 func HashTag(key []byte) []byte {
-    part := key
-    if i := bytes.IndexByte(part, '{'); i != -1 {
-        part = part[i+1:]
-    } else {
-        return key
-    }
-    if i := bytes.IndexByte(part, '}'); i != -1 {
-        return part[:i]
-    } else {
-        return key
-    }
+    return client.HashTag(key)
 }
 
 func HashTagToSlot(tag []byte) uint32 {
-    return crc32.ChecksumIEEE(tag) % MaxSlotNum
+    return client.HashTagToSlot(tag)
 }
 
 func HashKeyToSlot(key []byte) ([]byte, uint32) {
-    tag := HashTag(key)
-    return tag, HashTagToSlot(tag)
+    return client.HashKeyToSlot(key)
 }
 
 // SLOTSHASHKEY key [key...]
@@ -105,9 +95,6 @@ func SlotsInfoCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SLOTSMGRTONE host port timeout key
 func SlotsMgrtOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 4 {
-        return toRespErrorf("len(args) = %d, expect = 4", len(args))
-    }
     host := string(args[0])
     port, err := strconv.ParseInt(string(args[1]), 10, 64)
     if err != nil {
@@ -125,7 +112,7 @@ func SlotsMgrtOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
     }
     addr := fmt.Sprintf("%s:%d", host, port)
 
-    log.Printf("migrate one, addr = %s, timeout = %d, key = %v", addr, timeout, key)
+    c.s.logger.Printf("migrate one, addr = %s, timeout = %d, key = %v", addr, timeout, key)
     n, err := migrateOne(c, addr, timeout, key)
     if err != nil {
         return toRespError(err)
@@ -135,9 +122,6 @@ func SlotsMgrtOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SLOTSMGRTTAGONE host port timeout key
 func SlotsMgrtTagOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 4 {
-        return toRespErrorf("len(args) = %d, expect = 4", len(args))
-    }
     host := string(args[0])
     port, err := strconv.ParseInt(string(args[1]), 10, 64)
     if err != nil {
@@ -155,7 +139,7 @@ func SlotsMgrtTagOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
     }
     addr := fmt.Sprintf("%s:%d", host, port)
 
-    log.Printf("migrate one with tag, addr = %s, timeout = %d, key = %v", addr, timeout, key)
+    c.s.logger.Printf("migrate one with tag, addr = %s, timeout = %d, key = %v", addr, timeout, key)
     var n int64
     if tag := HashTag(key); len(tag) == len(key) {
         n, err = migrateOne(c, addr, timeout, key)
@@ -171,9 +155,6 @@ func SlotsMgrtTagOneCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SLOTSMGRTSLOT host port timeout slot
 func SlotsMgrtSlotCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 4 {
-        return toRespErrorf("len(args) = %d, expect = 4", len(args))
-    }
     host := string(args[0])
     port, err := strconv.ParseInt(string(args[1]), 10, 64)
     if err != nil {
@@ -220,9 +201,6 @@ func SlotsMgrtSlotCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SLOTSMGRTTAGSLOT host port timeout slot
 func SlotsMgrtTagSlotCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) != 4 {
-        return toRespErrorf("len(args) = %d, expect = 4", len(args))
-    }
     host := string(args[0])
     port, err := strconv.ParseInt(string(args[1]), 10, 64)
     if err != nil {
@@ -271,11 +249,11 @@ func SlotsMgrtTagSlotCmd(c *conn, args [][]byte) (redis.Resp, error) {
 
 // SLOTSRESTORE key ttlms value [key ttlms value...]
 func SlotsRestoreCmd(c *conn, args [][]byte) (redis.Resp, error) {
-    if len(args) == 0 || len(args) % 3 != 0 {
-        return toRespErrorf("len(args) = %d, expect != 0 && mod 3 = 0", len(args))
+    if len(args) % 3 != 0 {
+        return toRespErrorf("len(args) = %d, expect mod 3 = 0", len(args))
     }
 
-    bc := c.s.bc
+    b := &writeBatch{}
     num := len(args) / 3
     for i := 0; i < num; i++ {
         key := args[i * 3]
@@ -285,29 +263,34 @@ func SlotsRestoreCmd(c *conn, args [][]byte) (redis.Resp, error) {
         }
         value := args[i * 3 + 2]
 
+        // stored in unix seconds, rounded up so it doesn't expire early
         expireAt := int64(0)
         if ttlms != 0 {
-            if v, ok := TTLmsToExpireAt(ttlms); ok && v > 0 {
-                expireAt = v
+            if v, ok := TTLmsToExpireAt(ttlms); ok && v > 0 && (v + 999) / 1000 <= math.MaxUint32 {
+                expireAt = (v + 999) / 1000
             } else {
                 return toRespErrorf("parse args[%d] ttls = %d", i*3+1, ttlms)
             }
         }
 
-        // log.Printf("restore key = %v", key)
-        if err := bc.SetWithExpr(key, value, uint32(expireAt)); err != nil {
-            log.Printf("restore key[%v] failed, err = %s", key, err)
-            return toRespError(err)
-        }
+        b.PutWithExpr(key, value, uint32(expireAt))
+        b.notify(notifyRestored, "restored", key)
+    }
+
+    // all keys of a restore are applied or none
+    if err := c.s.commit(c, b); err != nil {
+        c.s.logger.Printf("restore %d keys failed, err = %s", num, err)
+        return toRespError(err)
     }
 
+    c.s.counters.restoredKeys.Add(int64(num))
     return redis.NewString("OK"), nil
 }
 
 func migrateOne(c *conn, addr string, timeout time.Duration, key []byte) (int64, error) {
     n, err := migrate(c, addr, timeout, key)
     if err != nil {
-        log.Printf("migrate one failed, err = %s", err)
+        c.s.logger.Printf("migrate one failed, err = %s", err)
         return 0, err
     }
     return n, nil
@@ -321,38 +304,48 @@ func migrateTag(c *conn, addr string, timeout time.Duration, tag []byte) (int64,
     }
     n, err := migrate(c, addr, timeout, keys...)
     if err != nil {
-        log.Printf("migrate tag failed, err = %s", err)
+        c.s.logger.Printf("migrate tag failed, err = %s", err)
         return 0, err
     }
     return n, nil
 }
 
 func migrate(c *conn, addr string, timeout time.Duration, keys ...[]byte) (int64, error) {
-    bc := c.s.bc
+    c.migrating.Incr()
+    defer c.migrating.Decr()
 
-    cnt, err := doMigrate(bc, addr, timeout, keys...);
+    cnt, err := doMigrate(c.s, addr, timeout, keys...);
     if err != nil {
-        log.Printf("migrate failed, err = %s", err)
+        c.s.logger.Printf("migrate failed, err = %s", err)
         return 0, err
     }
 
     // delete from local
+    b := &writeBatch{}
     for _, key := range keys {
-        err := bc.DelLocal(key)
-        if err != nil {
-            log.Printf("del key[%v] failed, err = %s", key, err)
-        }
+        b.DeleteLocal(key)
+        b.notify(notifyMigrated, "migrated", key)
+    }
+    if err := c.s.commit(c, b); err != nil {
+        c.s.logger.Printf("del %d migrated keys failed, err = %s", len(keys), err)
     }
     return cnt, nil
 }
 
 func init() {
-    Register("slotshashkey", SlotsHashKeyCmd, CmdReadOnly)
-    Register("slotsinfo", SlotsInfoCmd, CmdReadOnly)
-    Register("slotsmgrtone", SlotsMgrtOneCmd, CmdWrite)
-    Register("slotsmgrtslot", SlotsMgrtSlotCmd, CmdWrite)
-    Register("slotsmgrttagone", SlotsMgrtTagOneCmd, CmdWrite)
-    Register("slotsmgrttagslot", SlotsMgrtTagSlotCmd, CmdWrite)
-    Register("slotsrestore", SlotsRestoreCmd, CmdWrite)
+    register(&command{name: "slotshashkey", f: SlotsHashKeyCmd, flag: CmdReadOnly|CmdSlots|CmdFast, arity: -1, firstKey: 1, lastKey: -1, keyStep: 1,
+        group: "slots", summary: "Get the slots of keys"})
+    register(&command{name: "slotsinfo", f: SlotsInfoCmd, flag: CmdReadOnly|CmdSlots, arity: -1,
+        group: "slots", summary: "Get the number of keys of slots"})
+    register(&command{name: "slotsmgrtone", f: SlotsMgrtOneCmd, flag: CmdWrite|CmdSlots, arity: 5, firstKey: 4, lastKey: 4, keyStep: 1,
+        group: "slots", summary: "Migrate a key to another instance"})
+    register(&command{name: "slotsmgrtslot", f: SlotsMgrtSlotCmd, flag: CmdWrite|CmdSlots, arity: 5,
+        group: "slots", summary: "Migrate a key of the slot to another instance"})
+    register(&command{name: "slotsmgrttagone", f: SlotsMgrtTagOneCmd, flag: CmdWrite|CmdSlots, arity: 5, firstKey: 4, lastKey: 4, keyStep: 1,
+        group: "slots", summary: "Migrate a key and keys with the same tag to another instance"})
+    register(&command{name: "slotsmgrttagslot", f: SlotsMgrtTagSlotCmd, flag: CmdWrite|CmdSlots, arity: 5,
+        group: "slots", summary: "Migrate a tag of the slot to another instance"})
+    register(&command{name: "slotsrestore", f: SlotsRestoreCmd, flag: CmdWrite|CmdSlots, arity: -4, firstKey: 1, lastKey: -1, keyStep: 3,
+        group: "slots", summary: "Restore migrated keys"})
 }
 
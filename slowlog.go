@@ -0,0 +1,135 @@
+package bitserver
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+const (
+    slowlogMaxArgc = 32
+    slowlogMaxArgLen = 128
+)
+
+type slowlogEntry struct {
+    id          int64
+    time        time.Time
+    duration    time.Duration
+    args        [][]byte
+    addr        string
+    name        string
+}
+
+type slowlog struct {
+    sync.Mutex
+    // newest first
+    entries     []*slowlogEntry
+    nextId      int64
+}
+
+// slowlogArgs copies cmd and args, truncated as redis does, args of commands
+// hiding credentials from MONITOR are redacted
+func slowlogArgs(cmd string, args [][]byte) [][]byte {
+    argv := make([][]byte, 0, len(args) + 1)
+    argv = append(argv, []byte(cmd))
+    for i, arg := range args {
+        if hidesCredentials(cmd) {
+            arg = []byte("(redacted)")
+        }
+        if len(argv) == slowlogMaxArgc - 1 && i != len(args) - 1 {
+            argv = append(argv, []byte(fmt.Sprintf("... (%d more arguments)", len(args) - i)))
+            break
+        }
+        if len(arg) > slowlogMaxArgLen {
+            trunc := make([]byte, slowlogMaxArgLen)
+            copy(trunc, arg)
+            arg = append(trunc, fmt.Sprintf("... (%d more bytes)", len(arg) - slowlogMaxArgLen)...)
+        } else {
+            arg = append([]byte(nil), arg...)
+        }
+        argv = append(argv, arg)
+    }
+    return argv
+}
+
+func (s *Server) slowlogPush(c *conn, cmd string, args [][]byte, d time.Duration) {
+    threshold := s.config.SlowlogLogSlowerThan
+    if threshold < 0 || d < time.Duration(threshold) * time.Microsecond {
+        return
+    }
+
+    e := &slowlogEntry{
+        time: time.Now(),
+        duration: d,
+        args: slowlogArgs(cmd, args),
+        addr: c.nc.RemoteAddr().String(),
+        name: c.name.Get(),
+    }
+
+    l := &s.slowlog
+    l.Lock()
+    defer l.Unlock()
+    e.id = l.nextId
+    l.nextId++
+    l.entries = append([]*slowlogEntry{e}, l.entries...)
+    // a max not above 0 keeps no entry
+    if max := s.config.SlowlogMaxLen; len(l.entries) > max {
+        if max < 0 {
+            max = 0
+        }
+        l.entries = l.entries[:max]
+    }
+}
+
+// SLOWLOG GET [count] | LEN | RESET
+func SlowlogCmd(c *conn, args [][]byte) (redis.Resp, error) {
+    l := &c.s.slowlog
+    l.Lock()
+    defer l.Unlock()
+
+    switch sub := strings.ToLower(string(args[0])); sub {
+    case "get":
+        count := 10
+        if len(args) >= 2 {
+            n, err := strconv.Atoi(string(args[1]))
+            if err != nil {
+                return toRespError(err)
+            }
+            count = n
+        }
+        if count < 0 || count > len(l.entries) {
+            count = len(l.entries)
+        }
+        resp := redis.NewArray()
+        for _, e := range l.entries[:count] {
+            one := redis.NewArray()
+            one.AppendInt(e.id)
+            one.AppendInt(e.time.Unix())
+            one.AppendInt(int64(e.duration / time.Microsecond))
+            argv := redis.NewArray()
+            for _, arg := range e.args {
+                argv.AppendBulkBytes(arg)
+            }
+            one.Append(argv)
+            one.AppendBulkBytes([]byte(e.addr))
+            one.AppendBulkBytes([]byte(e.name))
+            resp.Append(one)
+        }
+        return resp, nil
+    case "len":
+        return redis.NewInt(int64(len(l.entries))), nil
+    case "reset":
+        l.entries = nil
+        return redis.NewString("OK"), nil
+    default:
+        return toRespErrorf("unknown SLOWLOG subcommand %s", sub)
+    }
+}
+
+func init() {
+    register(&command{name: "slowlog", f: SlowlogCmd, flag: CmdAdmin|CmdLoading|CmdStale, arity: -2,
+        group: "server", summary: "Manage the slow queries log"})
+}
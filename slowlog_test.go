@@ -0,0 +1,104 @@
+package bitserver
+
+import (
+    "strings"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testSlowlogSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testSlowlogSuite{})
+
+func (s *testSlowlogSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17840
+    config.Dbpath = c.MkDir()
+    config.SlowlogLogSlowerThan = 0
+    config.SlowlogMaxLen = 3
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testSlowlogSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testSlowlogSuite) TestSlowlog(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "slowlog", "reset")
+    nc.checkOK(c, "client", "setname", "slow")
+    nc.checkOK(c, "set", "a", strings.Repeat("x", 200))
+    nc.checkInt(c, 3, "slowlog", "len")
+
+    // newest first, the newest entry is SLOWLOG LEN
+    resp := nc.doCmd(c, "slowlog", "get", 2)
+    entries, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(entries.Value, HasLen, 2)
+    entry := entries.Value[1].(*redis.Array)
+    c.Assert(entry.Value, HasLen, 6)
+    argv := entry.Value[3].(*redis.Array)
+    c.Assert(argv.Value, HasLen, 3)
+    c.Assert(string(argv.Value[0].(*redis.BulkBytes).Value), Equals, "set")
+    c.Assert(string(argv.Value[2].(*redis.BulkBytes).Value), Equals, strings.Repeat("x", 128) + "... (72 more bytes)")
+    c.Assert(string(entry.Value[5].(*redis.BulkBytes).Value), Equals, "slow")
+}
+
+func (s *testSlowlogSuite) TestSlowlogArgs(c *C) {
+    args := make([][]byte, 40)
+    for i := range args {
+        args[i] = []byte("k")
+    }
+    argv := slowlogArgs("del", args)
+    c.Assert(argv, HasLen, slowlogMaxArgc)
+    c.Assert(string(argv[slowlogMaxArgc - 1]), Equals, "... (10 more arguments)")
+}
+
+func (s *testSlowlogSuite) TestSlowlogRedacted(c *C) {
+    argv := slowlogArgs("hello", [][]byte{[]byte("3"), []byte("auth"), []byte("u"), []byte("secret")})
+    c.Assert(argv, HasLen, 5)
+    c.Assert(string(argv[0]), Equals, "hello")
+    for _, arg := range argv[1:] {
+        c.Assert(string(arg), Equals, "(redacted)")
+    }
+}
+
+func (s *testSlowlogSuite) TestSlowlogNegativeMaxLen(c *C) {
+    svr := s.s.svr
+    svr.config.SlowlogMaxLen = -1
+    defer func() {
+        svr.config.SlowlogMaxLen = 3
+    }()
+
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+    nc.checkInt(c, 0, "slowlog", "len")
+}
+
+func (s *testSlowlogSuite) TestLatency(c *C) {
+    svr := s.s.svr
+    s.s.checkInt(c, 0, "latency", "reset")
+    svr.latencyAdd(latencyMerge, 10 * time.Millisecond)
+    svr.latencyAdd(latencyMerge, 300 * time.Millisecond)
+
+    resp := s.s.doCmd(c, "latency", "latest")
+    latest, ok := resp.(*redis.Array)
+    c.Assert(ok, Equals, true)
+    c.Assert(latest.Value, HasLen, 1)
+    event := latest.Value[0].(*redis.Array)
+    c.Assert(string(event.Value[0].(*redis.BulkBytes).Value), Equals, latencyMerge)
+    c.Assert(event.Value[2], DeepEquals, redis.NewInt(300))
+
+    resp = s.s.doCmd(c, "latency", "doctor")
+    doctor, ok := resp.(*redis.BulkBytes)
+    c.Assert(ok, Equals, true)
+    c.Assert(strings.Contains(string(doctor.Value), "merge: 1 latency spikes"), Equals, true)
+}
@@ -0,0 +1,418 @@
+package bitserver
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sync"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+// storage engines of Config.Storage
+const (
+    StorageBitcask = "bitcask"
+    StorageMemory = "memory"
+)
+
+var (
+    ErrKeyNotFound = errors.New("key not found")
+    // returned by engines without data-files for replication and backups
+    errNoDataFiles = errors.New("the storage has no data-files")
+)
+
+// FileMeta identifies a data-file by its content
+type FileMeta struct {
+    FileId  int64
+    Md5     []byte
+}
+
+// Record is a record of a data-file, as sent to slaves. Records of values the
+// server wrote tell their key and commit group, see record.go; the others, like
+// tombstones of the engine, have a nil Key.
+type Record interface {
+    Size() int64
+    Encode() ([]byte, error)
+    Key() []byte
+    Value() []byte
+    ExpireAt() uint32
+    Deleted() bool
+    // unix time the record was written at
+    Timestamp() uint32
+    // More tells the commit group goes on with the next record
+    More() bool
+}
+
+// Storage is what commands, slots and replication need from a storage engine.
+// Engines may implement optional interfaces as well, see atomicBatchWriter,
+// fsyncer, deadBytesCounter, mergeAborter and mergeThrottler.
+type Storage interface {
+    // Get returns ErrKeyNotFound for missing keys
+    Get(key []byte) ([]byte, error)
+    GetWithExpr(key []byte) ([]byte, uint32, error)
+    Set(key, value []byte) error
+    SetWithExpr(key, value []byte, expireAt uint32) error
+    Del(key []byte) error
+    // DelLocal deletes key without it being replicated, for migrated keys
+    DelLocal(key []byte) error
+    ClearAll() error
+
+    // FirstKeyUnderSlot returns nil if there is no key in slot
+    FirstKeyUnderSlot(slot uint32) ([]byte, error)
+    AllKeysWithTag(tag []byte) ([][]byte, error)
+
+    // Merge reclaims space of dead records, sending a status code to done once finished
+    Merge(done chan int)
+    Close()
+
+    // append-only data-files, for replication, backups and archiving.
+    // Engines without files return an empty path and no metas.
+    ActiveFileId() int64
+    NextDataFileId(fileId int64) int64
+    GetDataFilePath(fileId int64) string
+    GetFileMetas() []*FileMeta
+    // RefRecord returns io.EOF at the end of data-file fileId
+    RefRecord(fileId int64, offset int64) (Record, error)
+    // Truncate drops data-files from fileId on, before a slave syncs them again
+    Truncate(fileId int64) error
+    // SyncFile writes a record received from master at fileId:offset
+    SyncFile(fileId int64, offset int64, length int64, data []byte) error
+}
+
+// dataFileIds lists data-files from the oldest to the active one, without hashing them
+// like GetFileMetas does
+func dataFileIds(bc Storage) []int64 {
+    activeFileId := bc.ActiveFileId()
+    if bc.GetDataFilePath(activeFileId) == "" {
+        return nil
+    }
+    var ids []int64
+    for fileId := bc.NextDataFileId(-1); ; fileId = bc.NextDataFileId(fileId) {
+        if _, err := os.Stat(bc.GetDataFilePath(fileId)); err == nil {
+            ids = append(ids, fileId)
+        }
+        if fileId >= activeFileId || bc.NextDataFileId(fileId) <= fileId {
+            return ids
+        }
+    }
+}
+
+func openStorage(config *Config) (Storage, error) {
+    switch config.Storage {
+    case "", StorageBitcask:
+        return openBitcaskStorage(config.Dbpath)
+    case StorageMemory:
+        return newMemStorage(), nil
+    default:
+        return nil, fmt.Errorf("unknown storage engine '%s'", config.Storage)
+    }
+}
+
+// bitcaskStorage adapts bitcask to Storage. Values are stored with a trailer,
+// see record.go, and batches are written as commit groups, see WriteBatch.
+type bitcaskStorage struct {
+    *bitcask.BitCask
+    // set once a commit group failed half written, the storage refuses writes
+    // and reads of its keys until opened again, which drops the group
+    failMu      sync.RWMutex
+    failed      error
+    failedKeys  map[string]bool
+}
+
+func openBitcaskStorage(path string) (*bitcaskStorage, error) {
+    bc, err := bitcask.Open(path, bitcask.NewOptions())
+    if err != nil {
+        return nil, err
+    }
+    b := &bitcaskStorage{BitCask: bc}
+    fileId, offset, err := b.unfinishedGroup()
+    if err != nil || fileId < 0 {
+        if err != nil {
+            bc.Close()
+        }
+        return b, err
+    }
+
+    // records of a group interrupted by a crash are cut off, as if it never started
+    log.Printf("dropping a commit group interrupted by a crash, from %d:%d", fileId, offset)
+    if next := b.NextDataFileId(fileId); fileId < b.ActiveFileId() && next > fileId {
+        if err := b.BitCask.Truncate(next); err != nil {
+            bc.Close()
+            return nil, err
+        }
+    }
+    dataPath := b.GetDataFilePath(fileId)
+    bc.Close()
+    if err := os.Truncate(dataPath, offset); err != nil {
+        return nil, err
+    }
+    bc, err = bitcask.Open(path, bitcask.NewOptions())
+    if err != nil {
+        return nil, err
+    }
+    return &bitcaskStorage{BitCask: bc}, nil
+}
+
+func bitcaskError(err error) error {
+    if err == bitcask.ErrKeyNotFound {
+        return ErrKeyNotFound
+    }
+    return err
+}
+
+func (b *bitcaskStorage) Get(key []byte) ([]byte, error) {
+    value, _, err := b.GetWithExpr(key)
+    return value, err
+}
+
+func (b *bitcaskStorage) GetWithExpr(key []byte) ([]byte, uint32, error) {
+    b.failMu.RLock()
+    failed := b.failed
+    if !b.failedKeys[string(key)] {
+        failed = nil
+    }
+    b.failMu.RUnlock()
+    if failed != nil {
+        return nil, 0, failed
+    }
+    value, expireAt, err := b.BitCask.GetWithExpr(key)
+    if err != nil {
+        return nil, 0, bitcaskError(err)
+    }
+    if m, ok := decodeRecordValue(value); ok {
+        // left by a delete interrupted before bitcask's own tombstone
+        if m.flags&recordDeleted != 0 {
+            return nil, 0, ErrKeyNotFound
+        }
+        return m.value, expireAt, nil
+    }
+    return value, expireAt, nil
+}
+
+func (b *bitcaskStorage) Set(key, value []byte) error {
+    return b.WriteBatch([]writeOp{{key: key, value: value}})
+}
+
+func (b *bitcaskStorage) SetWithExpr(key, value []byte, expireAt uint32) error {
+    return b.WriteBatch([]writeOp{{key: key, value: value, expireAt: expireAt}})
+}
+
+func (b *bitcaskStorage) Del(key []byte) error {
+    if _, err := b.Get(key); err != nil {
+        return err
+    }
+    return b.WriteBatch([]writeOp{{key: key, del: true}})
+}
+
+// WriteBatch writes ops as one commit group, see atomicBatchWriter. Records of
+// the group but the last are flagged recordMore, the last one ends it: readers
+// of data-files never stop inside a group, and a group without end, cut short
+// by a crash, is dropped when the storage is opened again. If an op fails after
+// others were written, the storage fails until then.
+func (b *bitcaskStorage) WriteBatch(ops []writeOp) error {
+    b.failMu.RLock()
+    failed := b.failed
+    b.failMu.RUnlock()
+    if failed != nil {
+        return failed
+    }
+
+    // deletes of missing keys are dropped, they would write a tombstone for nothing
+    var group []writeOp
+    var exists map[string]bool
+    for _, op := range ops {
+        if op.del {
+            found, ok := exists[string(op.key)]
+            if !ok {
+                _, err := b.Get(op.key)
+                if err != nil && err != ErrKeyNotFound {
+                    return err
+                }
+                found = err == nil
+            }
+            if !found {
+                continue
+            }
+        }
+        if exists == nil {
+            exists = make(map[string]bool)
+        }
+        exists[string(op.key)] = !op.del
+        group = append(group, op)
+    }
+
+    now := uint32(time.Now().Unix())
+    for i, op := range group {
+        var flags byte
+        if i < len(group) - 1 {
+            flags = recordMore
+        }
+        if err := b.writeOp(op, flags, now); err != nil {
+            if i > 0 {
+                b.failGroup(group[:i + 1], err)
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+// failGroup fails the storage after ops of a group were written but not all,
+// readers of their keys would see part of the group
+func (b *bitcaskStorage) failGroup(ops []writeOp, err error) {
+    b.failMu.Lock()
+    defer b.failMu.Unlock()
+    b.failed = fmt.Errorf("a commit group failed half written, reopen the storage to drop it: %s", err)
+    b.failedKeys = make(map[string]bool)
+    for _, op := range ops {
+        b.failedKeys[string(op.key)] = true
+    }
+}
+
+// writeOp writes op with a trailer. A delete is written as a value flagged
+// recordDeleted, so its record tells the key, then as bitcask's tombstone.
+func (b *bitcaskStorage) writeOp(op writeOp, flags byte, now uint32) error {
+    m := &recordMeta{key: op.key, value: op.value, expireAt: op.expireAt, flags: flags, timestamp: now}
+    if op.del {
+        m.value = nil
+        m.flags |= recordDeleted
+        if err := b.BitCask.Set(op.key, encodeRecordValue(m)); err != nil {
+            return bitcaskError(err)
+        }
+        if err := bitcaskError(b.BitCask.Del(op.key)); err != nil && err != ErrKeyNotFound {
+            return err
+        }
+        return nil
+    }
+    if op.expireAt != 0 {
+        return bitcaskError(b.BitCask.SetWithExpr(op.key, encodeRecordValue(m), op.expireAt))
+    }
+    return bitcaskError(b.BitCask.Set(op.key, encodeRecordValue(m)))
+}
+
+// unfinishedGroup returns where the last commit group of the data-files starts if
+// it has no end, or -1. Groups may span data-files, the scan goes back from the
+// active one to the last group end.
+func (b *bitcaskStorage) unfinishedGroup() (int64, int64, error) {
+    ids := dataFileIds(b)
+    startFileId, start := int64(-1), int64(-1)
+    for i := len(ids) - 1; i >= 0; i-- {
+        // where the group open at the end of the file starts in it
+        open := int64(-1)
+        ended := false
+        for offset := int64(0); ; {
+            rec, err := b.RefRecord(ids[i], offset)
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return -1, -1, err
+            }
+            if rec.Key() != nil {
+                if !rec.More() {
+                    open, ended = -1, true
+                } else if open < 0 {
+                    open = offset
+                }
+            }
+            offset += rec.Size()
+        }
+        if open < 0 {
+            // no group goes on past this file
+            break
+        }
+        startFileId, start = ids[i], open
+        if ended {
+            break
+        }
+    }
+    return startFileId, start, nil
+}
+
+// FirstKeyUnderSlot skips keys left by interrupted deletes, removing them
+func (b *bitcaskStorage) FirstKeyUnderSlot(slot uint32) ([]byte, error) {
+    for {
+        key, err := b.BitCask.FirstKeyUnderSlot(slot)
+        if err != nil || key == nil {
+            return key, err
+        }
+        if _, err := b.Get(key); err != ErrKeyNotFound {
+            return key, nil
+        }
+        if err := bitcaskError(b.BitCask.DelLocal(key)); err != nil && err != ErrKeyNotFound {
+            return nil, err
+        }
+    }
+}
+
+func (b *bitcaskStorage) AllKeysWithTag(tag []byte) ([][]byte, error) {
+    keys, err := b.BitCask.AllKeysWithTag(tag)
+    if err != nil {
+        return nil, err
+    }
+    live := keys[:0]
+    for _, key := range keys {
+        if _, err := b.Get(key); err == nil {
+            live = append(live, key)
+        }
+    }
+    return live, nil
+}
+
+// ForEachKey lists live keys by scanning the data-files, see keyIterator. Values
+// written by older versions hide their keys, it returns errNoKeyIterator then.
+func (b *bitcaskStorage) ForEachKey(f func(key []byte) bool) error {
+    seen := make(map[string]bool)
+    g := &recordGroup{}
+    for _, fileId := range dataFileIds(b) {
+        for offset := int64(0); ; {
+            rec, err := b.RefRecord(fileId, offset)
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return err
+            }
+            offset += rec.Size()
+            // only to tell tombstones from values without trailer
+            g.add(rec)
+            if g.hidden {
+                return errNoKeyIterator
+            }
+            key := rec.Key()
+            if key == nil || seen[string(key)] {
+                continue
+            }
+            seen[string(key)] = true
+            if _, err := b.Get(key); err == ErrKeyNotFound {
+                continue
+            } else if err != nil {
+                return err
+            }
+            if !f(key) {
+                return nil
+            }
+        }
+    }
+    return nil
+}
+
+func (b *bitcaskStorage) GetFileMetas() []*FileMeta {
+    var metas []*FileMeta
+    for _, meta := range b.BitCask.GetFileMetas() {
+        metas = append(metas, &FileMeta{FileId: meta.FileId, Md5: meta.Md5})
+    }
+    return metas
+}
+
+func (b *bitcaskStorage) RefRecord(fileId int64, offset int64) (Record, error) {
+    rec, err := b.BitCask.RefRecord(fileId, offset)
+    if err != nil {
+        return nil, err
+    }
+    data, err := rec.Encode()
+    if err != nil {
+        return nil, err
+    }
+    return newDataRecord(rec.Size(), data), nil
+}
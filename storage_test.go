@@ -0,0 +1,162 @@
+package bitserver
+
+import (
+    "io"
+    . "gopkg.in/check.v1"
+)
+
+type testStorageSuite struct {
+    s *testSvrNode
+}
+
+var _ = Suite(&testStorageSuite{})
+
+func (s *testStorageSuite) SetUpSuite(c *C) {
+    config := DefaultConfig()
+    config.Listen = 17930
+    config.Dbpath = c.MkDir()
+    config.Storage = StorageMemory
+    s.s = testCreateServerWithConfig(c, config)
+}
+
+func (s *testStorageSuite) TearDownSuite(c *C) {
+    if s.s != nil {
+        s.s.Close()
+    }
+}
+
+func (s *testStorageSuite) TestMemStorage(c *C) {
+    m := newMemStorage()
+    _, err := m.Get([]byte("a"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    c.Assert(m.SetWithExpr([]byte("{t}b"), []byte("2"), 100), IsNil)
+    c.Assert(m.Set([]byte("{t}a"), []byte("1")), IsNil)
+    value, expireAt, err := m.GetWithExpr([]byte("{t}b"))
+    c.Assert(err, IsNil)
+    c.Assert(string(value), Equals, "2")
+    c.Assert(expireAt, Equals, uint32(100))
+
+    keys, err := m.AllKeysWithTag([]byte("t"))
+    c.Assert(err, IsNil)
+    c.Assert(keys, DeepEquals, [][]byte{[]byte("{t}a"), []byte("{t}b")})
+    _, slot := HashKeyToSlot([]byte("{t}a"))
+    first, err := m.FirstKeyUnderSlot(slot)
+    c.Assert(err, IsNil)
+    c.Assert(string(first), Equals, "{t}a")
+
+    c.Assert(m.Del([]byte("{t}a")), IsNil)
+    c.Assert(m.Del([]byte("{t}a")), Equals, ErrKeyNotFound)
+    c.Assert(m.ClearAll(), IsNil)
+    first, err = m.FirstKeyUnderSlot(slot)
+    c.Assert(err, IsNil)
+    c.Assert(first, IsNil)
+}
+
+func (s *testStorageSuite) TestServer(c *C) {
+    nc := testGetConn(c, s.s.port)
+    defer nc.Close()
+
+    nc.checkOK(c, "set", "a", "1")
+    nc.checkString(c, "1", "get", "a")
+    nc.checkInt(c, 1, "del", "a")
+    nc.checkOK(c, "slotsrestore", "b", 0, "2")
+    nc.checkString(c, "2", "get", "b")
+    nc.checkOK(c, "flushall")
+    nc.checkInt(c, 0, "del", "b")
+
+    nc.checkError(c, "the storage has no data-files", "backup", c.MkDir())
+    nc.checkError(c, "the storage has no data-files", "slaveof", "127.0.0.1", 17931)
+}
+
+// readRecords decodes the records of the active data-file of b
+func readRecords(c *C, b *bitcaskStorage) []Record {
+    var recs []Record
+    fileId := b.ActiveFileId()
+    for offset := int64(0); ; {
+        rec, err := b.RefRecord(fileId, offset)
+        if err == io.EOF {
+            return recs
+        }
+        c.Assert(err, IsNil)
+        recs = append(recs, rec)
+        offset += rec.Size()
+    }
+}
+
+func (s *testStorageSuite) TestBitcaskGroups(c *C) {
+    b, err := openBitcaskStorage(c.MkDir())
+    c.Assert(err, IsNil)
+    defer b.Close()
+
+    c.Assert(b.Set([]byte("a"), []byte("0")), IsNil)
+    c.Assert(b.WriteBatch([]writeOp{
+        {key: []byte("a"), value: []byte("1")},
+        {key: []byte("b"), value: []byte("2"), expireAt: 100},
+        {key: []byte("a"), del: true},
+        {key: []byte("none"), del: true},
+    }), IsNil)
+    _, err = b.Get([]byte("a"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+    value, expireAt, err := b.GetWithExpr([]byte("b"))
+    c.Assert(err, IsNil)
+    c.Assert(string(value), Equals, "2")
+    c.Assert(expireAt, Equals, uint32(100))
+
+    // records tell their keys and where groups end, tombstones of bitcask have no key
+    var keys []string
+    var more []bool
+    for _, rec := range readRecords(c, b) {
+        if rec.Key() == nil {
+            continue
+        }
+        keys = append(keys, string(rec.Key()))
+        more = append(more, rec.More())
+        c.Assert(rec.Timestamp() > 0, Equals, true)
+    }
+    c.Assert(keys, DeepEquals, []string{"a", "a", "b", "a"})
+    c.Assert(more, DeepEquals, []bool{false, true, true, false})
+}
+
+func (s *testStorageSuite) TestBitcaskRecoverGroup(c *C) {
+    dir := c.MkDir()
+    b, err := openBitcaskStorage(dir)
+    c.Assert(err, IsNil)
+
+    // a crash after the first op of a group
+    c.Assert(b.Set([]byte("x"), []byte("0")), IsNil)
+    c.Assert(b.writeOp(writeOp{key: []byte("x"), value: []byte("1")}, recordMore, 0), IsNil)
+    c.Assert(b.writeOp(writeOp{key: []byte("y"), del: true}, recordMore, 0), IsNil)
+    b.Close()
+
+    // the group is dropped whole
+    b, err = openBitcaskStorage(dir)
+    c.Assert(err, IsNil)
+    defer b.Close()
+    value, err := b.Get([]byte("x"))
+    c.Assert(err, IsNil)
+    c.Assert(string(value), Equals, "0")
+    recs := readRecords(c, b)
+    c.Assert(recs, HasLen, 1)
+    c.Assert(recs[0].More(), Equals, false)
+    c.Assert(b.Set([]byte("y"), []byte("2")), IsNil)
+}
+
+func (s *testStorageSuite) TestBitcaskFailedGroup(c *C) {
+    b, err := openBitcaskStorage(c.MkDir())
+    c.Assert(err, IsNil)
+    defer b.Close()
+
+    c.Assert(b.Set([]byte("u"), []byte("old")), IsNil)
+    c.Assert(b.Set([]byte("w"), []byte("other")), IsNil)
+    // ops of a group written before one failed
+    c.Assert(b.writeOp(writeOp{key: []byte("u"), value: []byte("new")}, recordMore, 0), IsNil)
+    b.failGroup([]writeOp{{key: []byte("u")}, {key: []byte("v")}}, io.ErrShortWrite)
+
+    _, err = b.Get([]byte("u"))
+    c.Assert(err, ErrorMatches, "a commit group failed half written.*")
+    value, err := b.Get([]byte("w"))
+    c.Assert(err, IsNil)
+    c.Assert(string(value), Equals, "other")
+    c.Assert(b.Set([]byte("w"), []byte("x")), ErrorMatches, "a commit group failed half written.*")
+}
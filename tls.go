@@ -0,0 +1,61 @@
+package bitserver
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "time"
+)
+
+func (c *Config) tlsEnabled() bool {
+    return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// newTLSConfig loads certs of config, used for both listener and outgoing connections
+func newTLSConfig(c *Config) (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+    if err != nil {
+        return nil, err
+    }
+    conf := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion: tls.VersionTLS12,
+    }
+
+    if c.TLSCAFile != "" {
+        pem, err := ioutil.ReadFile(c.TLSCAFile)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificate found in %s", c.TLSCAFile)
+        }
+        conf.RootCAs = pool
+        conf.ClientCAs = pool
+    }
+
+    if c.TLSAuthClients {
+        if conf.ClientCAs == nil {
+            return nil, fmt.Errorf("tls client auth needs a ca file")
+        }
+        conf.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return conf, nil
+}
+
+// dial connects to addr, with tls if replication tls is enabled
+func (s *Server) dial(addr string, timeout time.Duration) (net.Conn, error) {
+    if s.tlsConfig == nil || !s.config.TLSReplication {
+        return net.DialTimeout("tcp", addr, timeout)
+    }
+
+    conf := s.tlsConfig.Clone()
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        conf.ServerName = host
+    }
+    dialer := &net.Dialer{Timeout: timeout}
+    return tls.DialWithDialer(dialer, "tcp", addr, conf)
+}
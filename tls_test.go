@@ -0,0 +1,159 @@
+package bitserver
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "path/filepath"
+    "time"
+    . "gopkg.in/check.v1"
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+type testTLSSuite struct {
+    dir string
+    caFile string
+    certFile string
+    keyFile string
+}
+
+var _ = Suite(&testTLSSuite{})
+
+func testWritePem(c *C, path string, typ string, der []byte) {
+    data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+    c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+}
+
+// self-signed ca, and a cert for 127.0.0.1 signed by it
+func (s *testTLSSuite) SetUpSuite(c *C) {
+    s.dir = c.MkDir()
+
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    c.Assert(err, IsNil)
+    ca := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "bitserver test ca"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        KeyUsage: x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+    }
+    caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+    c.Assert(err, IsNil)
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    c.Assert(err, IsNil)
+    leaf := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{CommonName: "bitserver"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    leafDer, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+    c.Assert(err, IsNil)
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    c.Assert(err, IsNil)
+
+    s.caFile = filepath.Join(s.dir, "ca.pem")
+    s.certFile = filepath.Join(s.dir, "cert.pem")
+    s.keyFile = filepath.Join(s.dir, "key.pem")
+    testWritePem(c, s.caFile, "CERTIFICATE", caDer)
+    testWritePem(c, s.certFile, "CERTIFICATE", leafDer)
+    testWritePem(c, s.keyFile, "EC PRIVATE KEY", keyDer)
+}
+
+func (s *testTLSSuite) createServer(c *C, port int, authClients bool) *testSvrNode {
+    config := DefaultConfig()
+    config.Listen = port
+    config.Dbpath = c.MkDir()
+    config.TLSCertFile = s.certFile
+    config.TLSKeyFile = s.keyFile
+    config.TLSCAFile = s.caFile
+    config.TLSAuthClients = authClients
+    config.TLSReplication = true
+    return testCreateServerWithConfig(c, config)
+}
+
+func (s *testTLSSuite) getConn(c *C, port int, withCert bool) (*testConn, error) {
+    config := DefaultConfig()
+    config.TLSCAFile = s.caFile
+    config.TLSCertFile = s.certFile
+    config.TLSKeyFile = s.keyFile
+    conf, err := newTLSConfig(config)
+    c.Assert(err, IsNil)
+    if !withCert {
+        conf.Certificates = nil
+    }
+
+    nc, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), conf)
+    if err != nil {
+        return nil, err
+    }
+    // finish the handshake, so a rejected client cert shows up here
+    if err := nc.Handshake(); err != nil {
+        nc.Close()
+        return nil, err
+    }
+    return testNewConn(nc), nil
+}
+
+func (s *testTLSSuite) TestClient(c *C) {
+    node := s.createServer(c, 17810, false)
+    defer node.Close()
+
+    nc, err := s.getConn(c, node.port, false)
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+    nc.checkString(c, "1", "get", "a")
+}
+
+func (s *testTLSSuite) TestMutualAuth(c *C) {
+    node := s.createServer(c, 17811, true)
+    defer node.Close()
+
+    if nc, err := s.getConn(c, node.port, false); err == nil {
+        // tls 1.3 reports the rejected cert on first read
+        _, err = nc.Receive()
+        nc.Close()
+        c.Assert(err, NotNil)
+    }
+
+    nc, err := s.getConn(c, node.port, true)
+    c.Assert(err, IsNil)
+    defer nc.Close()
+    nc.checkOK(c, "set", "a", "1")
+}
+
+func (s *testTLSSuite) TestReplication(c *C) {
+    master := s.createServer(c, 17812, true)
+    defer master.Close()
+    slave := s.createServer(c, 17813, true)
+    defer slave.Close()
+
+    mc, err := s.getConn(c, master.port, true)
+    c.Assert(err, IsNil)
+    defer mc.Close()
+    sc, err := s.getConn(c, slave.port, true)
+    c.Assert(err, IsNil)
+    defer sc.Close()
+
+    mc.checkOK(c, "set", "a", "100")
+    sc.checkOK(c, "slaveof", "127.0.0.1", master.port)
+    time.Sleep(2000 * time.Millisecond)
+    resp := sc.doCmd(c, "get", "a")
+    c.Assert(resp, DeepEquals, redis.NewBulkBytesWithString("100"))
+    sc.checkOK(c, "slaveof", "no", "one")
+}
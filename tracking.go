@@ -0,0 +1,108 @@
+package bitserver
+
+import (
+    redis "github.com/reborndb/go/redis/resp"
+)
+
+// Client side caching, in the default mode of redis: keys read by a conn with
+// CLIENT TRACKING on are remembered, and the first write of one of them pushes
+// an "invalidate" message to the conn. Pushes go through the subscriber queue
+// of the conn, so they need RESP3 to be told apart from replies.
+
+// setTracking turns tracking of the keys c reads on or off
+func (s *Server) setTracking(c *conn, on bool) {
+    sub := s.subscriber(c)
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    if !on {
+        s.untrackLocked(c)
+    }
+    sub.tracking = on
+}
+
+// untrackLocked forgets the keys read by c, s.pubsub must be held
+func (s *Server) untrackLocked(c *conn) {
+    for key, _ := range c.sub.tracked {
+        s.unsubscribeLocked(s.pubsub.tracking, key, c)
+    }
+    c.sub.tracked = make(map[string]struct{})
+}
+
+// anyTracking tells if some key is tracked, writes check it before taking
+// s.pubsub exclusively
+func (s *Server) anyTracking() bool {
+    s.pubsub.RLock()
+    defer s.pubsub.RUnlock()
+    return len(s.pubsub.tracking) != 0
+}
+
+// trackReads remembers the stored keys a read only command of c reads. It's
+// called before the command runs, a write in between is told rather than lost.
+func (s *Server) trackReads(c *conn, f *command, args [][]byte) {
+    if c.sub == nil || !c.sub.tracking {
+        return
+    }
+    keys := f.keys(args)
+    if len(keys) == 0 {
+        return
+    }
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    if c.sub.closed {
+        return
+    }
+    if s.pubsub.tracking == nil {
+        s.pubsub.tracking = make(map[string]map[*conn]struct{})
+    }
+    for _, key := range keys {
+        key := string(c.dbKey(key))
+        c.sub.tracked[key] = struct{}{}
+        if s.pubsub.tracking[key] == nil {
+            s.pubsub.tracking[key] = make(map[*conn]struct{})
+        }
+        s.pubsub.tracking[key][c] = struct{}{}
+    }
+}
+
+// invalidateKeys pushes "invalidate" to conns that read the stored keys, they
+// are told once until they read them again
+func (s *Server) invalidateKeys(keys ...[]byte) {
+    if !s.anyTracking() {
+        return
+    }
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    for _, key := range keys {
+        conns := s.pubsub.tracking[string(key)]
+        if conns == nil {
+            continue
+        }
+        delete(s.pubsub.tracking, string(key))
+        _, k := decodeDbKey(key)
+        for c, _ := range conns {
+            delete(c.sub.tracked, string(key))
+            s.push(c, newPush("invalidate", &redis.Array{Value: []redis.Resp{redis.NewBulkBytes(k)}}))
+        }
+    }
+}
+
+// invalidateAllKeys pushes "invalidate" with a null to all tracking conns, as
+// redis does once its dataset is flushed
+func (s *Server) invalidateAllKeys() {
+    if !s.anyTracking() {
+        return
+    }
+    s.pubsub.Lock()
+    defer s.pubsub.Unlock()
+    told := make(map[*conn]struct{})
+    for _, conns := range s.pubsub.tracking {
+        for c, _ := range conns {
+            told[c] = struct{}{}
+        }
+    }
+    s.pubsub.tracking = nil
+    for c, _ := range told {
+        c.sub.tracked = make(map[string]struct{})
+        s.push(c, newPush("invalidate", &redis.Array{}))
+    }
+}